@@ -7,6 +7,8 @@ require (
 	github.com/google/go-github/v55 v55.0.0
 	github.com/stretchr/testify v1.9.0
 	github.com/studio-b12/gowebdav v0.9.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -16,8 +18,6 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sys v0.23.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
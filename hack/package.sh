@@ -1,6 +1,18 @@
 #!/bin/bash
 
+# The tag builds embed the tag, so that the updater compares the running version with the releases. The other builds
+# embed the git describe output, that the updater handles as a development build of the last tag.
+if [ -z "${VERSION:-}" ]; then
+  if [ "${GITHUB_REF_TYPE:-}" = "tag" ]; then
+    VERSION="${GITHUB_REF_NAME}"
+  else
+    VERSION="$(git describe --tags --always --dirty)"
+  fi
+fi
+
 mkdir -p _artifacts/
-${DOCKER_CMD:-docker} build --squash --output type=tar,dest=./_artifacts/KoboRoot.tar ./
+${DOCKER_CMD:-docker} build --squash --build-arg RELEASE_PUBLIC_KEY="${RELEASE_PUBLIC_KEY:-}" \
+  --build-arg VERSION="${VERSION}" \
+  --output type=tar,dest=./_artifacts/KoboRoot.tar ./
 gzip -f ./_artifacts/KoboRoot.tar
 mv ./_artifacts/KoboRoot.tar.gz ./_artifacts/KoboRoot.tgz
@@ -0,0 +1,11 @@
+#!/bin/bash
+# Generates the SHA256SUMS file for the release artifacts and signs it with minisign.
+# The SHA256SUMS and SHA256SUMS.minisig files must be uploaded to the release along with the KoboRoot.tgz, or the
+# auto-update will refuse to install it.
+set -euo pipefail
+
+MINISIGN_SECRET_KEY=${MINISIGN_SECRET_KEY:-~/.minisign/minisign.key}
+
+cd _artifacts/
+sha256sum KoboRoot.tgz > SHA256SUMS
+minisign -S -s "${MINISIGN_SECRET_KEY}" -m SHA256SUMS
@@ -2,32 +2,491 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/aleskandro/nextcloud-kobo-synchronizer/pkg"
 )
 
+// The exit codes of the commands, for scripting. The flag package exits with 2 on usage errors.
+const (
+	exitCodeError = 1
+	exitCodeUsage = 2
+	// installationChangedExitCode tells run.sh that the installation changed and that it has to reload itself
+	installationChangedExitCode = 3
+	// exitCodeSyncFailed means that some remotes failed to sync, or to plan
+	exitCodeSyncFailed = 4
+	// exitCodeSyncSkipped means that the sync was skipped, e.g. because of the network or the battery, or cancelled
+	exitCodeSyncSkipped = 5
+	// exitCodeUpdateAvailable is returned by update check when there is a version to update to
+	exitCodeUpdateAvailable = 6
+	// exitCodeAlreadyRunning is returned by daemon, supervise, sync and update apply when another instance holds the
+	// lock
+	exitCodeAlreadyRunning = pkg.ExitCodeAlreadyRunning
+)
+
+// options are the flags shared by all the commands.
+type options struct {
+	configFilePath string
+	basePath       string
+}
+
+// configPath is the directory of the configuration file, that also stores the history, the logs and the updates.
+func (o *options) configPath() string {
+	return filepath.Dir(o.configFilePath)
+}
+
+// loadConfig loads the configuration and sends the logs to the standard error, for the commands run from a terminal.
+func (o *options) loadConfig() (*pkg.Config, error) {
+	config, err := pkg.LoadConfig(o.configFilePath, o.basePath)
+	if err != nil {
+		return nil, err
+	}
+	pkg.SetupConsoleLogging(os.Stderr, config)
+	return config, nil
+}
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(o *options, flags *flag.FlagSet, args []string) int
+}
+
+var commands = []command{
+	{"daemon", "daemon [-sync]", "Sync every time the device connects to a network (default)", daemon},
+	{"supervise", "supervise [-sync] [-backup-binary path]", "Run the daemon, restarting it when it exits", supervise},
+	{"stop", "stop [-timeout duration]", "Stop the running supervisor or daemon", stop},
+	{"restart", "restart", "Restart the daemon run by the supervisor", restart},
+	{"sync", "sync [-profile name] [-yes]", "Sync once without D-Bus and print the outcome", syncOnce},
+	{"validate", "validate", "Check the configuration file", validate},
+	{"plan", "plan [-profile name]", "Print the changes the sync would apply, without applying them", plan},
+	{"status", "status [-json]", "Print the version, the last sync and the state of the updates", status},
+	{"history", "history [-n N] [-json]", "Print the last sync runs", history},
+	{"diagnose", "diagnose [-upload]", "Write a redacted diagnostic bundle, and upload it if requested", diagnose},
+	{"update", "update check|apply", "Check for an update, or download and install it", update},
+	{"version", "version", "Print the version", version},
+}
+
 func main() {
-	configFilePath := flag.String("config-file", "", "The path to the yaml config file")
-	basePath := flag.String("base-path", "", "The base path to use for relative paths in the config file")
-	sync := flag.Bool("sync", false, "Run the syncer at startup")
+	o := &options{}
+	flag.StringVar(&o.configFilePath, "config-file", "/mnt/onboard/.adds/nextcloud-kobo/config.yaml",
+		"The path to the yaml config file")
+	flag.StringVar(&o.basePath, "base-path", "/mnt/onboard/nextcloud",
+		"The base path to use for relative paths in the config file")
+	// prestart is a flag rather than a command so that the previous versions, run from the backup, understand it too
+	prestart := flag.Bool("prestart", false,
+		"Apply the pending update or roll back a failed one, then exit. Used by the supervisor before starting the daemon")
+	applyUpdate := flag.Bool("apply-update", true, "Apply the pending update in the prestart step, if any")
+	flag.Usage = usage
 	flag.Parse()
-	config, err := pkg.LoadConfig(*configFilePath, *basePath)
+	if *prestart {
+		os.Exit(runPrestart(o, *applyUpdate))
+	}
+	name, args := "daemon", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(o, newFlagSet(c), args))
+		}
+	}
+	//nolint:errcheck
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+	usage()
+	os.Exit(exitCodeUsage)
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	//nolint:errcheck
+	fmt.Fprintf(w, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		//nolint:errcheck
+		fmt.Fprintf(w, "  %-28s %s\n", c.usage, c.description)
+	}
+	//nolint:errcheck
+	fmt.Fprintln(w, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// newFlagSet returns the flag set of a command, printing its usage line on errors.
+func newFlagSet(c command) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	flags.Usage = func() {
+		//nolint:errcheck
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] %s\n", os.Args[0], c.usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func runPrestart(o *options, applyUpdate bool) int {
+	closer := setupLogging(o.configFilePath, nil)
+	//nolint:errcheck
+	defer closer.Close()
+	changed, err := pkg.Prestart(o.configPath(), applyUpdate)
+	switch {
+	case err != nil:
+		slog.Error("NextCloud Kobo syncer failed at applying the update", "error", err)
+		return exitCodeError
+	case changed:
+		return installationChangedExitCode
+	}
+	return 0
+}
+
+// daemon listens to the network connections from Nickel and syncs the remotes. It returns ExitCodeApplyUpdate when
+// an update has been downloaded and the supervisor has to apply it.
+func daemon(o *options, flags *flag.FlagSet, args []string) int {
+	sync := flags.Bool("sync", false, "Run the syncer at startup")
+	//nolint:errcheck
+	flags.Parse(args)
+	// only one daemon writes the logs and reacts to the network connections
+	lock, err := pkg.LockInstance(o.configPath(), pkg.InstanceDaemon, pkg.InstanceDaemon)
 	if err != nil {
-		log.Println("NextCloud Kobo syncer failed at loading config")
-		log.Println(err)
-		return
+		return lockFailed("Nextcloud-Kobo not started:", err)
+	}
+	//nolint:errcheck
+	defer lock.Release()
+	// the logging options are in the configuration: load it first, and log its errors once the logs are set up
+	config, err := pkg.LoadConfig(o.configFilePath, o.basePath)
+	closer := setupLogging(o.configFilePath, config)
+	//nolint:errcheck
+	defer closer.Close()
+	slog.Info("NextCloud Kobo syncer", "version", pkg.RunningVersion())
+	if err != nil {
+		slog.Error("NextCloud Kobo syncer failed at loading config", "error", err)
+		return exitCodeError
 	}
 	ctx := SetupSignalHandler()
 	controller := pkg.NewNetworkConnectionReconciler(config, ctx)
 	if *sync {
-		controller.HandleWmNetworkConnected(ctx)
+		controller.TriggerSync(ctx, pkg.TriggerStartup)
+	}
+	return controller.Run(ctx)
+}
+
+// supervise applies the updates and runs the daemon, restarting it when it exits, as started by run.sh. SIGHUP
+// restarts the daemon. It returns installationChangedExitCode when the installation changed, so that run.sh starts
+// the new supervisor.
+func supervise(o *options, flags *flag.FlagSet, args []string) int {
+	sync := flags.Bool("sync", false, "Sync at the first start of the daemon")
+	backup := flags.String("backup-binary", "",
+		"The binary of the previous installation, that applies the updates when the installed one cannot")
+	//nolint:errcheck
+	flags.Parse(args)
+	lock, err := pkg.LockInstance(o.configPath(), pkg.InstanceSupervisor, pkg.InstanceSupervisor)
+	if err != nil {
+		return lockFailed("Nextcloud-Kobo not started:", err)
+	}
+	//nolint:errcheck
+	defer lock.Release()
+	executable, err := os.Executable()
+	if err != nil {
+		return fail("Failed to find the executable:", err)
+	}
+	restarts := make(chan struct{}, 1)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			select {
+			case restarts <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	slog.Info("NextCloud Kobo supervisor", "version", pkg.RunningVersion())
+	if pkg.Supervise(SetupSignalHandler(), restarts, pkg.SupervisorOptions{ConfigFilePath: o.configFilePath,
+		BasePath: o.basePath, Executable: executable, BackupExecutable: *backup, Sync: *sync, Output: os.Stderr}) {
+		return installationChangedExitCode
+	}
+	return 0
+}
+
+// stop stops the supervisor, or the daemon started without it, and waits for it to exit.
+func stop(o *options, flags *flag.FlagSet, args []string) int {
+	timeout := flags.Duration("timeout", time.Minute, "The time to wait for the instance to exit")
+	//nolint:errcheck
+	flags.Parse(args)
+	instance, err := pkg.StopInstance(o.configPath(), *timeout)
+	if errors.Is(err, pkg.ErrNotRunning) {
+		fmt.Println("Nextcloud-Kobo is not running")
+		return 0
+	}
+	if err != nil {
+		return fail("Failed to stop Nextcloud-Kobo:", err)
+	}
+	fmt.Printf("Nextcloud-Kobo %s stopped\n", instance)
+	return 0
+}
+
+// restart asks the supervisor to restart the daemon, e.g. after changing the configuration.
+func restart(o *options, flags *flag.FlagSet, args []string) int {
+	//nolint:errcheck
+	flags.Parse(args)
+	if err := pkg.RestartInstance(o.configPath()); err != nil {
+		return fail("Failed to restart the daemon:", err)
+	}
+	fmt.Println("Nextcloud-Kobo daemon restarting")
+	return 0
+}
+
+// lockFailed reports that the instance could not be locked, with exitCodeAlreadyRunning if another one holds it.
+func lockFailed(message string, err error) int {
+	//nolint:errcheck
+	fmt.Fprintln(os.Stderr, message, err)
+	if errors.Is(err, pkg.ErrAlreadyRunning) {
+		return exitCodeAlreadyRunning
+	}
+	return exitCodeError
+}
+
+// lockInstances locks the instances for the command in order, releasing the locks already acquired if one of them
+// fails. The commands changing what the daemon works on lock it, so that they do not run at the same time.
+func lockInstances(configPath, command string, instances ...string) (release func(), err error) {
+	var locks []*pkg.InstanceLock
+	release = func() {
+		for _, lock := range locks {
+			//nolint:errcheck
+			lock.Release()
+		}
+	}
+	for _, instance := range instances {
+		lock, err := pkg.LockInstance(configPath, instance, command)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return release, nil
+}
+
+// syncOnce syncs the remotes once, printing the toasts to the standard output and the logs to the standard error.
+func syncOnce(o *options, flags *flag.FlagSet, args []string) int {
+	profile := flags.String("profile", "", "The profile to use instead of the one selected by the Wi-Fi network")
+	assumeYes := flags.Bool("yes", false, "Accept the confirmations instead of taking the safe choice")
+	//nolint:errcheck
+	flags.Parse(args)
+	// the sync takes the place of the daemon, that would sync the same files at the same time
+	release, err := lockInstances(o.configPath(), "sync", pkg.InstanceDaemon)
+	if err != nil {
+		return lockFailed("Nextcloud-Kobo not synced:", err)
+	}
+	defer release()
+	config, err := o.loadConfig()
+	if err != nil {
+		return fail("Failed to load the configuration:", err)
+	}
+	controller, err := pkg.NewOneShotReconciler(config, os.Stdout,
+		pkg.OneShotOptions{Profile: *profile, AssumeYes: *assumeYes})
+	if err != nil {
+		return fail("Failed to sync:", err)
+	}
+	run := controller.SyncOnce(SetupSignalHandler())
+	if run == nil {
+		return fail("Failed to sync:", fmt.Errorf("the run was not recorded"))
+	}
+	if run.Reason != "" {
+		//nolint:errcheck
+		fmt.Fprintf(os.Stdout, "Sync %s: %s\n", run.Outcome, run.Reason)
+	}
+	return runExitCode(run)
+}
+
+func validate(o *options, flags *flag.FlagSet, args []string) int {
+	//nolint:errcheck
+	flags.Parse(args)
+	config, err := o.loadConfig()
+	if err != nil {
+		return fail("Invalid configuration:", err)
+	}
+	//nolint:errcheck
+	fmt.Fprintf(os.Stdout, "Configuration is valid: %d remotes, %d profiles\n", len(config.Remotes),
+		len(config.Profiles))
+	return 0
+}
+
+func plan(o *options, flags *flag.FlagSet, args []string) int {
+	profile := flags.String("profile", "", "The profile to use instead of the one selected by the Wi-Fi network")
+	//nolint:errcheck
+	flags.Parse(args)
+	config, err := o.loadConfig()
+	if err != nil {
+		return fail("Failed to load the configuration:", err)
+	}
+	controller, err := pkg.NewOneShotReconciler(config, os.Stdout, pkg.OneShotOptions{Profile: *profile})
+	if err != nil {
+		return fail("Failed to plan the sync:", err)
+	}
+	failed, err := controller.PrintPlan(SetupSignalHandler(), os.Stdout)
+	if err != nil {
+		return fail("Failed to plan the sync:", err)
+	}
+	if failed > 0 {
+		return exitCodeSyncFailed
+	}
+	return 0
+}
+
+// status prints the status found in the configuration directory. Its exit code is the one of the last sync.
+func status(o *options, flags *flag.FlagSet, args []string) int {
+	asJSON := flags.Bool("json", false, "Print the status as JSON")
+	//nolint:errcheck
+	flags.Parse(args)
+	s, err := pkg.ReadDeviceStatus(o.configPath())
+	if err == nil {
+		err = pkg.PrintDeviceStatus(os.Stdout, s, *asJSON)
+	}
+	if err != nil {
+		return fail("Failed to read the status:", err)
+	}
+	if s.LastRun == nil {
+		return 0
+	}
+	return runExitCode(s.LastRun)
+}
+
+// history prints the last sync runs recorded in the configuration directory.
+func history(o *options, flags *flag.FlagSet, args []string) int {
+	last := flags.Int("n", 10, "The number of runs to print, 0 for all")
+	asJSON := flags.Bool("json", false, "Print the runs as JSON")
+	//nolint:errcheck
+	flags.Parse(args)
+	runs, err := pkg.ReadHistory(o.configPath(), *last)
+	if err == nil {
+		err = pkg.PrintHistory(os.Stdout, runs, *asJSON)
+	}
+	if err != nil {
+		return fail("Failed to print the sync history:", err)
+	}
+	return 0
+}
+
+// diagnose writes a diagnostic bundle in the configuration directory, even if the configuration is invalid, and
+// uploads it with -upload.
+func diagnose(o *options, flags *flag.FlagSet, args []string) int {
+	upload := flags.Bool("upload", false, "Upload the bundle to the upload_url of the diagnostics options")
+	//nolint:errcheck
+	flags.Parse(args)
+	path, err := pkg.Diagnose(SetupSignalHandler(),
+		pkg.DiagnoseOptions{ConfigFilePath: o.configFilePath, BasePath: o.basePath, Upload: *upload})
+	if path != "" {
+		fmt.Printf("Diagnostic bundle written to %s\n", path)
+	}
+	if err != nil {
+		return fail("Failed to create the diagnostic bundle:", err)
+	}
+	if *upload {
+		fmt.Println("Diagnostic bundle uploaded")
+	}
+	return 0
+}
+
+// update checks for an update, returning exitCodeUpdateAvailable if there is one, or downloads and installs it,
+// returning installationChangedExitCode once installed. The daemon has to be restarted to run the new version.
+func update(o *options, flags *flag.FlagSet, args []string) int {
+	//nolint:errcheck
+	flags.Parse(args)
+	if flags.NArg() != 1 || flags.Arg(0) != "check" && flags.Arg(0) != "apply" {
+		flags.Usage()
+		return exitCodeUsage
+	}
+	config, err := o.loadConfig()
+	if err != nil {
+		return fail("Failed to load the configuration:", err)
+	}
+	ctx := SetupSignalHandler()
+	if flags.Arg(0) == "check" {
+		check, err := pkg.CheckUpdate(ctx, config)
+		if err != nil {
+			return fail("Failed to check for updates:", err)
+		}
+		switch {
+		case check.Available == "":
+			fmt.Printf("Nextcloud-Kobo %s is up to date\n", orUnknown(check.Current))
+			return 0
+		case check.Pending == check.Available:
+			fmt.Printf("Nextcloud-Kobo %s is downloaded and will be applied at the next start\n", check.Pending)
+		default:
+			fmt.Printf("Nextcloud-Kobo %s is available, the running version is %s\n", check.Available,
+				orUnknown(check.Current))
+		}
+		return exitCodeUpdateAvailable
+	}
+	// the supervisor applies the updates itself, and the daemon must not run while its files are replaced
+	release, err := lockInstances(o.configPath(), "update", pkg.InstanceSupervisor, pkg.InstanceDaemon)
+	if err != nil {
+		return lockFailed("Nextcloud-Kobo not updated, stop it first:", err)
+	}
+	defer release()
+	version, err := pkg.DownloadUpdate(ctx, config)
+	if err != nil {
+		return fail("Failed to download the update:", err)
+	}
+	if version == "" {
+		fmt.Println("Nextcloud-Kobo is up to date")
+		return 0
+	}
+	if _, err = pkg.Prestart(o.configPath(), true); err != nil {
+		return fail("Failed to install the update:", err)
+	}
+	fmt.Printf("Nextcloud-Kobo %s installed, start Nextcloud-Kobo to run it\n", version)
+	return installationChangedExitCode
+}
+
+func version(_ *options, flags *flag.FlagSet, args []string) int {
+	//nolint:errcheck
+	flags.Parse(args)
+	fmt.Println(orUnknown(pkg.RunningVersion()))
+	return 0
+}
+
+// runExitCode returns the exit code reporting the outcome of a sync run.
+func runExitCode(run *pkg.SyncRun) int {
+	switch run.Outcome {
+	case pkg.RunCompleted:
+		return 0
+	case pkg.RunFailed:
+		return exitCodeSyncFailed
+	default:
+		return exitCodeSyncSkipped
+	}
+}
+
+func fail(message string, err error) int {
+	//nolint:errcheck
+	fmt.Fprintln(os.Stderr, message, err)
+	return exitCodeError
+}
+
+func orUnknown(version string) string {
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
+
+// setupLogging sends the logs to the rotated log file next to the configuration file. If the log file cannot be
+// opened, the logs go to the standard error.
+func setupLogging(configFilePath string, config *pkg.Config) io.Closer {
+	closer, err := pkg.SetupLogging(filepath.Dir(configFilePath), config)
+	if err != nil {
+		slog.Error("Failed to set up the log file", "error", err)
+		return io.NopCloser(nil)
 	}
-	controller.Run(ctx)
+	return closer
 }
 
 // Gently stolen from the k8s source code
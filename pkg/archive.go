@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// allowedArchivePrefixes are the only paths a release tarball can write to, as it is extracted in the root of the
+// device filesystem.
+var allowedArchivePrefixes = []string{
+	"usr/local/nextcloud-kobo/",
+	"etc/udev/rules.d/",
+	// the CA bundle shipped with the releases, as the one on the device is often outdated
+	"etc/ssl/certs/",
+}
+
+// validateReleaseArchive checks that the gzipped tarball at archivePath only contains regular files and directories
+// under allowedArchivePrefixes, with no absolute or parent-relative paths, and that its uncompressed size does not
+// exceed maxSize bytes.
+func validateReleaseArchive(archivePath string, maxSize int64) error {
+	file, err := os.Open(path.Clean(archivePath))
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("invalid release archive: %w", err)
+	}
+	//nolint:errcheck
+	defer gz.Close()
+	reader := tar.NewReader(gz)
+	var size int64
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid release archive: %w", err)
+		}
+		name, err := archiveEntryName(header)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if !isAllowedArchiveDir(name) {
+				return fmt.Errorf("release archive contains the unexpected directory %s", header.Name)
+			}
+		case tar.TypeReg:
+			if !isAllowedArchiveFile(name) {
+				return fmt.Errorf("release archive contains the unexpected file %s", header.Name)
+			}
+			if size += header.Size; size > maxSize {
+				return fmt.Errorf("release archive is larger than %d bytes once extracted", maxSize)
+			}
+		default:
+			return fmt.Errorf("release archive contains %s, which is not a regular file or a directory", header.Name)
+		}
+	}
+}
+
+// archiveEntryName returns the cleaned, relative name of a tar entry, failing on absolute or parent-relative paths.
+func archiveEntryName(header *tar.Header) (string, error) {
+	name := header.Name
+	if path.IsAbs(name) || strings.HasPrefix(name, "\\") {
+		return "", fmt.Errorf("release archive contains the absolute path %s", header.Name)
+	}
+	for _, element := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("release archive contains the parent-relative path %s", header.Name)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// isAllowedArchiveDir returns true if dir is one of the allowed prefixes, one of their parents or one of their
+// subdirectories.
+func isAllowedArchiveDir(dir string) bool {
+	if dir == "." {
+		return true
+	}
+	for _, prefix := range allowedArchivePrefixes {
+		if strings.HasPrefix(prefix, dir+"/") || strings.HasPrefix(dir+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowedArchiveFile(name string) bool {
+	for _, prefix := range allowedArchivePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
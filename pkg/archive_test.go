@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTarball returns a gzipped tarball with the given files, and the directories containing them.
+func makeTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var headers []*tar.Header
+	dirs := map[string]bool{}
+	for name, content := range files {
+		for dir := filepath.Dir(name); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			headers = append(headers, &tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		}
+		headers = append(headers, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(content))})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return writeTarball(t, headers, files)
+}
+
+func writeTarball(t *testing.T, headers []*tar.Header, files map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range headers {
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(files[header.Name]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestValidateReleaseArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		errMsg  string
+	}{
+		{
+			name: "valid archive",
+			headers: []*tar.Header{
+				{Name: "./", Typeflag: tar.TypeDir},
+				{Name: "./usr/", Typeflag: tar.TypeDir},
+				{Name: "./usr/local/nextcloud-kobo/", Typeflag: tar.TypeDir},
+				{Name: "./usr/local/nextcloud-kobo/nextcloud-kobo", Typeflag: tar.TypeReg, Size: 4},
+				{Name: "etc/udev/rules.d/97-nextcloud-kobo.rules", Typeflag: tar.TypeReg, Size: 4},
+				{Name: "etc/ssl/certs/ca-certificates.crt", Typeflag: tar.TypeReg, Size: 4},
+			},
+		},
+		{
+			name:    "absolute path",
+			headers: []*tar.Header{{Name: "/usr/local/nextcloud-kobo/run.sh", Typeflag: tar.TypeReg, Size: 4}},
+			errMsg:  "absolute path",
+		},
+		{
+			name:    "parent-relative path",
+			headers: []*tar.Header{{Name: "usr/local/nextcloud-kobo/../../bin/sh", Typeflag: tar.TypeReg, Size: 4}},
+			errMsg:  "parent-relative path",
+		},
+		{
+			name:    "unexpected directory",
+			headers: []*tar.Header{{Name: "usr/bin/", Typeflag: tar.TypeDir}},
+			errMsg:  "unexpected directory",
+		},
+		{
+			name:    "unexpected file",
+			headers: []*tar.Header{{Name: "usr/local/nextcloud-kobo.sh", Typeflag: tar.TypeReg, Size: 4}},
+			errMsg:  "unexpected file",
+		},
+		{
+			name: "symlink",
+			headers: []*tar.Header{{Name: "usr/local/nextcloud-kobo/run.sh", Typeflag: tar.TypeSymlink,
+				Linkname: "/etc/init.d/rcS"}},
+			errMsg: "not a regular file",
+		},
+		{
+			name: "too large",
+			headers: []*tar.Header{
+				{Name: "usr/local/nextcloud-kobo/a", Typeflag: tar.TypeReg, Size: 600},
+				{Name: "usr/local/nextcloud-kobo/b", Typeflag: tar.TypeReg, Size: 600},
+			},
+			errMsg: "larger than 1024 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			for _, header := range tt.headers {
+				files[header.Name] = string(bytes.Repeat([]byte("a"), int(header.Size)))
+			}
+			archivePath := filepath.Join(t.TempDir(), "release.tar.gz")
+			require.NoError(t, os.WriteFile(archivePath, writeTarball(t, tt.headers, files), 0600))
+			err := validateReleaseArchive(archivePath, 1024)
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "release.tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, []byte("not a tarball"), 0600))
+	assert.ErrorContains(t, validateReleaseArchive(archivePath, 1024), "invalid release archive")
+}
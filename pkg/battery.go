@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultPowerSupplyPath = "/sys/class/power_supply"
+
+// BatteryPolicy defines how the sync behaves when the device runs on battery. All the thresholds are percentages of
+// the battery capacity and are ignored while the device is charging.
+type BatteryPolicy struct {
+	// SkipBelow skips the sync entirely when the battery is below this level. 0 disables the check.
+	SkipBelow int `yaml:"skip_below,omitempty"`
+	// SmallFilesOnlyBelow only downloads files smaller than SmallFileSizeMB when the battery is below this level.
+	// 0 disables the check.
+	SmallFilesOnlyBelow int `yaml:"small_files_only_below,omitempty"`
+	// SmallFileSizeMB is the size limit for the files downloaded when SmallFilesOnlyBelow applies. Defaults to 5 MB.
+	SmallFileSizeMB int64 `yaml:"small_file_size_mb,omitempty"`
+	// DeferLargeUntilCharging defers the download of the files larger than LargeFileSizeMB until the device is
+	// charging.
+	DeferLargeUntilCharging bool `yaml:"defer_large_until_charging,omitempty"`
+	// LargeFileSizeMB is the size above which a file is considered large. Defaults to 50 MB.
+	LargeFileSizeMB int64 `yaml:"large_file_size_mb,omitempty"`
+}
+
+// PowerStatus is the state of the battery read from sysfs.
+type PowerStatus struct {
+	// Capacity is the battery level in percent
+	Capacity int
+	Charging bool
+}
+
+// powerDecision is the outcome of the evaluation of the BatteryPolicy against the current PowerStatus.
+type powerDecision struct {
+	// Skip is true if the sync should not run at all
+	Skip bool
+	// MaxFileSize is the maximum size of the files to download, in bytes. 0 means no limit.
+	MaxFileSize int64
+	// Reason explains why the sync is skipped or limited, and it is empty if no restriction applies
+	Reason string
+	// Deferred counts the files that were not downloaded because of MaxFileSize
+	Deferred int
+}
+
+func (p *BatteryPolicy) setDefaults() {
+	if p.SmallFileSizeMB == 0 {
+		p.SmallFileSizeMB = 5
+	}
+	if p.LargeFileSizeMB == 0 {
+		p.LargeFileSizeMB = 50
+	}
+}
+
+func (p *BatteryPolicy) validate() error {
+	for name, level := range map[string]int{"skip_below": p.SkipBelow, "small_files_only_below": p.SmallFilesOnlyBelow} {
+		if level < 0 || level > 100 {
+			return fmt.Errorf("battery_policy.%s must be between 0 and 100", name)
+		}
+	}
+	if p.SmallFileSizeMB < 0 || p.LargeFileSizeMB < 0 {
+		return fmt.Errorf("battery_policy file sizes must not be negative")
+	}
+	return nil
+}
+
+// evaluate returns the restrictions to apply to the sync for the given power status, with the reason in the language
+// of the messages. A nil status means the battery state is unknown, and no restriction applies.
+func (p *BatteryPolicy) evaluate(status *PowerStatus, m *messages) powerDecision {
+	if status == nil || status.Charging {
+		return powerDecision{}
+	}
+	if status.Capacity < p.SkipBelow {
+		return powerDecision{
+			Skip:   true,
+			Reason: m.format(msgBatterySkip, msgData{"Capacity": status.Capacity}),
+		}
+	}
+	if status.Capacity < p.SmallFilesOnlyBelow {
+		return powerDecision{
+			MaxFileSize: p.SmallFileSizeMB << 20,
+			Reason: m.format(msgBatterySmallFiles, msgData{"Capacity": status.Capacity,
+				"SizeMB": p.SmallFileSizeMB}),
+		}
+	}
+	if p.DeferLargeUntilCharging {
+		return powerDecision{
+			MaxFileSize: p.LargeFileSizeMB << 20,
+			Reason:      m.format(msgBatteryLargeFiles, msgData{"SizeMB": p.LargeFileSizeMB}),
+		}
+	}
+	return powerDecision{}
+}
+
+// allows returns true if a file of the given size can be downloaded.
+func (d powerDecision) allows(size int64) bool {
+	return d.MaxFileSize == 0 || size <= d.MaxFileSize
+}
+
+// readPowerStatus looks for a battery in the given sysfs power_supply directory and reads its capacity and charging
+// status. It returns nil if no battery is found.
+func readPowerStatus(dir string) (*PowerStatus, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading power supplies: %w", err)
+	}
+	for _, entry := range entries {
+		supplyPath := filepath.Join(dir, entry.Name())
+		if readSysfsValue(supplyPath, "type") != "Battery" {
+			continue
+		}
+		capacity, err := strconv.Atoi(readSysfsValue(supplyPath, "capacity"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading the capacity of %s: %w", entry.Name(), err)
+		}
+		status := readSysfsValue(supplyPath, "status")
+		return &PowerStatus{
+			Capacity: capacity,
+			Charging: status == "Charging" || status == "Full",
+		}, nil
+	}
+	return nil, nil
+}
+
+func readSysfsValue(dir, name string) string {
+	value, err := os.ReadFile(filepath.Clean(filepath.Join(dir, name)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// evaluatePowerPolicy reads the current power status and evaluates the battery policy against it.
+func (n *NetworkConnectionReconciler) evaluatePowerPolicy() powerDecision {
+	status, err := readPowerStatus(n.config.PowerSupplyPath)
+	if err != nil {
+		slog.Warn("Failed to read the battery status, ignoring the battery policy", "error", err)
+		return powerDecision{}
+	}
+	decision := n.config.BatteryPolicy.evaluate(status, n.config.localizer())
+	if status != nil {
+		slog.Info("Battery status", "capacity", status.Capacity, "charging", status.Charging,
+			"policy", fmt.Sprintf("%+v", decision))
+	}
+	return decision
+}
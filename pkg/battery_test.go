@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePowerSupply creates a sysfs-like power_supply directory with an AC adapter and a battery.
+func fakePowerSupply(t *testing.T, capacity, status string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, values := range map[string]map[string]string{
+		"mc13892_charger": {"type": "Mains\n", "online": "0\n"},
+		"mc13892_bat":     {"type": "Battery\n", "capacity": capacity + "\n", "status": status + "\n"},
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		for file, value := range values {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name, file), []byte(value), 0644))
+		}
+	}
+	return dir
+}
+
+func TestReadPowerStatus(t *testing.T) {
+	status, err := readPowerStatus(fakePowerSupply(t, "42", "Discharging"))
+	assert.NoError(t, err)
+	assert.Equal(t, &PowerStatus{Capacity: 42, Charging: false}, status)
+
+	status, err = readPowerStatus(fakePowerSupply(t, "100", "Full"))
+	assert.NoError(t, err)
+	assert.Equal(t, &PowerStatus{Capacity: 100, Charging: true}, status)
+
+	_, err = readPowerStatus(fakePowerSupply(t, "unknown", "Charging"))
+	assert.Error(t, err)
+
+	// no battery at all
+	status, err = readPowerStatus(t.TempDir())
+	assert.NoError(t, err)
+	assert.Nil(t, status)
+
+	_, err = readPowerStatus(filepath.Join(t.TempDir(), "nonexistent"))
+	assert.Error(t, err)
+}
+
+func TestBatteryPolicy_evaluate(t *testing.T) {
+	policy := BatteryPolicy{
+		SkipBelow:               10,
+		SmallFilesOnlyBelow:     30,
+		DeferLargeUntilCharging: true,
+	}
+	policy.setDefaults()
+	assert.NoError(t, policy.validate())
+
+	tests := []struct {
+		name        string
+		status      *PowerStatus
+		skip        bool
+		maxFileSize int64
+	}{
+		{name: "unknown battery", status: nil},
+		{name: "charging with low battery", status: &PowerStatus{Capacity: 5, Charging: true}},
+		{name: "very low battery", status: &PowerStatus{Capacity: 5}, skip: true},
+		{name: "low battery", status: &PowerStatus{Capacity: 20}, maxFileSize: 5 << 20},
+		{name: "on battery", status: &PowerStatus{Capacity: 80}, maxFileSize: 50 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := policy.evaluate(tt.status, defaultMessages)
+			assert.Equal(t, tt.skip, decision.Skip)
+			assert.Equal(t, tt.maxFileSize, decision.MaxFileSize)
+			assert.Equal(t, tt.skip || tt.maxFileSize > 0, decision.Reason != "")
+		})
+	}
+
+	decision := policy.evaluate(&PowerStatus{Capacity: 20}, defaultMessages)
+	assert.True(t, decision.allows(1<<20))
+	assert.False(t, decision.allows(6<<20))
+	assert.True(t, powerDecision{}.allows(1<<40))
+
+	assert.Error(t, (&BatteryPolicy{SkipBelow: 101}).validate())
+}
+
+func TestSyncRemotes_powerNote(t *testing.T) {
+	n := newTestReconciler(t, newWebDAVServer(t, map[string]string{"small.epub": "a", "large.epub": "a large book"}),
+		newWebDAVServer(t, map[string]string{"book.epub": "book"}))
+	// the battery drops below skip_below after the first remote
+	n.config.PowerSupplyPath = fakePowerSupply(t, "5", "Discharging")
+	n.config.BatteryPolicy = BatteryPolicy{SkipBelow: 10}
+	results, note, err := n.syncRemotes(context.Background(), nil, powerDecision{MaxFileSize: 1, Reason: "slow"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, RemoteSkipped, results[1].Outcome)
+	assert.Equal(t, "1 files not downloaded: slow\nRemaining remotes skipped: battery at 5%, sync skipped", note)
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	nickelDBusName      = "com.github.shermp.nickeldbus"
+	nickelDBusInterface = "com.github.shermp.nickeldbus"
+	nickelDBusPath      = dbus.ObjectPath("/nickeldbus")
+
+	nameOwnerChangedSignal = "org.freedesktop.DBus.NameOwnerChanged"
+)
+
+var errBusNotReady = fmt.Errorf("nickeldbus is not available")
+
+// BusHealth is a snapshot of the state of the D-Bus connection as seen by the busSupervisor.
+type BusHealth struct {
+	// Connected is true when the connection to the bus is established and the signal matches are registered
+	Connected bool `json:"connected"`
+	// Service is the name the supervisor waits for on the bus: nickeldbus on the Kobo, or the network service
+	// triggering the syncs on Linux
+	Service string `json:"service"`
+	// ServiceAvailable is true when the service name has an owner on the bus
+	ServiceAvailable bool `json:"service_available"`
+	// Reconnects counts the number of times the connection to the bus had to be re-established
+	Reconnects int `json:"reconnects"`
+	// LastError is the last error encountered while connecting to the bus, if any
+	LastError string `json:"last_error,omitempty"`
+	// Since is the time of the last change of Connected or ServiceAvailable
+	Since time.Time `json:"since"`
+}
+
+// busSupervisor owns the connection to the system bus. It retries the connection with an exponential backoff, waits
+// for the service, nickeldbus on the Kobo, to appear on the bus, re-registers the signal matches after every
+// reconnect and forwards the matched signals to a channel that stays open until the supervisor is stopped.
+type busSupervisor struct {
+	dial       func() (*dbus.Conn, error)
+	service    string
+	matches    []string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	signals chan *dbus.Signal
+	mu      sync.RWMutex
+	conn    *dbus.Conn
+	health  BusHealth
+	ready   chan struct{}
+}
+
+func newBusSupervisor(dial func() (*dbus.Conn, error), service string, matches ...string) *busSupervisor {
+	return &busSupervisor{
+		dial:       dial,
+		service:    service,
+		health:     BusHealth{Service: service},
+		matches:    matches,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		signals:    make(chan *dbus.Signal, 10),
+		ready:      make(chan struct{}),
+	}
+}
+
+// Signals returns the channel where the matched signals are forwarded. It is closed when Run returns.
+func (b *busSupervisor) Signals() <-chan *dbus.Signal {
+	return b.signals
+}
+
+// Health returns a snapshot of the current health of the bus connection.
+func (b *busSupervisor) Health() BusHealth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.health
+}
+
+// WaitReady blocks until the bus is connected and the service is available, or the context is done.
+func (b *busSupervisor) WaitReady(ctx context.Context) error {
+	b.mu.RLock()
+	ready := b.ready
+	b.mu.RUnlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ready:
+		return nil
+	}
+}
+
+// Call invokes a nickeldbus method. It fails fast with errBusNotReady if the bus or nickeldbus are not available.
+func (b *busSupervisor) Call(method string, args ...interface{}) *dbus.Call {
+	b.mu.RLock()
+	conn, available := b.conn, b.health.Connected && b.health.ServiceAvailable
+	b.mu.RUnlock()
+	if !available || b.service != nickelDBusName {
+		return &dbus.Call{Err: errBusNotReady}
+	}
+	return conn.Object(nickelDBusName, nickelDBusPath).Call(nickelDBusInterface+"."+method, 0, args...)
+}
+
+// Run keeps the connection to the bus alive until the context is done.
+func (b *busSupervisor) Run(ctx context.Context) {
+	defer close(b.signals)
+	backoff := b.minBackoff
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := b.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.setDisconnected(err)
+		slog.Warn("D-Bus connection lost, reconnecting", "error", err, "backoff", backoff)
+		if time.Since(started) > b.maxBackoff {
+			// the connection was healthy for a while: do not penalize this reconnect
+			backoff = b.minBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, b.maxBackoff)
+	}
+}
+
+// serve connects to the bus, registers the matches and forwards the signals until the connection is lost or the
+// context is done. It always returns a non-nil error describing why the connection was dropped.
+func (b *busSupervisor) serve(ctx context.Context) error {
+	conn, err := b.dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	//nolint:errcheck
+	defer conn.Close()
+	ch := make(chan *dbus.Signal, 10)
+	conn.Signal(ch)
+
+	matches := append([]string{fmt.Sprintf(
+		"type='signal',interface='org.freedesktop.DBus',member='NameOwnerChanged',arg0='%s'", b.service)},
+		b.matches...)
+	for _, match := range matches {
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match); call.Err != nil {
+			return fmt.Errorf("failed to add D-Bus match %q: %w", match, call.Err)
+		}
+	}
+	var hasOwner bool
+	if err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, b.service).Store(&hasOwner); err != nil {
+		return fmt.Errorf("failed to look up %s on the bus: %w", b.service, err)
+	}
+	b.setConnected(conn, hasOwner)
+	if !hasOwner {
+		slog.Info("Waiting for the service to appear on the bus", "service", b.service)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case signal, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("connection closed")
+			}
+			if signal == nil {
+				continue
+			}
+			if signal.Name == nameOwnerChangedSignal {
+				if len(signal.Body) == 3 {
+					newOwner, _ := signal.Body[2].(string)
+					b.setServiceAvailable(newOwner != "")
+				}
+				continue
+			}
+			if signal.Sender == "org.freedesktop.DBus" {
+				// NameAcquired and NameLost are delivered to us regardless of the matches
+				continue
+			}
+			select {
+			case b.signals <- signal:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (b *busSupervisor) setConnected(conn *dbus.Conn, serviceAvailable bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.health.Reconnects++
+	}
+	b.conn = conn
+	b.health.Connected = true
+	b.health.LastError = ""
+	b.health.Since = time.Now()
+	slog.Info("Connected to the system bus")
+	b.updateServiceAvailable(serviceAvailable)
+}
+
+func (b *busSupervisor) setServiceAvailable(available bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateServiceAvailable(available)
+}
+
+func (b *busSupervisor) setDisconnected(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateServiceAvailable(false)
+	b.health.Connected = false
+	b.health.LastError = err.Error()
+	b.health.Since = time.Now()
+}
+
+// updateServiceAvailable must be called with the lock held.
+func (b *busSupervisor) updateServiceAvailable(available bool) {
+	wasReady := b.health.Connected && b.health.ServiceAvailable
+	b.health.ServiceAvailable = available && b.health.Connected
+	isReady := b.health.Connected && b.health.ServiceAvailable
+	if wasReady == isReady {
+		return
+	}
+	b.health.Since = time.Now()
+	if isReady {
+		slog.Info("The service is available", "service", b.service)
+		close(b.ready)
+	} else {
+		slog.Warn("The service is not available", "service", b.service)
+		b.ready = make(chan struct{})
+	}
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const privateBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startPrivateBus runs a private dbus-daemon for the duration of the test and returns its address.
+func startPrivateBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "bus")
+	configFile := filepath.Join(dir, "bus.conf")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(privateBusConfig, socket)), 0600))
+	cmd := exec.Command(daemon, "--nofork", "--nopidfile", "--config-file="+configFile)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		//nolint:errcheck
+		cmd.Process.Kill()
+		//nolint:errcheck
+		cmd.Wait()
+	})
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return "unix:path=" + socket
+}
+
+func TestBusSupervisor(t *testing.T) {
+	address := startPrivateBus(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failures atomic.Int32
+	b := newBusSupervisor(func() (*dbus.Conn, error) {
+		// fail the first connection attempt to simulate the early boot
+		if failures.Add(1) == 1 {
+			return nil, fmt.Errorf("bus not up yet")
+		}
+		return dbus.Connect(address)
+	}, nickelDBusName,
+		"type='signal',interface='com.github.shermp.nickeldbus',member='wmNetworkConnected',path='/nickeldbus'")
+	b.minBackoff = 10 * time.Millisecond
+	go b.Run(ctx)
+
+	// the supervisor connects to the bus, but nickeldbus is not there yet
+	require.Eventually(t, func() bool { return b.Health().Connected }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, b.Health().ServiceAvailable)
+	assert.ErrorIs(t, b.Call("pfmRescanBooks").Err, errBusNotReady)
+
+	// nickeldbus appears on the bus
+	nickel, err := dbus.Connect(address)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer nickel.Close()
+	reply, err := nickel.RequestName(nickelDBusName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+
+	readyCtx, readyCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readyCancel()
+	require.NoError(t, b.WaitReady(readyCtx))
+	assert.True(t, b.Health().ServiceAvailable)
+
+	// the matched signals are forwarded
+	require.NoError(t, nickel.Emit(nickelDBusPath, nickelDBusInterface+".wmNetworkConnected"))
+	select {
+	case signal := <-b.Signals():
+		assert.Equal(t, nickelDBusInterface+".wmNetworkConnected", signal.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("signal not forwarded")
+	}
+
+	// Nickel goes away
+	_, err = nickel.ReleaseName(nickelDBusName)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !b.Health().ServiceAvailable }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, ok := <-b.Signals()
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// OneShotOptions are the options of the sync and plan commands.
+type OneShotOptions struct {
+	// Profile is the name of the profile to use instead of the one selected by the network, if set
+	Profile string
+	// AssumeYes accepts the confirmations. Otherwise, the safe choice is taken, as if the dialog was not answered.
+	AssumeYes bool
+}
+
+// NewOneShotReconciler returns a reconciler for the sync and plan commands: it does not connect to D-Bus, prints the
+// toasts to console, and neither rescans the books nor updates itself.
+func NewOneShotReconciler(config *Config, console io.Writer, options OneShotOptions) (*NetworkConnectionReconciler,
+	error) {
+	n := &NetworkConnectionReconciler{
+		bus:           newBusSupervisor(nil, nickelDBusName),
+		config:        config,
+		toastsChan:    make(chan string, 16),
+		dialogResults: make(chan int32, 1),
+		ssid:          &wpaSupplicantSSIDProvider{socket: config.WPASupplicantSocket},
+		now:           time.Now,
+		dispatchDone:  make(chan struct{}),
+		exitRequests:  make(chan int, 1),
+		console:       console,
+		autoConfirm:   options.AssumeYes,
+	}
+	if options.Profile != "" {
+		for i := range config.Profiles {
+			if config.Profiles[i].Name == options.Profile {
+				n.profile = &config.Profiles[i]
+			}
+		}
+		if n.profile == nil {
+			return nil, fmt.Errorf("profile %s not found", options.Profile)
+		}
+	}
+	n.state = newSyncStateMachine(n.runSync)
+	return n, nil
+}
+
+// SyncOnce runs a single sync, recorded in the history, and returns its record once all the toasts have been printed
+// and the notifications sent.
+// The reconciler cannot be used anymore afterwards.
+func (n *NetworkConnectionReconciler) SyncOnce(ctx context.Context) *SyncRun {
+	// print the last toasts even if the sync is interrupted
+	go n.dispatchMessages(context.WithoutCancel(ctx))
+	n.state.Trigger(withTrigger(ctx, TriggerManual))
+	n.state.Wait()
+	n.sinks.Wait()
+	close(n.toastsChan)
+	<-n.dispatchDone
+	return n.state.Status().LastRun
+}
+
+// PrintPlan plans the sync of the remotes without applying it, and writes the planned changes to w. It returns the
+// number of remotes that could not be planned.
+func (n *NetworkConnectionReconciler) PrintPlan(ctx context.Context, w io.Writer) (failed int, err error) {
+	profile := n.selectProfile(ctx)
+	plan, err := n.planSync(ctx, profile)
+	if err != nil {
+		return 0, err
+	}
+	lines := []string{fmt.Sprintf("Profile: %s", profile)}
+	for _, rp := range plan.Remotes {
+		lines = append(lines, fmt.Sprintf("Remote: %s", rp.remote.configuredLocalPath))
+		for _, download := range rp.Downloads {
+			change := "~"
+			if download.New {
+				change = "+"
+			}
+			lines = append(lines, fmt.Sprintf("  %s %s (%s)", change, download.LocalPath, formatBytes(download.Size)))
+		}
+		for _, deletion := range rp.Deletions {
+			lines = append(lines, fmt.Sprintf("  - %s", deletion))
+		}
+	}
+	for _, result := range plan.Failed {
+		lines = append(lines, fmt.Sprintf("Failed: %s", result.Error.localized(n.config.localizer())))
+	}
+	files, size := plan.downloadSize(powerDecision{})
+	lines = append(lines, fmt.Sprintf("%d files to download (%s), %d files to delete", files, formatBytes(size),
+		plan.deletedFiles()))
+	_, err = fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return len(plan.Failed), err
+}
+
+// DeviceStatus is the status read from the configuration directory: it is available whether the daemon runs or not.
+type DeviceStatus struct {
+	// Version is the version of the running binary, empty if unknown
+	Version string   `json:"version"`
+	LastRun *SyncRun `json:"last_run,omitempty"`
+	// PendingUpdate is the version downloaded and applied at the next start, if any
+	PendingUpdate string `json:"pending_update,omitempty"`
+	// UpdateVersion and UpdateStatus are the version and the health of the last installed update, if any
+	UpdateVersion string `json:"update_version,omitempty"`
+	UpdateStatus  string `json:"update_status,omitempty"`
+	// Blacklist are the versions rolled back after a failed update
+	Blacklist []string `json:"blacklist,omitempty"`
+}
+
+// ReadDeviceStatus reads the last sync run and the state of the updates from the configuration directory.
+func ReadDeviceStatus(configPath string) (*DeviceStatus, error) {
+	status := &DeviceStatus{Version: RunningVersion(), PendingUpdate: pendingUpdateVersion(configPath)}
+	runs, err := ReadHistory(configPath, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) > 0 {
+		status.LastRun = runs[0]
+	}
+	state, err := loadUpdateState(configPath)
+	if err != nil {
+		return nil, err
+	}
+	status.UpdateVersion, status.UpdateStatus, status.Blacklist = state.Version, string(state.Status), state.Blacklist
+	return status, nil
+}
+
+// PrintDeviceStatus writes the status to w, or as JSON if asJSON is set.
+func PrintDeviceStatus(w io.Writer, status *DeviceStatus, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	lastRun, failed := "never", ""
+	if run := status.LastRun; run != nil {
+		lastRun = fmt.Sprintf("%s (%s): %s", run.StartedAt.Local().Format(time.DateTime), run.Trigger, run.Outcome)
+		if run.Reason != "" {
+			lastRun += ", " + run.Reason
+		}
+		var failures []string
+		for _, result := range run.Remotes {
+			if result.Error != nil {
+				failures = append(failures, result.Error.Message())
+			}
+		}
+		failed = strings.Join(failures, "; ")
+	}
+	lastUpdate := ""
+	if status.UpdateVersion != "" {
+		lastUpdate = fmt.Sprintf("%s (%s)", status.UpdateVersion, status.UpdateStatus)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	//nolint:errcheck
+	fmt.Fprintf(tw, "Version:\t%s\nLast sync:\t%s\nFailed remotes:\t%s\nPending update:\t%s\nLast update:\t%s\n"+
+		"Blacklisted versions:\t%s\n", orDash(status.Version), lastRun, orDash(failed), orDash(status.PendingUpdate),
+		orDash(lastUpdate), orDash(strings.Join(status.Blacklist, ", ")))
+	return tw.Flush()
+}
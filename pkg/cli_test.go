@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncOnce(t *testing.T) {
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1", "book2.epub": "book2"})
+	config := newTestReconciler(t, srv).config
+	config.Confirm.DeletionsAbove = 1
+	config.Profiles = []Profile{{Name: "home"}}
+	localPath := config.Remotes[0].LocalPath
+	writeTestFile(t, filepath.Join(localPath, "deleted1.epub"), "deleted")
+	writeTestFile(t, filepath.Join(localPath, "deleted2.epub"), "deleted")
+
+	console := &bytes.Buffer{}
+	n, err := NewOneShotReconciler(config, console, OneShotOptions{Profile: "home"})
+	require.NoError(t, err)
+	run := n.SyncOnce(context.Background())
+	require.NotNil(t, run)
+	assert.Equal(t, TriggerManual, run.Trigger)
+	assert.Equal(t, "home", run.Profile)
+	assert.Equal(t, RunCompleted, run.Outcome)
+	// the toasts are printed, and the deletions are not confirmed without D-Bus
+	assert.Contains(t, console.String(), "Synced 2 files")
+	assert.FileExists(t, filepath.Join(localPath, "deleted1.epub"))
+
+	runs, err := ReadHistory(config.configPath, 0)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run.ID, runs[0].ID)
+
+	n, err = NewOneShotReconciler(config, &bytes.Buffer{}, OneShotOptions{AssumeYes: true})
+	require.NoError(t, err)
+	run = n.SyncOnce(context.Background())
+	_, _, deleted, _ := run.Counts()
+	assert.Equal(t, 2, deleted)
+	assert.NoFileExists(t, filepath.Join(localPath, "deleted1.epub"))
+
+	_, err = NewOneShotReconciler(config, console, OneShotOptions{Profile: "work"})
+	assert.ErrorContains(t, err, "profile work not found")
+}
+
+func TestPrintPlan(t *testing.T) {
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(unauthorized.Close)
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1", "book2.epub": "book2"})
+	config := newTestReconciler(t, unauthorized, srv).config
+	localPath := config.Remotes[1].LocalPath
+	writeTestFile(t, filepath.Join(localPath, "book2.epub"), "old")
+	writeTestFile(t, filepath.Join(localPath, "deleted.epub"), "deleted")
+
+	n, err := NewOneShotReconciler(config, &bytes.Buffer{}, OneShotOptions{})
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	failed, err := n.PrintPlan(context.Background(), out)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failed)
+	// the order of the downloads is the one of the WebDAV listing
+	for _, line := range []string{
+		"Profile: default\nRemote: share2\n",
+		"  + " + filepath.Join(localPath, "book1.epub") + " (5 B)\n",
+		"  ~ " + filepath.Join(localPath, "book2.epub") + " (5 B)\n",
+		"  - " + filepath.Join(localPath, "deleted.epub") + "\n" +
+			"Failed: Share link expired or password changed for share1\n" +
+			"2 files to download (10 B), 1 files to delete\n",
+	} {
+		assert.Contains(t, out.String(), line)
+	}
+	// nothing is applied
+	assert.NoFileExists(t, filepath.Join(localPath, "book1.epub"))
+	assert.FileExists(t, filepath.Join(localPath, "deleted.epub"))
+}
+
+func TestDeviceStatus(t *testing.T) {
+	dir := t.TempDir()
+	status, err := ReadDeviceStatus(dir)
+	require.NoError(t, err)
+	assert.Nil(t, status.LastRun)
+	out := &bytes.Buffer{}
+	require.NoError(t, PrintDeviceStatus(out, status, false))
+	assert.Contains(t, out.String(), "Last sync:             never")
+
+	started := time.Date(2024, 5, 1, 8, 0, 0, 0, time.Local)
+	require.NoError(t, appendHistory(dir, &SyncRun{ID: "a", Trigger: TriggerManual, StartedAt: started,
+		Outcome: RunFailed, Remotes: []*RemoteResult{{Remote: "books/", Outcome: RemoteFailed,
+			Error: &RemoteError{Remote: "books/", Kind: RemoteErrorNetwork}}}}, 10))
+	writeTestFile(t, filepath.Join(dir, updateStateFileName),
+		`{"version":"v1.2.0","status":"healthy","failed_starts":0,"blacklist":["v1.1.0"]}`)
+	writeTestFile(t, filepath.Join(dir, versionFileName), "v1.3.0\n")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, releaseFileName), nil, 0600))
+
+	status, err = ReadDeviceStatus(dir)
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, PrintDeviceStatus(out, status, false))
+	for _, line := range []string{
+		"Last sync:             2024-05-01 08:00:00 (manual): failed",
+		"Failed remotes:        Network error while syncing books/",
+		"Pending update:        v1.3.0",
+		"Last update:           v1.2.0 (healthy)",
+		"Blacklisted versions:  v1.1.0",
+	} {
+		assert.Contains(t, out.String(), line)
+	}
+
+	out.Reset()
+	require.NoError(t, PrintDeviceStatus(out, status, true))
+	var decoded DeviceStatus
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, "v1.3.0", decoded.PendingUpdate)
+	assert.Equal(t, RunFailed, decoded.LastRun.Outcome)
+}
+
+func TestCheckAndDownloadUpdate(t *testing.T) {
+	signer := newTestSigner(t)
+	tarball := makeTarball(t, map[string]string{"usr/local/nextcloud-kobo/nextcloud-kobo": "binary"})
+	srv := newFakeGitHub(t, newSignedRelease(signer, "v1.1.0", tarball))
+	previousKey, previousVersion := releasePublicKey, Version
+	t.Cleanup(func() { releasePublicKey, Version = previousKey, previousVersion })
+	releasePublicKey, Version = signer.PublicKey(), "v1.0.0"
+	config := &Config{configPath: t.TempDir(), RepoOwner: "owner", RepoName: "repo", UpdateSource: updateSourceGitHub,
+		UpdateURL: srv.URL, UpdateAsset: defaultUpdateAsset, MaxUpdateSizeMB: 1, UpdateChannel: updateChannelStable}
+
+	check, err := CheckUpdate(context.Background(), config)
+	require.NoError(t, err)
+	assert.Equal(t, &UpdateCheck{Current: "v1.0.0", Available: "v1.1.0"}, check)
+
+	version, err := DownloadUpdate(context.Background(), config)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", version)
+	check, err = CheckUpdate(context.Background(), config)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", check.Pending)
+
+	Version = "v1.1.0"
+	version, err = DownloadUpdate(context.Background(), config)
+	require.NoError(t, err)
+	assert.Empty(t, version)
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -14,16 +15,85 @@ import (
 type Config struct {
 	Remotes []Remote `yaml:"remotes"`
 
-	// AutoUpdate is a flag that determines whether the application should check for updates on GitHub.
+	// AutoUpdate is a flag that determines whether the application should check for updates.
 	AutoUpdate bool `yaml:"auto_update,omitempty"`
-	// RepoOwner and RepoName are used to check for updates on GitHub. They default to aleskandro/nextcloud-kobo, but
-	// can be changed to check for updates on a different repository.
+	// UpdateSource is where the updates are looked up: github (the default), gitea (also for Forgejo) or manifest.
+	UpdateSource string `yaml:"update_source,omitempty"`
+	// UpdateURL is the API base URL for github (it defaults to https://api.github.com/), the server URL for gitea and
+	// the URL of the JSON manifest for manifest.
+	UpdateURL string `yaml:"update_url,omitempty"`
+	// RepoOwner and RepoName are used to check for updates on GitHub or Gitea. They default to
+	// aleskandro/nextcloud-kobo, but can be changed to check for updates on a different repository.
 	RepoOwner string `yaml:"repo_owner,omitempty"`
 	RepoName  string `yaml:"repo_name,omitempty"`
+	// UpdateAsset is the name pattern of the release asset to install. {arch} is replaced with the architecture of
+	// the running binary. It defaults to KoboRoot.tgz.
+	UpdateAsset string `yaml:"update_asset,omitempty"`
+	// MaxUpdateSizeMB is the maximum size of an update, once extracted. It defaults to 100 MB.
+	MaxUpdateSizeMB int64 `yaml:"max_update_size_mb,omitempty"`
+	// UpdateChannel is either stable (the default) or prerelease, to also install the pre-releases.
+	UpdateChannel string `yaml:"update_channel,omitempty"`
+	// PinVersion installs the given version, and stays on it, instead of the latest one.
+	PinVersion string `yaml:"pin_version,omitempty"`
+	// AllowDowngrade installs the latest release of the channel even if it is older than the running version, e.g.
+	// to go back to the stable channel after having installed a pre-release.
+	AllowDowngrade bool `yaml:"allow_downgrade,omitempty"`
 
-	basePath   string `yaml:"-"`
-	configPath string `yaml:"-"`
-	configFile string `yaml:"-"`
+	// PowerSupplyPath is the sysfs directory where the battery status is read from. It defaults to
+	// /sys/class/power_supply.
+	PowerSupplyPath string `yaml:"power_supply_path,omitempty"`
+	// BatteryPolicy limits the sync when the device is running on battery.
+	BatteryPolicy BatteryPolicy `yaml:"battery_policy,omitempty"`
+	// Confirm asks the user to confirm the syncs that would delete or download too much.
+	Confirm ConfirmPolicy `yaml:"confirm,omitempty"`
+	// Profiles select the remotes to sync and the bandwidth limits depending on the Wi-Fi network and the time of
+	// the day.
+	Profiles []Profile `yaml:"profiles,omitempty"`
+	// ConnectivityProbe checks that the network is usable, and not behind a captive portal, before syncing.
+	ConnectivityProbe ConnectivityProbe `yaml:"connectivity_probe,omitempty"`
+	// Retry retries the WebDAV listings and downloads that fail for a transient reason.
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// WPASupplicantSocket is the wpa_supplicant control socket used to read the SSID of the current network.
+	// It defaults to /var/run/wpa_supplicant/eth0.
+	WPASupplicantSocket string `yaml:"wpa_supplicant_socket,omitempty"`
+	// LogLevel is the minimum level of the logged messages: debug, info (the default), warn or error.
+	LogLevel string `yaml:"log_level,omitempty"`
+	// LogMaxSizeMB is the size of the log file beyond which it is compressed and rotated. It defaults to 2 MB, 0
+	// disables the rotation.
+	LogMaxSizeMB int `yaml:"log_max_size_mb,omitempty"`
+	// LogBackups is the number of compressed log files kept. It defaults to 3.
+	LogBackups int `yaml:"log_backups,omitempty"`
+	// HistorySize is the number of sync runs kept in the history. It defaults to 50.
+	HistorySize int `yaml:"history_size,omitempty"`
+	// Trigger is what starts the syncs: nickel (the default) when the Kobo connects to a Wi-Fi network, or
+	// networkmanager or networkd when NetworkManager or systemd-networkd report a connection, to run as a service on
+	// a regular Linux system.
+	Trigger string `yaml:"trigger,omitempty"`
+	// Notifications is how the messages are shown and the confirmations asked: nickel with the Kobo toasts and
+	// dialogs, freedesktop with the desktop notifications of the session bus, or none to only log them. It defaults
+	// to nickel with the nickel trigger, and to freedesktop otherwise.
+	Notifications string `yaml:"notifications,omitempty"`
+	// SyncReport writes an EPUB book in the library reporting the last sync runs.
+	SyncReport SyncReport `yaml:"sync_report,omitempty"`
+	// StatusServer serves the status and the Prometheus metrics over HTTP. It is disabled by default.
+	StatusServer StatusServer `yaml:"status_server,omitempty"`
+	// NotificationSinks send a notification, e.g. to a phone, at the end of the sync runs.
+	NotificationSinks []NotificationSink `yaml:"notification_sinks,omitempty"`
+	// DeviceName identifies the device in the notifications. It defaults to the hostname.
+	DeviceName string `yaml:"device_name,omitempty"`
+	// Diagnostics configures the diagnostic bundles of the diagnose command.
+	Diagnostics Diagnostics `yaml:"diagnostics,omitempty"`
+	// Language is the language of the messages: en, it or de. It defaults to the language of Nickel with the nickel
+	// trigger, and to the one of the environment (LANG) otherwise, falling back to en.
+	Language string `yaml:"language,omitempty"`
+	// Messages overrides the text/template of the messages by name, e.g. summary. The templates are rendered with the
+	// fields of the event.
+	Messages map[string]string `yaml:"messages,omitempty"`
+
+	messages   *messages `yaml:"-"`
+	basePath   string    `yaml:"-"`
+	configPath string    `yaml:"-"`
+	configFile string    `yaml:"-"`
 }
 
 type Remote struct {
@@ -42,10 +112,28 @@ type Remote struct {
 	RemoteFolder string `yaml:"remote_folder,omitempty"`
 	// LocalPath is the local path to sync the remote folder to
 	LocalPath string `yaml:"local_path"`
+	// CAFile is the absolute path of a PEM bundle of CA certificates trusted in addition to the system ones, e.g. for
+	// a server with a self-signed CA.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// PinnedFingerprint is the SHA-256 fingerprint of the server certificate, in hex with optional colons. When set,
+	// the server is trusted if its certificate matches, regardless of the CAs.
+	PinnedFingerprint string `yaml:"pinned_fingerprint,omitempty"`
+	// ClientCertFile and ClientKeyFile are the absolute paths of the PEM client certificate and key for mutual TLS.
+	ClientCertFile string `yaml:"client_cert_file,omitempty"`
+	ClientKeyFile  string `yaml:"client_key_file,omitempty"`
+	// ProxyURL is the http, https or socks5 proxy to connect to the remote through. If not set, the proxy
+	// environment variables are used.
+	ProxyURL string `yaml:"proxy_url,omitempty"`
 
 	// remoteURL is the parsed and processed URL that we will use to connect to the remote server
-	remoteURL    *url.URL
+	remoteURL *url.URL
+	// statusURL is the status.php of the server, used to probe the connectivity
+	statusURL    *url.URL
 	printableURL string
+	// configuredLocalPath is the local path as written in the config file, used to reference the remote in profiles
+	configuredLocalPath string
+	// transport applies the TLS and proxy options to the connections to the remote
+	transport *http.Transport
 }
 
 func LoadConfig(configFilePath, basePath string) (*Config, error) {
@@ -59,6 +147,15 @@ func LoadConfig(configFilePath, basePath string) (*Config, error) {
 	if config.RepoName == "" {
 		config.RepoName = "nextcloud-kobo"
 	}
+	config.UpdateSource = updateSourceGitHub
+	config.UpdateAsset = defaultUpdateAsset
+	config.MaxUpdateSizeMB = defaultMaxUpdateSizeMB
+	config.PowerSupplyPath = defaultPowerSupplyPath
+	config.WPASupplicantSocket = defaultWPASupplicantSocket
+	config.LogLevel = defaultLogLevel
+	config.LogMaxSizeMB = defaultLogMaxSizeMB
+	config.LogBackups = defaultLogBackups
+	config.HistorySize = defaultHistorySize
 	configFilePath = filepath.Clean(configFilePath)
 	configFile, err := os.ReadFile(configFilePath)
 	if err != nil {
@@ -69,12 +166,96 @@ func LoadConfig(configFilePath, basePath string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config file: %w", err)
 	}
+	switch config.UpdateSource {
+	case updateSourceGitHub:
+	case updateSourceGitea, updateSourceManifest:
+		if config.UpdateURL == "" {
+			return nil, fmt.Errorf("update_url is required for the %s update source", config.UpdateSource)
+		}
+	default:
+		return nil, fmt.Errorf("update_source must be one of %s, %s or %s", updateSourceGitHub, updateSourceGitea,
+			updateSourceManifest)
+	}
+	if config.UpdateURL != "" {
+		if u, err := url.Parse(config.UpdateURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid update_url %q", config.UpdateURL)
+		}
+	}
+	if _, err = path.Match(config.UpdateAsset, ""); err != nil {
+		return nil, fmt.Errorf("invalid update_asset pattern %q: %w", config.UpdateAsset, err)
+	}
+	if config.MaxUpdateSizeMB <= 0 {
+		return nil, fmt.Errorf("max_update_size_mb must be positive")
+	}
+	if config.UpdateChannel == "" {
+		config.UpdateChannel = updateChannelStable
+	}
+	if config.UpdateChannel != updateChannelStable && config.UpdateChannel != updateChannelPrerelease {
+		return nil, fmt.Errorf("update_channel must be either %s or %s", updateChannelStable, updateChannelPrerelease)
+	}
+	if config.PinVersion != "" {
+		if _, err = parseSemver(config.PinVersion); err != nil {
+			return nil, fmt.Errorf("invalid pin_version: %w", err)
+		}
+	}
+	if _, err = parseLogLevel(config.LogLevel); err != nil {
+		return nil, err
+	}
+	if config.LogMaxSizeMB < 0 || config.LogBackups < 0 {
+		return nil, fmt.Errorf("log_max_size_mb and log_backups must not be negative")
+	}
+	if config.HistorySize <= 0 {
+		return nil, fmt.Errorf("history_size must be positive")
+	}
+	config.BatteryPolicy.setDefaults()
+	if err = config.BatteryPolicy.validate(); err != nil {
+		return nil, err
+	}
+	config.Confirm.setDefaults()
+	if err = config.Confirm.validate(); err != nil {
+		return nil, err
+	}
+	config.ConnectivityProbe.setDefaults()
+	if err = config.ConnectivityProbe.validate(); err != nil {
+		return nil, err
+	}
+	config.Retry.setDefaults()
+	if err = config.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.validatePlatform(); err != nil {
+		return nil, err
+	}
+	config.SyncReport.setDefaults()
+	if err = config.SyncReport.validate(); err != nil {
+		return nil, err
+	}
+	config.SyncReport.fullPath = filepath.Join(basePath, config.SyncReport.Path)
+	if err = config.StatusServer.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.Diagnostics.validateAndSetup(basePath); err != nil {
+		return nil, err
+	}
+	for i := range config.NotificationSinks {
+		if err = config.NotificationSinks[i].validateAndSetup(); err != nil {
+			return nil, err
+		}
+	}
+	if err = config.setupMessages(); err != nil {
+		return nil, err
+	}
 	for i := range config.Remotes {
 		err = config.Remotes[i].validateAndSetup(filepath.Clean(basePath))
 		if err != nil {
 			return nil, err
 		}
 	}
+	for i := range config.Profiles {
+		if err = config.Profiles[i].validateAndSetup(config.Remotes); err != nil {
+			return nil, err
+		}
+	}
 
 	return config, nil
 }
@@ -105,6 +286,9 @@ func (r *Remote) validateAndSetup(basePath string) error {
 	if err != nil {
 		return fmt.Errorf("invalid URL: %s", r.URL)
 	}
+	if err = r.setupTransport(); err != nil {
+		return fmt.Errorf("remote %s: %w", r.URL, err)
+	}
 
 	// Check if URL is a shared link (contains "/s/")
 	if strings.Contains(baseURL.Path, "/s/") {
@@ -120,7 +304,10 @@ func (r *Remote) validateAndSetup(basePath string) error {
 	// Resolve "public.php/webdav" relative to the base URL
 	webdavPath, _ := url.Parse("public.php/webdav")
 	r.remoteURL = baseURL.ResolveReference(webdavPath)
+	statusPath, _ := url.Parse("status.php")
+	r.statusURL = baseURL.ResolveReference(statusPath)
 	r.printableURL = fmt.Sprintf("%s:%s", r.remoteURL.Host, r.LocalPath)
+	r.configuredLocalPath = r.LocalPath
 	r.LocalPath = path.Join(basePath, r.LocalPath)
 
 	return nil
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// maxListedDeletions is the number of deleted files listed in the confirmation dialog
+const maxListedDeletions = 10
+
+// ConfirmPolicy defines when the user is asked to confirm a sync through a Nickel dialog. If the dialog is not
+// answered in time, the safe choice is taken: the deletions are skipped, the large downloads are cancelled and the
+// updates are postponed.
+type ConfirmPolicy struct {
+	// DeletionsAbove asks for confirmation when the sync would delete more than this number of files. 0 disables the
+	// check.
+	DeletionsAbove int `yaml:"deletions_above,omitempty"`
+	// DownloadsAboveMB asks for confirmation when the sync would download more than this amount of data. 0 disables
+	// the check.
+	DownloadsAboveMB int64 `yaml:"downloads_above_mb,omitempty"`
+	// Update asks whether to apply a downloaded update right away or at the next boot.
+	Update bool `yaml:"update,omitempty"`
+	// TimeoutSeconds is the time to wait for an answer. Defaults to 60 seconds.
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"`
+}
+
+type confirmOutcome int
+
+const (
+	confirmProceed confirmOutcome = iota
+	confirmSkipDeletions
+	confirmAbort
+)
+
+var errDialogTimeout = fmt.Errorf("no answer received")
+
+func (p *ConfirmPolicy) setDefaults() {
+	if p.TimeoutSeconds == 0 {
+		p.TimeoutSeconds = 60
+	}
+}
+
+func (p *ConfirmPolicy) validate() error {
+	if p.DeletionsAbove < 0 || p.DownloadsAboveMB < 0 || p.TimeoutSeconds < 0 {
+		return fmt.Errorf("confirm thresholds must not be negative")
+	}
+	return nil
+}
+
+// confirmPlan asks the user to confirm the large downloads and the deletions of the plan, when they exceed the
+// configured thresholds.
+func (n *NetworkConnectionReconciler) confirmPlan(ctx context.Context, plan *syncPlan,
+	power powerDecision) confirmOutcome {
+	policy := n.config.Confirm
+	timeout := time.Duration(policy.TimeoutSeconds) * time.Second
+	outcome := confirmProceed
+	files, size := plan.downloadSize(power)
+	if policy.DownloadsAboveMB > 0 && size > policy.DownloadsAboveMB<<20 {
+		data := msgData{"Files": files, "Size": formatBytes(size)}
+		accepted, err := n.confirm(ctx, timeout, n.config.text(msgLargeSyncTitle, data),
+			n.config.text(msgLargeSyncBody, data), n.config.text(msgLargeSyncAccept, data),
+			n.config.text(msgLargeSyncReject, data))
+		if err != nil {
+			loggerFrom(ctx).Warn("Large download not confirmed", "error", err)
+		}
+		if !accepted {
+			return confirmAbort
+		}
+	}
+	if deleted := plan.deletedFiles(); policy.DeletionsAbove > 0 && deleted > policy.DeletionsAbove {
+		deletions := plan.deletions()
+		listed := deletions[:min(len(deletions), maxListedDeletions)]
+		data := msgData{"Count": deleted, "Files": listed, "More": len(deletions) - len(listed)}
+		accepted, err := n.confirm(ctx, timeout, n.config.text(msgDeleteTitle, data), n.config.text(msgDeleteBody, data),
+			n.config.text(msgDeleteAccept, data), n.config.text(msgDeleteReject, data))
+		if err != nil {
+			loggerFrom(ctx).Warn("Deletions not confirmed", "error", err)
+		}
+		if !accepted {
+			outcome = confirmSkipDeletions
+		}
+	}
+	return outcome
+}
+
+// confirm shows a Nickel dialog, or a desktop notification, with accept and reject buttons and waits for the answer.
+// It returns false, along with the error, if the dialog cannot be shown or no answer is received within the timeout.
+func (n *NetworkConnectionReconciler) confirm(ctx context.Context, timeout time.Duration, title, body, accept,
+	reject string) (bool, error) {
+	if n.autoConfirm {
+		loggerFrom(ctx).Info("Confirmation accepted without asking", "title", title)
+		return true, nil
+	}
+	switch {
+	case n.desktop != nil:
+		return n.desktop.confirm(ctx, timeout, title, body, accept, reject)
+	case n.config.Notifications == notificationsNone:
+		return false, fmt.Errorf("the notifications are disabled")
+	}
+	// drop any stale result
+	select {
+	case <-n.dialogResults:
+	default:
+	}
+	if call := n.bus.Call("dlgConfirmAcceptReject", title, body, accept, reject); call.Err != nil {
+		return false, fmt.Errorf("failed to show the dialog: %w", call.Err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+		return false, errDialogTimeout
+	case result := <-n.dialogResults:
+		loggerFrom(ctx).Info("Dialog answered", "title", title, "result", result)
+		return result == 1, nil
+	}
+}
+
+// handleDialogResult forwards the result of a confirmation dialog to the pending confirm call, if any.
+func (n *NetworkConnectionReconciler) handleDialogResult(signal *dbus.Signal) {
+	var result int32
+	if err := dbus.Store(signal.Body, &result); err != nil {
+		slog.Warn("Received an invalid dialog result", "error", err)
+		return
+	}
+	select {
+	case n.dialogResults <- result:
+	default:
+		slog.Warn("Dropping unexpected dialog result", "result", result)
+	}
+}
+
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
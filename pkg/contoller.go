@@ -3,7 +3,9 @@ package pkg
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"sync"
 	"time"
 
@@ -11,98 +13,266 @@ import (
 )
 
 type NetworkConnectionReconciler struct {
-	conn          *dbus.Conn
-	dbusChan      chan *dbus.Signal
-	config        *Config
-	toastsChan    chan string
-	wg            *sync.WaitGroup
-	syncCtx       context.Context
-	syncCtxCancel context.CancelFunc
+	bus        *busSupervisor
+	state      *syncStateMachine
+	config     *Config
+	toastsChan chan string
+	// dialogResults receives the answers to the Nickel confirmation dialogs
+	dialogResults chan int32
+	ssid          ssidProvider
+	now           func() time.Time
+
+	// cancel stops the background goroutines once Run returns
+	cancel context.CancelFunc
+	// background tracks the goroutines to wait for before exiting
+	background sync.WaitGroup
+	// dispatchDone is closed when all the toasts have been shown
+	dispatchDone chan struct{}
+	// exitRequests receives the exit code to return from Run, e.g. to let the supervisor apply an update
+	exitRequests chan int
+
+	// console, when set, makes the reconciler run without D-Bus, e.g. for the sync command: the toasts are printed to
+	// it, the dialogs are answered by autoConfirm and the updates are left to the update command
+	console io.Writer
+	// autoConfirm accepts the confirmations instead of showing a dialog
+	autoConfirm bool
+	// profile, when set, is used instead of the profile selected by the network
+	profile *Profile
+	// desktop shows the messages with the desktop notifications, if configured
+	desktop *desktopNotifier
+	// metrics are served by the status server, if configured
+	metrics *syncMetrics
+	// sinks tracks the notifications being sent to the notification sinks
+	sinks sync.WaitGroup
 }
 
-var networkConnectionFailedErr = fmt.Errorf("network connection failed")
+// ExitCodeApplyUpdate is returned by Run when an update has been downloaded and the supervisor has to apply it.
+const ExitCodeApplyUpdate = 10
+
+// shutdownTimeout bounds the time spent showing the pending toasts before exiting
+const shutdownTimeout = 30 * time.Second
+
+var (
+	networkConnectionFailedErr = fmt.Errorf("network connection failed")
+	errSyncCancelled           = fmt.Errorf("sync cancelled by the user")
+)
 
+// NewNetworkConnectionReconciler starts supervising the connection to the system bus in the background: the
+// reconciler can be created before D-Bus or the service triggering the syncs, nickeldbus on the Kobo, are up, and it
+// survives their restarts. The desktop notifications, if configured, are sent to the session bus.
 func NewNetworkConnectionReconciler(config *Config, ctx context.Context) *NetworkConnectionReconciler {
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		log.Fatalf("Failed to connect to system bus: %v", err)
+	return newNetworkConnectionReconciler(ctx, config, func() (*dbus.Conn, error) {
+		return dbus.ConnectSystemBus()
+	}, func() (*dbus.Conn, error) {
+		return dbus.ConnectSessionBus()
+	})
+}
+
+func newNetworkConnectionReconciler(ctx context.Context, config *Config,
+	dialSystem, dialSession func() (*dbus.Conn, error)) *NetworkConnectionReconciler {
+	service, matches := config.triggerService()
+	n := &NetworkConnectionReconciler{
+		bus:           newBusSupervisor(dialSystem, service, matches...),
+		config:        config,
+		toastsChan:    make(chan string, 16),
+		dialogResults: make(chan int32, 1),
+		ssid:          &wpaSupplicantSSIDProvider{socket: config.WPASupplicantSocket},
+		now:           time.Now,
+		dispatchDone:  make(chan struct{}),
+		exitRequests:  make(chan int, 1),
 	}
-	ch := make(chan *dbus.Signal, 10)
-	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0,
-		"type='signal',interface='com.github.shermp.nickeldbus',member='wmNetworkConnected',path='/nickeldbus'")
-	if call.Err != nil {
-		log.Fatalf("Failed to add D-Bus match: %v", call.Err)
+	if config.Notifications == notificationsFreedesktop {
+		n.desktop = &desktopNotifier{dial: dialSession}
 	}
-	conn.Signal(ch)
-	n := &NetworkConnectionReconciler{
-		conn:       conn,
-		dbusChan:   ch,
-		config:     config,
-		toastsChan: make(chan string, 16),
-		wg:         &sync.WaitGroup{},
+	n.state = newSyncStateMachine(n.runSync)
+	// the background goroutines outlive the context, to show the last toasts: shutdown stops them
+	ctx, n.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	if config.StatusServer.Address != "" {
+		n.metrics = newSyncMetrics()
+		if err := n.metrics.loadLastSuccess(config.configPath); err != nil {
+			slog.Warn("Failed to read the last successful sync from the history", "error", err)
+		}
+		if listener, err := net.Listen("tcp", config.StatusServer.Address); err != nil {
+			slog.Error("Failed to start the status server", "address", config.StatusServer.Address, "error", err)
+		} else {
+			n.background.Add(1)
+			go func() {
+				defer n.background.Done()
+				n.serveStatus(ctx, listener)
+			}()
+		}
 	}
+	n.background.Add(2)
+	go func() {
+		defer n.background.Done()
+		n.bus.Run(ctx)
+	}()
+	go func() {
+		defer n.background.Done()
+		n.markHealthy(ctx)
+	}()
 	go n.dispatchMessages(ctx)
 	return n
 }
 
-func (n *NetworkConnectionReconciler) Run(ctx context.Context) {
+// Health returns the health of the connection to the system bus and to the service triggering the syncs.
+func (n *NetworkConnectionReconciler) Health() BusHealth {
+	return n.bus.Health()
+}
+
+// Status returns the current state of the sync state machine.
+func (n *NetworkConnectionReconciler) Status() SyncStatus {
+	return n.state.Status()
+}
+
+// Run handles the signals from Nickel, or from the network service, until the context is done or an exit is
+// requested, then it stops the sync in progress, shows the pending toasts and closes the connection to the bus. It
+// returns the exit code of the process.
+func (n *NetworkConnectionReconciler) Run(ctx context.Context) (exitCode int) {
 	defer func() {
-		fmt.Println("Exiting network connection reconciler")
-		n.conn.RemoveSignal(n.dbusChan)
-		close(n.dbusChan)
-		//nolint:errcheck
-		n.conn.Close()
+		slog.Info("Exiting network connection reconciler")
+		n.shutdown()
 	}()
 	for {
-		fmt.Println("Listening for network connection signals from Nickel...")
+		slog.Debug("Listening for network connection signals")
 		select {
 		case <-ctx.Done():
-			fmt.Println("Context done")
-			return
-		case signal, ok := <-n.dbusChan:
+			slog.Info("Context done")
+			return 0
+		case exitCode = <-n.exitRequests:
+			slog.Info("Exit requested", "code", exitCode)
+			return exitCode
+		case signal, ok := <-n.bus.Signals():
 			if !ok {
-				log.Println("Signal channel closed")
-				return
+				slog.Warn("Signal channel closed")
+				return 0
 			}
 			if signal == nil {
-				log.Println("Received nil signal")
+				slog.Warn("Received nil signal")
 				continue
 			}
-			fmt.Printf("Received signal: %s\n", signal.Name)
-			// Check if the signal is the one we are interested in
-			if signal.Name != "com.github.shermp.nickeldbus.wmNetworkConnected" {
-				log.Println("Received unexpected signal", signal.Name)
-				continue
+			slog.Debug("Received signal", "name", signal.Name)
+			switch signal.Name {
+			case "com.github.shermp.nickeldbus.wmNetworkConnected":
+				n.HandleWmNetworkConnected(ctx)
+			case "com.github.shermp.nickeldbus.dlgConfirmResult":
+				n.handleDialogResult(signal)
+			default:
+				if isNetworkConnected(signal) {
+					n.TriggerSync(ctx, TriggerNetwork)
+				} else if signal.Name != networkManagerName+".StateChanged" && signal.Name != propertiesChangedSignal {
+					slog.Warn("Received unexpected signal", "name", signal.Name)
+				}
 			}
-			n.HandleWmNetworkConnected(ctx)
 		}
 	}
 }
 
-func (n *NetworkConnectionReconciler) HandleWmNetworkConnected(ctx context.Context) {
-	if n.syncCtxCancel != nil {
-		n.syncCtxCancel()
+// requestExit makes Run return with the given exit code.
+func (n *NetworkConnectionReconciler) requestExit(code int) {
+	select {
+	case n.exitRequests <- code:
+	default:
 	}
-	n.wg.Wait()
-	n.syncCtx, n.syncCtxCancel = context.WithCancel(ctx)
-	n.wg.Add(2)
-	go func() {
-		defer n.wg.Done()
-		n.keepNetworkAlive(n.syncCtx)
-	}()
-	go func() {
-		defer n.wg.Done()
+}
+
+// toast queues a message for the dispatcher. It does not block once the context is done, when the dispatcher may be
+// gone: the message is still shown if the queue has room, and dropped otherwise.
+func (n *NetworkConnectionReconciler) toast(ctx context.Context, message string) {
+	select {
+	case n.toastsChan <- message:
+		return
+	default:
+	}
+	select {
+	case n.toastsChan <- message:
+	case <-ctx.Done():
+		slog.Warn("Toast dropped", "message", message)
+	}
+}
+
+// shutdown waits for the sync in progress to stop and for the pending toasts to be shown, then stops the background
+// goroutines, closing the connection to the bus.
+func (n *NetworkConnectionReconciler) shutdown() {
+	n.state.Cancel()
+	n.state.Wait()
+	n.sinks.Wait()
+	// no sync is running anymore: nobody else sends toasts
+	close(n.toastsChan)
+	select {
+	case <-n.dispatchDone:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Timed out showing the pending toasts")
+	}
+	n.cancel()
+	n.background.Wait()
+	if n.desktop != nil {
+		n.desktop.close()
+	}
+}
+
+// HandleWmNetworkConnected starts a sync run. If a run is already in progress, a single follow-up run is scheduled
+// instead of restarting the current one.
+func (n *NetworkConnectionReconciler) HandleWmNetworkConnected(ctx context.Context) {
+	n.TriggerSync(ctx, TriggerNetwork)
+}
+
+// TriggerSync starts a sync run like HandleWmNetworkConnected, recording trigger as its cause in the history.
+func (n *NetworkConnectionReconciler) TriggerSync(ctx context.Context, trigger SyncTrigger) {
+	n.state.Trigger(withTrigger(ctx, trigger))
+}
+
+// runSync is the body of a sync run, driven by the state machine.
+func (n *NetworkConnectionReconciler) runSync(ctx context.Context) {
+	run := &SyncRun{ID: newSyncID(), Trigger: triggerFrom(ctx), StartedAt: n.now()}
+	// correlate the log messages of the run
+	ctx = withLogger(ctx, slog.Default().With("sync_id", run.ID))
+	if n.console == nil && n.config.usesNickel() {
+		keepAliveCtx, cancel := context.WithCancel(ctx)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.keepNetworkAlive(keepAliveCtx)
+		}()
 		defer func() {
-			if n.syncCtx.Err() == nil {
-				n.syncCtxCancel()
-				n.syncCtxCancel = nil
-			}
+			cancel()
+			wg.Wait()
 		}()
-		n.sync(n.syncCtx)
-		if n.config.AutoUpdate {
-			n.updateNow()
+	}
+	profile := n.selectProfile(ctx)
+	if profile != nil {
+		run.Profile = profile.Name
+	}
+	n.sync(ctx, profile, run)
+	run.localize(n.config.localizer())
+	n.recordRun(ctx, run)
+	n.notifySinks(ctx, run)
+	n.writeSyncReport(ctx)
+	if n.console != nil {
+		return
+	}
+	if n.config.usesNickel() && (run.Outcome == RunCompleted || run.Outcome == RunFailed) {
+		n.rescanBooks()
+	}
+	if n.config.AutoUpdate && ctx.Err() == nil {
+		n.state.Transition(StateUpdating)
+		if version := n.updateNow(ctx); version != "" && n.applyUpdateNow(ctx, version) {
+			n.requestExit(ExitCodeApplyUpdate)
 		}
-	}()
+	}
+}
+
+// recordRun stores the run in the history and makes it the last run of the status.
+func (n *NetworkConnectionReconciler) recordRun(ctx context.Context, run *SyncRun) {
+	run.FinishedAt = n.now()
+	n.state.SetLastRun(run)
+	if n.metrics != nil {
+		n.metrics.observe(run)
+	}
+	if err := appendHistory(n.config.configPath, run, n.config.HistorySize); err != nil {
+		loggerFrom(ctx).Error("Failed to record the sync in the history", "error", err)
+	}
 }
 
 func (n *NetworkConnectionReconciler) keepNetworkAlive(ctx context.Context) {
@@ -111,43 +281,74 @@ func (n *NetworkConnectionReconciler) keepNetworkAlive(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("[keepNetworkAlive] context closed")
+			slog.Debug("Context closed", "component", "keepNetworkAlive")
 			return
 		case <-ticker.C:
-			obj := n.conn.Object("com.github.shermp.nickeldbus", "/nickeldbus")
-			call := obj.Call("com.github.shermp.nickeldbus.wfmConnectWirelessSilently", 0)
+			call := n.bus.Call("wfmConnectWirelessSilently")
 			if call.Err != nil {
-				log.Println("Failed to notify Nickel", call.Err)
+				loggerFrom(ctx).Warn("Failed to keep the network alive", "error", call.Err)
 			}
 		}
 	}
 }
 
+// dispatchMessages shows the toasts until the toasts channel is closed or the context is done.
 func (n *NetworkConnectionReconciler) dispatchMessages(ctx context.Context) {
+	defer close(n.dispatchDone)
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("[dispatchMessages] context closed")
+			slog.Debug("Context closed", "component", "dispatchMessages")
 			return
-		case message := <-n.toastsChan:
+		case message, ok := <-n.toastsChan:
+			if !ok {
+				return
+			}
+			switch {
+			case n.console != nil:
+				//nolint:errcheck
+				fmt.Fprintln(n.console, message)
+				continue
+			case n.config.Notifications == notificationsNone:
+				slog.Info("Message not shown", "message", message)
+				continue
+			case n.desktop != nil:
+				if err := n.desktop.notify(message); err != nil {
+					slog.Warn("Failed to show the notification", "error", err)
+				}
+				continue
+			}
+			if err := n.bus.WaitReady(ctx); err != nil {
+				slog.Debug("Context closed", "component", "dispatchMessages")
+				return
+			}
 			n.notifyNickel(message)
 		}
 	}
 }
 
 func (n *NetworkConnectionReconciler) rescanBooks() {
-	obj := n.conn.Object("com.github.shermp.nickeldbus", "/nickeldbus")
-	call := obj.Call("com.github.shermp.nickeldbus.pfmRescanBooks", 0)
+	call := n.bus.Call("pfmRescanBooks")
 	if call.Err != nil {
-		log.Println("Failed to rescan books", call.Err)
+		slog.Warn("Failed to rescan books", "error", call.Err)
 	}
 }
 
 func (n *NetworkConnectionReconciler) notifyNickel(message string) {
-	obj := n.conn.Object("com.github.shermp.nickeldbus", "/nickeldbus")
-	call := obj.Call("com.github.shermp.nickeldbus.mwcToast", 0, 5000, "NextCloud Kobo Syncer", message)
+	call := n.bus.Call("mwcToast", 5000, "NextCloud Kobo Syncer", message)
 	if call.Err != nil {
-		log.Println("Failed to notify Nickel", call.Err)
+		slog.Warn("Failed to notify Nickel", "error", call.Err)
 	}
 	time.Sleep(time.Second * 5)
 }
+
+// markHealthy reports the running version as healthy once it is connected to Nickel, so that the supervisor does not
+// roll it back.
+func (n *NetworkConnectionReconciler) markHealthy(ctx context.Context) {
+	if err := n.bus.WaitReady(ctx); err != nil {
+		return
+	}
+	if err := MarkUpdateHealthy(n.config.configPath); err != nil {
+		slog.Error("Failed to mark the update as healthy", "error", err)
+	}
+}
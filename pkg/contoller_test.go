@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNickel owns the nickeldbus name on a private bus and records the toasts.
+type fakeNickel struct {
+	mu     sync.Mutex
+	toasts []string
+}
+
+func (f *fakeNickel) Toasts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.toasts...)
+}
+
+func startFakeNickel(t *testing.T, address string) *fakeNickel {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		//nolint:errcheck
+		conn.Close()
+	})
+	f := &fakeNickel{}
+	require.NoError(t, conn.ExportMethodTable(map[string]interface{}{
+		"mwcToast": func(duration int32, title, message string) *dbus.Error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.toasts = append(f.toasts, message)
+			return nil
+		},
+	}, nickelDBusPath, nickelDBusInterface))
+	reply, err := conn.RequestName(nickelDBusName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+	return f
+}
+
+func TestNetworkConnectionReconciler_requestExit(t *testing.T) {
+	address := startPrivateBus(t)
+	nickel := startFakeNickel(t, address)
+	dial := func() (*dbus.Conn, error) {
+		return dbus.Connect(address)
+	}
+	n := newNetworkConnectionReconciler(context.Background(), &Config{configPath: t.TempDir()}, dial, dial)
+
+	n.toastsChan <- "Restarting to apply Nextcloud-Kobo v1.1.0"
+	n.requestExit(ExitCodeApplyUpdate)
+	exitCode := make(chan int)
+	go func() {
+		exitCode <- n.Run(context.Background())
+	}()
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, ExitCodeApplyUpdate, code)
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Run did not return")
+	}
+	// the pending toasts are shown before exiting, and the connection to the bus is closed
+	assert.Equal(t, []string{"Restarting to apply Nextcloud-Kobo v1.1.0"}, nickel.Toasts())
+	assert.False(t, n.bus.conn.Connected())
+	_, ok := <-n.bus.Signals()
+	assert.False(t, ok)
+}
+
+func TestNetworkConnectionReconciler_toastAfterCancel(t *testing.T) {
+	address := startPrivateBus(t)
+	nickel := startFakeNickel(t, address)
+	dial := func() (*dbus.Conn, error) {
+		return dbus.Connect(address)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := newNetworkConnectionReconciler(ctx, &Config{configPath: t.TempDir()}, dial, dial)
+	cancel()
+
+	// the toasts sent while the sync stops are shown before exiting
+	n.toast(ctx, "Sync cancelled")
+	exitCode := make(chan int)
+	go func() {
+		exitCode <- n.Run(ctx)
+	}()
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, 0, code)
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Run did not return")
+	}
+	assert.Equal(t, []string{"Sync cancelled"}, nickel.Toasts())
+
+	// a full queue does not block the senders once the context is done
+	n = &NetworkConnectionReconciler{toastsChan: make(chan string, 1)}
+	n.toast(ctx, "Downloaded a.epub")
+	n.toast(ctx, "Downloaded b.epub")
+	assert.Equal(t, "Downloaded a.epub", <-n.toastsChan)
+}
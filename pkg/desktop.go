@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// triggerNickel syncs when the Kobo connects to a Wi-Fi network, as reported by nickeldbus
+	triggerNickel = "nickel"
+	// triggerNetworkManager syncs when NetworkManager reports a connection with full internet access
+	triggerNetworkManager = "networkmanager"
+	// triggerNetworkd syncs when systemd-networkd reports a routable network
+	triggerNetworkd = "networkd"
+
+	// notificationsNickel shows the messages with the Nickel toasts and dialogs
+	notificationsNickel = "nickel"
+	// notificationsFreedesktop shows the messages with the desktop notifications of the session bus
+	notificationsFreedesktop = "freedesktop"
+	// notificationsNone only logs the messages
+	notificationsNone = "none"
+
+	networkManagerName = "org.freedesktop.NetworkManager"
+	networkManagerPath = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	// nmStateConnectedGlobal is the NM_STATE_CONNECTED_GLOBAL state of NetworkManager
+	nmStateConnectedGlobal = 70
+
+	networkdName             = "org.freedesktop.network1"
+	networkdPath             = dbus.ObjectPath("/org/freedesktop/network1")
+	networkdManagerInterface = "org.freedesktop.network1.Manager"
+	propertiesChangedSignal  = "org.freedesktop.DBus.Properties.PropertiesChanged"
+
+	notificationsName = "org.freedesktop.Notifications"
+	notificationsPath = dbus.ObjectPath("/org/freedesktop/Notifications")
+	notificationsApp  = "Nextcloud-Kobo"
+	// notificationTimeout is how long the messages are shown, in milliseconds, like the Nickel toasts
+	notificationTimeout = 5000
+
+	notificationActionAccept = "accept"
+	notificationActionReject = "reject"
+)
+
+// validatePlatform sets the default trigger and notifications, and checks that they can work together.
+func (c *Config) validatePlatform() error {
+	if c.Trigger == "" {
+		c.Trigger = triggerNickel
+	}
+	if c.Notifications == "" {
+		c.Notifications = notificationsNickel
+		if c.Trigger != triggerNickel {
+			c.Notifications = notificationsFreedesktop
+		}
+	}
+	switch c.Trigger {
+	case triggerNickel, triggerNetworkManager, triggerNetworkd:
+	default:
+		return fmt.Errorf("trigger must be one of nickel, networkmanager or networkd")
+	}
+	switch c.Notifications {
+	case notificationsNickel, notificationsFreedesktop, notificationsNone:
+	default:
+		return fmt.Errorf("notifications must be one of nickel, freedesktop or none")
+	}
+	if c.Notifications == notificationsNickel && c.Trigger != triggerNickel {
+		return fmt.Errorf("the nickel notifications require the nickel trigger")
+	}
+	if c.AutoUpdate && c.Trigger != triggerNickel {
+		return fmt.Errorf("auto_update is only supported with the nickel trigger")
+	}
+	return nil
+}
+
+// usesNickel returns true if the syncs are triggered by Nickel, i.e. the daemon runs on the Kobo.
+func (c *Config) usesNickel() bool {
+	return c.Trigger == "" || c.Trigger == triggerNickel
+}
+
+// triggerService returns the name the bus supervisor waits for on the system bus, and the matches of the signals
+// that trigger the syncs or answer the dialogs.
+func (c *Config) triggerService() (service string, matches []string) {
+	switch c.Trigger {
+	case triggerNetworkManager:
+		return networkManagerName, []string{fmt.Sprintf(
+			"type='signal',interface='%s',member='StateChanged',path='%s'", networkManagerName, networkManagerPath)}
+	case triggerNetworkd:
+		return networkdName, []string{fmt.Sprintf(
+			"type='signal',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged',path='%s',arg0='%s'",
+			networkdPath, networkdManagerInterface)}
+	}
+	return nickelDBusName, []string{
+		"type='signal',interface='com.github.shermp.nickeldbus',member='wmNetworkConnected',path='/nickeldbus'",
+		"type='signal',interface='com.github.shermp.nickeldbus',member='dlgConfirmResult',path='/nickeldbus'",
+	}
+}
+
+// isNetworkConnected returns true if the signal of NetworkManager or systemd-networkd reports that the network is
+// connected.
+func isNetworkConnected(signal *dbus.Signal) bool {
+	switch {
+	case signal.Name == networkManagerName+".StateChanged" && signal.Path == networkManagerPath:
+		var state uint32
+		return dbus.Store(signal.Body, &state) == nil && state == nmStateConnectedGlobal
+	case signal.Name == propertiesChangedSignal && signal.Path == networkdPath:
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+		if dbus.Store(signal.Body, &iface, &changed, &invalidated) != nil || iface != networkdManagerInterface {
+			return false
+		}
+		state, _ := changed["OperationalState"].Value().(string)
+		return state == "routable"
+	}
+	return false
+}
+
+// desktopNotifier shows the messages and asks for the confirmations with the desktop notifications of
+// org.freedesktop.Notifications, on the session bus.
+type desktopNotifier struct {
+	dial func() (*dbus.Conn, error)
+
+	mu   sync.Mutex
+	conn *dbus.Conn
+}
+
+// connection returns the connection to the session bus, connecting again if it was lost.
+func (d *desktopNotifier) connection() (*dbus.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.Connected() {
+		return d.conn, nil
+	}
+	conn, err := d.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %w", err)
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+// close closes the connection to the session bus, if any.
+func (d *desktopNotifier) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		//nolint:errcheck
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+func (d *desktopNotifier) notify(message string) error {
+	conn, err := d.connection()
+	if err != nil {
+		return err
+	}
+	_, err = d.show(conn, "NextCloud Kobo Syncer", message, []string{}, notificationTimeout)
+	return err
+}
+
+func (d *desktopNotifier) show(conn *dbus.Conn, summary, body string, actions []string, timeout int32) (uint32,
+	error) {
+	var id uint32
+	err := conn.Object(notificationsName, notificationsPath).Call(notificationsName+".Notify", 0, notificationsApp,
+		uint32(0), "", summary, body, actions, map[string]dbus.Variant{}, timeout).Store(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to show the notification: %w", err)
+	}
+	return id, nil
+}
+
+// confirm shows a notification with accept and reject actions and waits for the answer. Dismissing the notification
+// rejects it. It returns false, along with the error, if the notification cannot be shown or no answer is received
+// within the timeout.
+func (d *desktopNotifier) confirm(ctx context.Context, timeout time.Duration, title, body, accept,
+	reject string) (bool, error) {
+	conn, err := d.connection()
+	if err != nil {
+		return false, err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	defer conn.RemoveSignal(signals)
+	for _, member := range []string{"ActionInvoked", "NotificationClosed"} {
+		match := fmt.Sprintf("type='signal',interface='%s',member='%s',path='%s'", notificationsName, member,
+			notificationsPath)
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match); call.Err != nil {
+			return false, fmt.Errorf("failed to add D-Bus match %q: %w", match, call.Err)
+		}
+		//nolint:errcheck
+		defer conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", 0, match)
+	}
+	// the notification does not expire: the timeout is handled here, to take the safe choice
+	id, err := d.show(conn, title, body,
+		[]string{notificationActionAccept, accept, notificationActionReject, reject}, 0)
+	if err != nil {
+		return false, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			d.dismiss(conn, id)
+			return false, ctx.Err()
+		case <-timer.C:
+			d.dismiss(conn, id)
+			return false, errDialogTimeout
+		case signal, ok := <-signals:
+			if !ok {
+				return false, fmt.Errorf("connection closed")
+			}
+			var signalID uint32
+			if signal == nil || len(signal.Body) < 2 || dbus.Store(signal.Body[:1], &signalID) != nil ||
+				signalID != id {
+				continue
+			}
+			switch signal.Name {
+			case notificationsName + ".ActionInvoked":
+				action, _ := signal.Body[1].(string)
+				loggerFrom(ctx).Info("Notification answered", "title", title, "action", action)
+				return action == notificationActionAccept, nil
+			case notificationsName + ".NotificationClosed":
+				return false, fmt.Errorf("the notification was dismissed")
+			}
+		}
+	}
+}
+
+func (d *desktopNotifier) dismiss(conn *dbus.Conn, id uint32) {
+	//nolint:errcheck
+	conn.Object(notificationsName, notificationsPath).Call(notificationsName+".CloseNotification", 0, id)
+}
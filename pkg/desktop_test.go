@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifications owns org.freedesktop.Notifications on a private bus, records the notifications and answers the
+// ones with actions with the given action.
+type fakeNotifications struct {
+	conn   *dbus.Conn
+	answer string
+
+	mu     sync.Mutex
+	bodies []string
+	closed []uint32
+}
+
+func (f *fakeNotifications) Bodies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.bodies...)
+}
+
+func (f *fakeNotifications) SetAnswer(answer string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answer = answer
+}
+
+func (f *fakeNotifications) Closed() []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]uint32{}, f.closed...)
+}
+
+func startFakeNotifications(t *testing.T, address, answer string) *fakeNotifications {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		//nolint:errcheck
+		conn.Close()
+	})
+	f := &fakeNotifications{conn: conn, answer: answer}
+	require.NoError(t, conn.ExportMethodTable(map[string]interface{}{
+		"Notify": func(app string, replaces uint32, icon, summary, body string, actions []string,
+			hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.bodies = append(f.bodies, body)
+			id, answer := uint32(len(f.bodies)), f.answer
+			if len(actions) > 0 && answer != "" {
+				go func() {
+					//nolint:errcheck
+					conn.Emit(notificationsPath, notificationsName+".ActionInvoked", id, answer)
+				}()
+			}
+			return id, nil
+		},
+		"CloseNotification": func(id uint32) *dbus.Error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.closed = append(f.closed, id)
+			return nil
+		},
+	}, notificationsPath, notificationsName))
+	reply, err := conn.RequestName(notificationsName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+	return f
+}
+
+func TestNetworkConnectionReconciler_networkManager(t *testing.T) {
+	address := startPrivateBus(t)
+	notifications := startFakeNotifications(t, address, "")
+	networkManager, err := dbus.Connect(address)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer networkManager.Close()
+	reply, err := networkManager.RequestName(networkManagerName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1"})
+	config := newTestReconciler(t, srv).config
+	config.Trigger = triggerNetworkManager
+	require.NoError(t, config.validatePlatform())
+	assert.Equal(t, notificationsFreedesktop, config.Notifications)
+	dial := func() (*dbus.Conn, error) {
+		return dbus.Connect(address)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := newNetworkConnectionReconciler(ctx, config, dial, dial)
+	done := make(chan int)
+	go func() {
+		done <- n.Run(ctx)
+	}()
+	readyCtx, readyCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readyCancel()
+	require.NoError(t, n.bus.WaitReady(readyCtx))
+
+	// connecting without internet access does not sync
+	require.NoError(t, networkManager.Emit(networkManagerPath, networkManagerName+".StateChanged",
+		uint32(nmStateConnectedGlobal-10)))
+	require.NoError(t, networkManager.Emit(networkManagerPath, networkManagerName+".StateChanged",
+		uint32(nmStateConnectedGlobal)))
+	require.Eventually(t, func() bool {
+		for _, body := range notifications.Bodies() {
+			if strings.HasPrefix(body, "Synced 1 files") {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, n.Status().Runs)
+	assert.Equal(t, networkManagerName, n.Health().Service)
+	cancel()
+	<-done
+}
+
+func TestDesktopNotifier_confirm(t *testing.T) {
+	address := startPrivateBus(t)
+	dial := func() (*dbus.Conn, error) {
+		return dbus.Connect(address)
+	}
+	d := &desktopNotifier{dial: dial}
+	defer d.close()
+
+	// no notification server
+	_, err := d.confirm(context.Background(), time.Second, "Delete books?", "body", "Delete", "Keep")
+	assert.ErrorContains(t, err, "failed to show the notification")
+
+	notifications := startFakeNotifications(t, address, notificationActionAccept)
+	accepted, err := d.confirm(context.Background(), 5*time.Second, "Delete books?", "body", "Delete", "Keep")
+	require.NoError(t, err)
+	assert.True(t, accepted)
+
+	notifications.SetAnswer(notificationActionReject)
+	accepted, err = d.confirm(context.Background(), 5*time.Second, "Delete books?", "body", "Delete", "Keep")
+	require.NoError(t, err)
+	assert.False(t, accepted)
+
+	// the unanswered notifications are closed when the timeout expires
+	notifications.SetAnswer("")
+	accepted, err = d.confirm(context.Background(), 50*time.Millisecond, "Delete books?", "body", "Delete", "Keep")
+	assert.ErrorIs(t, err, errDialogTimeout)
+	assert.False(t, accepted)
+	assert.Equal(t, []uint32{3}, notifications.Closed())
+
+	require.NoError(t, d.notify("Synced"))
+	assert.Equal(t, []string{"body", "body", "body", "Synced"}, notifications.Bodies())
+}
+
+func TestIsNetworkConnected(t *testing.T) {
+	networkdState := func(iface, state string) *dbus.Signal {
+		return &dbus.Signal{Path: networkdPath, Name: propertiesChangedSignal, Body: []interface{}{iface,
+			map[string]dbus.Variant{"OperationalState": dbus.MakeVariant(state)}, []string{}}}
+	}
+	tests := []struct {
+		name      string
+		signal    *dbus.Signal
+		connected bool
+	}{
+		{name: "NetworkManager connected", connected: true, signal: &dbus.Signal{Path: networkManagerPath,
+			Name: networkManagerName + ".StateChanged", Body: []interface{}{uint32(nmStateConnectedGlobal)}}},
+		{name: "NetworkManager connected locally", signal: &dbus.Signal{Path: networkManagerPath,
+			Name: networkManagerName + ".StateChanged", Body: []interface{}{uint32(50)}}},
+		{name: "networkd routable", signal: networkdState(networkdManagerInterface, "routable"), connected: true},
+		{name: "networkd degraded", signal: networkdState(networkdManagerInterface, "degraded")},
+		{name: "networkd link", signal: networkdState("org.freedesktop.network1.Link", "routable")},
+		{name: "invalid body", signal: &dbus.Signal{Path: networkManagerPath,
+			Name: networkManagerName + ".StateChanged", Body: []interface{}{"connected"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.connected, isNetworkConnected(tt.signal))
+		})
+	}
+}
+
+func TestConfig_validatePlatform(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		notifications string
+		errMsg        string
+	}{
+		{name: "kobo", notifications: notificationsNickel},
+		{name: "networkd", config: Config{Trigger: triggerNetworkd}, notifications: notificationsFreedesktop},
+		{name: "headless", config: Config{Trigger: triggerNetworkManager, Notifications: notificationsNone},
+			notifications: notificationsNone},
+		{name: "nickel notifications on linux", config: Config{Trigger: triggerNetworkd,
+			Notifications: notificationsNickel}, errMsg: "require the nickel trigger"},
+		{name: "updates on linux", config: Config{Trigger: triggerNetworkManager, AutoUpdate: true},
+			errMsg: "only supported with the nickel trigger"},
+		{name: "unknown trigger", config: Config{Trigger: "wicd"}, errMsg: "trigger must be"},
+		{name: "unknown notifications", config: Config{Notifications: "email"}, errMsg: "notifications must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validatePlatform()
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.notifications, tt.config.Notifications)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+const (
+	diagnosticsPrefix = "diagnostics-"
+	// stderrLogFileName is the file where run.sh sends what the daemon cannot log itself
+	stderrLogFileName = "nextcloud-kobo.stderr.log"
+	// maxDiagnosticLogSize is the size of the end of each log file included in the bundles
+	maxDiagnosticLogSize  = 1 << 20
+	diagnosticHistoryRuns = 10
+	// maxDiagnosticBundles is the number of bundles kept in the configuration directory
+	maxDiagnosticBundles = 3
+)
+
+// configSecretPattern matches the lines of the configuration file setting a password, a token or a secret, whatever
+// their value, so that even the short ones or the ones of an invalid configuration are redacted.
+var configSecretPattern = regexp.MustCompile(`(?im)^(\s*(?:-\s+)?[\w-]*(?:password|secret|token)[\w-]*\s*:).*$`)
+
+// Diagnostics configures the diagnostic bundles of the diagnose command.
+type Diagnostics struct {
+	// UploadURL is a Nextcloud share link, e.g. a file drop, the bundles are uploaded to with diagnose -upload.
+	UploadURL string `yaml:"upload_url,omitempty"`
+	// UploadPassword is the password of the share link, if any.
+	UploadPassword string `yaml:"upload_password,omitempty"`
+
+	// upload is the remote of UploadURL, if set
+	upload *Remote
+}
+
+func (d *Diagnostics) validateAndSetup(basePath string) error {
+	if d.UploadURL == "" {
+		return nil
+	}
+	r := &Remote{URL: d.UploadURL, Password: d.UploadPassword, LocalPath: "."}
+	if err := r.validateAndSetup(basePath); err != nil {
+		return fmt.Errorf("invalid diagnostics upload_url: %w", err)
+	}
+	if !r.isShareLink() {
+		return fmt.Errorf("diagnostics upload_url must be a share link")
+	}
+	d.upload = r
+	return nil
+}
+
+// DiagnoseOptions are the options of the diagnose command.
+type DiagnoseOptions struct {
+	ConfigFilePath string
+	BasePath       string
+	// Upload uploads the bundle to the upload_url of the diagnostics options
+	Upload bool
+}
+
+// DiagnosticSummary is the summary.json of a diagnostic bundle.
+type DiagnosticSummary struct {
+	CreatedAt time.Time `json:"created_at"`
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	Platform  string    `json:"platform"`
+	// ConfigError is the error loading the configuration, if any: the probes are skipped in that case
+	ConfigError string          `json:"config_error,omitempty"`
+	Device      *DeviceStatus   `json:"device,omitempty"`
+	Disks       []DiskUsage     `json:"disks"`
+	Probes      []ProbeResult   `json:"probes,omitempty"`
+	Errors      []string        `json:"errors,omitempty"`
+	Files       map[string]bool `json:"files"`
+}
+
+// DiskUsage is the space of the file system of a directory.
+type DiskUsage struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ProbeResult is the result of a single connectivity probe.
+type ProbeResult struct {
+	URL        string `json:"url"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Diagnose collects the state of the device in a zip file in the configuration directory, with the passwords and the
+// share tokens redacted, and uploads it if requested. It works with an invalid configuration too, as that is often
+// the issue to diagnose. It returns the path of the bundle, also when the upload fails.
+func Diagnose(ctx context.Context, options DiagnoseOptions) (string, error) {
+	configPath := filepath.Dir(options.ConfigFilePath)
+	now := time.Now()
+	summary := &DiagnosticSummary{CreatedAt: now, Version: RunningVersion(), GoVersion: runtime.Version(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH, Files: map[string]bool{}}
+	config, err := LoadConfig(options.ConfigFilePath, options.BasePath)
+	if err != nil {
+		summary.ConfigError = err.Error()
+	}
+	r := newRedactor(config.logOptions().secrets)
+	if summary.Device, err = ReadDeviceStatus(configPath); err != nil {
+		summary.Errors = append(summary.Errors, fmt.Sprintf("failed to read the device status: %v", err))
+	}
+	for _, dir := range []string{options.BasePath, configPath} {
+		summary.Disks = append(summary.Disks, diskUsage(dir))
+	}
+	if config != nil {
+		summary.Probes = probeAll(ctx, config)
+	}
+
+	files := map[string][]byte{}
+	addFile := func(name string, content []byte, err error) {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				summary.Errors = append(summary.Errors, fmt.Sprintf("failed to read %s: %v", name, err))
+			}
+			summary.Files[name] = false
+			return
+		}
+		files[name], summary.Files[name] = []byte(r.redact(string(content))), true
+	}
+	content, err := os.ReadFile(options.ConfigFilePath)
+	addFile("config.yaml", configSecretPattern.ReplaceAll(content, []byte("$1 "+redacted)), err)
+	runs, err := ReadHistory(configPath, diagnosticHistoryRuns)
+	if err == nil {
+		content, err = json.MarshalIndent(runs, "", "  ")
+	}
+	addFile("history.json", content, err)
+	for _, name := range []string{LogFileName, stderrLogFileName} {
+		content, err = readTail(filepath.Join(configPath, name), maxDiagnosticLogSize)
+		addFile(name, content, err)
+	}
+	content, err = json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files["summary.json"] = []byte(r.redact(string(content)))
+
+	bundle := &bytes.Buffer{}
+	if err = writeZip(bundle, files, now); err != nil {
+		return "", fmt.Errorf("failed to write the bundle: %w", err)
+	}
+	name := diagnosticsPrefix + now.UTC().Format("20060102T150405Z") + ".zip"
+	bundlePath := filepath.Join(configPath, name)
+	if err = writeFileAtomically(bundlePath, bytes.NewReader(bundle.Bytes()), 0600); err != nil {
+		return "", fmt.Errorf("failed to write the bundle: %w", err)
+	}
+	pruneDiagnosticBundles(configPath)
+	if !options.Upload {
+		return bundlePath, nil
+	}
+	switch {
+	case config == nil:
+		return bundlePath, fmt.Errorf("cannot upload the bundle with an invalid configuration")
+	case config.Diagnostics.upload == nil:
+		return bundlePath, fmt.Errorf("diagnostics upload_url is not set")
+	}
+	if err = uploadDiagnosticBundle(config.Diagnostics.upload, name, bundle.Bytes()); err != nil {
+		return bundlePath, fmt.Errorf("failed to upload the bundle: %s", r.redact(err.Error()))
+	}
+	return bundlePath, nil
+}
+
+// probeAll probes once the status.php of every remote and the generate_204 URL, to tell a server issue from a
+// network issue.
+func probeAll(ctx context.Context, config *Config) []ProbeResult {
+	probe := config.ConnectivityProbe
+	remotes := make([]*Remote, 0, len(config.Remotes))
+	for i := range config.Remotes {
+		remotes = append(remotes, &config.Remotes[i])
+	}
+	probe.Mode = probeModeStatus
+	targets := probe.targets(remotes)
+	probe.Mode = probeModeGenerate204
+	if probe.URL == "" {
+		probe.URL = defaultProbeURL
+	}
+	targets = append(targets, probe.targets(nil)...)
+	results := make([]ProbeResult, 0, len(targets))
+	for _, target := range targets {
+		started := time.Now()
+		err := target.probe(ctx)
+		result := ProbeResult{URL: target.url, OK: err == nil, DurationMS: time.Since(started).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func diskUsage(dir string) DiskUsage {
+	usage := DiskUsage{Path: dir}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		usage.Error = err.Error()
+		return usage
+	}
+	//nolint:gosec
+	usage.FreeBytes, usage.TotalBytes = stat.Bavail*uint64(stat.Bsize), stat.Blocks*uint64(stat.Bsize)
+	return usage
+}
+
+// readTail returns the last size bytes of the file, starting from a complete line.
+func readTail(name string, size int64) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - size
+	if offset <= 0 {
+		return io.ReadAll(file)
+	}
+	content, err := io.ReadAll(io.NewSectionReader(file, offset, size))
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		content = content[i+1:]
+	}
+	return content, nil
+}
+
+func writeZip(w io.Writer, files map[string][]byte, modified time.Time) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// pruneDiagnosticBundles removes the oldest bundles, so that they do not fill the storage of the device.
+func pruneDiagnosticBundles(configPath string) {
+	bundles, err := filepath.Glob(filepath.Join(configPath, diagnosticsPrefix+"*.zip"))
+	if err != nil || len(bundles) <= maxDiagnosticBundles {
+		return
+	}
+	// the names sort by creation time
+	sort.Strings(bundles)
+	for _, bundle := range bundles[:len(bundles)-maxDiagnosticBundles] {
+		//nolint:errcheck
+		os.Remove(bundle)
+	}
+}
+
+func uploadDiagnosticBundle(remote *Remote, name string, bundle []byte) error {
+	client := gowebdav.NewClient(remote.remoteURL.String(), remote.Username, remote.Password)
+	client.SetTransport(remote.transport)
+	client.SetTimeout(time.Minute)
+	return client.WriteStream("/"+name, bytes.NewReader(bundle), 0600)
+}
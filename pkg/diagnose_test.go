@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	srv := newWebDAVServer(t, map[string]string{})
+	dropSrv := httptest.NewServer(newWebDAVHandler(t, map[string]string{}))
+	t.Cleanup(dropSrv.Close)
+	generate204 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(generate204.Close)
+	configPath, basePath := t.TempDir(), t.TempDir()
+	configFile := filepath.Join(configPath, "config.yaml")
+	writeTestFile(t, configFile, fmt.Sprintf(`remotes:
+- url: %s/s/shareToken1
+  password: p
+  local_path: books
+connectivity_probe:
+  mode: generate_204
+  url: %s
+diagnostics:
+  upload_url: %s/s/dropToken
+  upload_password: dropPassword
+`, srv.URL, generate204.URL, dropSrv.URL))
+	writeTestFile(t, filepath.Join(configPath, LogFileName),
+		fmt.Sprintf("level=INFO msg=\"Syncing %s/s/shareToken1\"\n", srv.URL))
+	require.NoError(t, appendHistory(configPath, &SyncRun{ID: "a", Outcome: RunCompleted}, 10))
+
+	bundlePath, err := Diagnose(context.Background(), DiagnoseOptions{ConfigFilePath: configFile,
+		BasePath: basePath})
+	require.NoError(t, err)
+	assert.Equal(t, configPath, filepath.Dir(bundlePath))
+	bundle, err := zip.OpenReader(bundlePath)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer bundle.Close()
+
+	config := readZipFile(t, &bundle.Reader, "config.yaml")
+	assert.Contains(t, config, "  password: REDACTED\n")
+	assert.Contains(t, config, "  upload_password: REDACTED\n")
+	assert.Contains(t, config, "  local_path: books\n")
+	log := readZipFile(t, &bundle.Reader, LogFileName)
+	assert.Contains(t, log, "Syncing")
+	assert.Contains(t, readZipFile(t, &bundle.Reader, "history.json"), `"id": "a"`)
+	for _, file := range bundle.File {
+		content := readZipFile(t, &bundle.Reader, file.Name)
+		for _, secret := range []string{"shareToken1", "dropToken", "dropPassword"} {
+			assert.NotContains(t, content, secret, file.Name)
+		}
+	}
+
+	var summary DiagnosticSummary
+	require.NoError(t, json.Unmarshal([]byte(readZipFile(t, &bundle.Reader, "summary.json")), &summary))
+	assert.Empty(t, summary.ConfigError)
+	assert.Equal(t, map[string]bool{"config.yaml": true, "history.json": true, LogFileName: true,
+		stderrLogFileName: false}, summary.Files)
+	require.Len(t, summary.Disks, 2)
+	assert.NotZero(t, summary.Disks[0].TotalBytes)
+	require.Len(t, summary.Probes, 2)
+	// status.php is probed even in the generate_204 mode
+	assert.Equal(t, srv.URL+"/status.php", summary.Probes[0].URL)
+	assert.Equal(t, generate204.URL, summary.Probes[1].URL)
+	assert.True(t, summary.Probes[1].OK)
+
+	// the bundle is uploaded to the file drop
+	bundlePath, err = Diagnose(context.Background(), DiagnoseOptions{ConfigFilePath: configFile,
+		BasePath: basePath, Upload: true})
+	require.NoError(t, err)
+	req, err := http.NewRequest("PROPFIND", dropSrv.URL+"/public.php/webdav/"+filepath.Base(bundlePath), nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	//nolint:errcheck
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+}
+
+func TestDiagnose_invalidConfig(t *testing.T) {
+	configPath := t.TempDir()
+	configFile := filepath.Join(configPath, "config.yaml")
+	writeTestFile(t, configFile, "remotes:\n- url: https://cloud.example.com/s/shareToken1\n  password: secret\n"+
+		"history_size: -1\n")
+
+	bundlePath, err := Diagnose(context.Background(), DiagnoseOptions{ConfigFilePath: configFile,
+		BasePath: t.TempDir(), Upload: true})
+	assert.ErrorContains(t, err, "cannot upload the bundle with an invalid configuration")
+	require.NotEmpty(t, bundlePath)
+	bundle, err := zip.OpenReader(bundlePath)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer bundle.Close()
+	config := readZipFile(t, &bundle.Reader, "config.yaml")
+	assert.NotContains(t, config, "secret")
+	assert.NotContains(t, config, "shareToken1")
+	var summary DiagnosticSummary
+	require.NoError(t, json.Unmarshal([]byte(readZipFile(t, &bundle.Reader, "summary.json")), &summary))
+	assert.Contains(t, summary.ConfigError, "history_size")
+	assert.Empty(t, summary.Probes)
+}
+
+func TestReadTail(t *testing.T) {
+	name := filepath.Join(t.TempDir(), LogFileName)
+	writeTestFile(t, name, "first line\nsecond line\nthird line\n")
+	content, err := readTail(name, 15)
+	require.NoError(t, err)
+	assert.Equal(t, "third line\n", string(content))
+	content, err = readTail(name, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, "first line\nsecond line\nthird line\n", string(content))
+}
+
+func TestPruneDiagnosticBundles(t *testing.T) {
+	dir := t.TempDir()
+	for _, stamp := range []string{"20240101T000000Z", "20240102T000000Z", "20240103T000000Z", "20240104T000000Z"} {
+		writeTestFile(t, filepath.Join(dir, diagnosticsPrefix+stamp+".zip"), "bundle")
+	}
+	writeTestFile(t, filepath.Join(dir, "config.yaml"), "remotes: []")
+	pruneDiagnosticBundles(dir)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, "config.yaml diagnostics-20240102T000000Z.zip diagnostics-20240103T000000Z.zip "+
+		"diagnostics-20240104T000000Z.zip", strings.Join(names, " "))
+}
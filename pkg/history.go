@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	historyFileName    = "history.json"
+	defaultHistorySize = 50
+)
+
+// SyncTrigger is what started a sync run.
+type SyncTrigger string
+
+const (
+	// TriggerNetwork is a run started because the device connected to a network
+	TriggerNetwork SyncTrigger = "network"
+	// TriggerStartup is a run started with the daemon
+	TriggerStartup SyncTrigger = "startup"
+	// TriggerFollowUp is a run started because a trigger was received during the previous run
+	TriggerFollowUp SyncTrigger = "follow_up"
+	// TriggerManual is a run started with the sync command
+	TriggerManual SyncTrigger = "manual"
+)
+
+// RunOutcome is the outcome of a sync run.
+type RunOutcome string
+
+const (
+	// RunCompleted means that all the remotes were synced
+	RunCompleted RunOutcome = "completed"
+	// RunFailed means that some remotes failed, the others were synced
+	RunFailed RunOutcome = "failed"
+	// RunSkipped means that nothing was synced, e.g. because of the network or the battery, see the reason
+	RunSkipped RunOutcome = "skipped"
+	// RunCancelled means that the run was cancelled by the user or interrupted
+	RunCancelled RunOutcome = "cancelled"
+)
+
+// SyncRun is the record of a sync run, kept in the history.
+type SyncRun struct {
+	// ID is the correlation ID of the log messages of the run
+	ID         string      `json:"id"`
+	Trigger    SyncTrigger `json:"trigger"`
+	Profile    string      `json:"profile,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Outcome    RunOutcome  `json:"outcome"`
+	// Reason tells why the run was skipped or cancelled
+	Reason string `json:"reason,omitempty"`
+	// Note reports the restrictions applied by the battery policy
+	Note    string          `json:"note,omitempty"`
+	Remotes []*RemoteResult `json:"remotes,omitempty"`
+}
+
+type history struct {
+	Runs []*SyncRun `json:"runs"`
+}
+
+type triggerKey struct{}
+
+// withTrigger returns a context carrying the trigger of the sync run started with it.
+func withTrigger(ctx context.Context, trigger SyncTrigger) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+func triggerFrom(ctx context.Context) SyncTrigger {
+	if trigger, ok := ctx.Value(triggerKey{}).(SyncTrigger); ok {
+		return trigger
+	}
+	return TriggerNetwork
+}
+
+// finish sets the outcome of a run that got to sync the remotes.
+func (r *SyncRun) finish() {
+	r.Outcome = RunCompleted
+	for _, result := range r.Remotes {
+		if result.Error != nil {
+			r.Outcome = RunFailed
+		}
+	}
+}
+
+// skip records that the run stopped before syncing the remotes.
+func (r *SyncRun) skip(outcome RunOutcome, reason string) {
+	r.Outcome, r.Reason = outcome, reason
+}
+
+// Counts returns the number of added, updated and deleted files and the downloaded bytes of all the remotes.
+func (r *SyncRun) Counts() (added, updated, deleted int, bytes int64) {
+	for _, result := range r.Remotes {
+		added += len(result.Added)
+		updated += len(result.Updated)
+		deleted += len(result.Deleted)
+		bytes += result.Bytes
+	}
+	return
+}
+
+// Summary returns the message shown to the user at the end of the run: the downloaded files of every remote, what
+// went wrong with the failed ones and the restrictions of the battery policy.
+func (r *SyncRun) Summary() string {
+	return r.summary(defaultMessages)
+}
+
+// localize renders the messages of the errors of the remotes with m, also in the JSON of the run.
+func (r *SyncRun) localize(m *messages) {
+	for _, result := range r.Remotes {
+		if result.Error != nil {
+			result.Error.messages = m
+		}
+	}
+}
+
+// summaryRemote is a remote in the data of the summary template.
+type summaryRemote struct {
+	Remote string
+	Files  []string
+	Error  string
+}
+
+// summary renders the summary of the run with the messages. The template gets the run as .Run, its counts, the
+// remotes with their downloaded files and errors, the error messages as .Failures, and the battery .Note.
+func (r *SyncRun) summary(m *messages) string {
+	var remotes []summaryRemote
+	var failures []string
+	downloaded := 0
+	for _, result := range r.Remotes {
+		remote := summaryRemote{Remote: result.Remote, Files: result.downloaded()}
+		downloaded += len(remote.Files)
+		if result.Error != nil {
+			remote.Error = result.Error.localized(m)
+			failures = append(failures, remote.Error)
+		}
+		remotes = append(remotes, remote)
+	}
+	added, updated, deleted, bytes := r.Counts()
+	return m.format(msgSummary, msgData{"Run": r, "Profile": r.Profile, "Downloaded": downloaded, "Added": added,
+		"Updated": updated, "Deleted": deleted, "Size": formatBytes(bytes), "Remotes": remotes,
+		"Failures": failures, "Note": r.Note})
+}
+
+func loadHistory(configPath string) (*history, error) {
+	h := &history{}
+	content, err := os.ReadFile(path.Join(configPath, historyFileName))
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the sync history: %w", err)
+	}
+	if err = json.Unmarshal(content, h); err != nil {
+		return nil, fmt.Errorf("error parsing the sync history: %w", err)
+	}
+	return h, nil
+}
+
+// appendHistory adds the run to the history, keeping the last size runs.
+func appendHistory(configPath string, run *SyncRun, size int) error {
+	h, err := loadHistory(configPath)
+	if err != nil {
+		// do not lose the new runs because of a corrupted history
+		h = &history{}
+	}
+	h.Runs = append(h.Runs, run)
+	if len(h.Runs) > size {
+		h.Runs = h.Runs[len(h.Runs)-size:]
+	}
+	content, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path.Join(configPath, historyFileName), bytes.NewReader(content), 0644)
+}
+
+// ReadHistory returns the last runs recorded in the history of the configuration directory, the most recent first.
+// All the runs are returned if last is 0.
+func ReadHistory(configPath string, last int) ([]*SyncRun, error) {
+	h, err := loadHistory(configPath)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]*SyncRun, 0, len(h.Runs))
+	for i := len(h.Runs) - 1; i >= 0 && (last == 0 || len(runs) < last); i-- {
+		runs = append(runs, h.Runs[i])
+	}
+	return runs, nil
+}
+
+// PrintHistory writes the runs to w as a table, or as JSON if asJSON is set.
+func PrintHistory(w io.Writer, runs []*SyncRun, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	//nolint:errcheck
+	fmt.Fprintln(tw, "ID\tSTARTED\tDURATION\tTRIGGER\tOUTCOME\tADDED\tUPDATED\tDELETED\tSIZE\tFAILED\tREASON")
+	for _, run := range runs {
+		added, updated, deleted, size := run.Counts()
+		var failed []string
+		for _, result := range run.Remotes {
+			if result.Error != nil {
+				failed = append(failed, fmt.Sprintf("%s (%s)", result.Remote, result.Error.Kind))
+			}
+		}
+		//nolint:errcheck
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n", run.ID,
+			run.StartedAt.Local().Format(time.DateTime), run.FinishedAt.Sub(run.StartedAt).Round(time.Second),
+			run.Trigger, run.Outcome, added, updated, deleted, formatBytes(size), orDash(strings.Join(failed, ", ")),
+			orDash(run.Reason))
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
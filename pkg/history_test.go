@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSync_recordsHistory(t *testing.T) {
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1", "book2.epub": "book2"})
+	n := newTestReconciler(t, srv)
+	localPath := n.config.Remotes[0].LocalPath
+	writeTestFile(t, filepath.Join(localPath, "book2.epub"), "old")
+	writeTestFile(t, filepath.Join(localPath, "deleted.epub"), "deleted")
+
+	n.runSync(withTrigger(context.Background(), TriggerStartup))
+
+	runs, err := ReadHistory(n.config.configPath, 0)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	run := runs[0]
+	assert.Len(t, run.ID, 8)
+	assert.Equal(t, TriggerStartup, run.Trigger)
+	assert.Equal(t, RunCompleted, run.Outcome)
+	assert.False(t, run.FinishedAt.Before(run.StartedAt))
+	added, updated, deleted, size := run.Counts()
+	assert.Equal(t, []int{1, 1, 1}, []int{added, updated, deleted})
+	assert.Equal(t, int64(10), size)
+	assert.Equal(t, run.ID, n.Status().LastRun.ID)
+
+	// the toast is built from the recorded run
+	var last string
+	for len(n.toastsChan) > 0 {
+		last = <-n.toastsChan
+	}
+	assert.Equal(t, run.Summary(), last)
+	assert.Contains(t, last, "Synced 2 files")
+}
+
+func TestHistory_retention(t *testing.T) {
+	dir := t.TempDir()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, appendHistory(dir, &SyncRun{ID: id, Outcome: RunCompleted}, 3))
+	}
+	runs, err := ReadHistory(dir, 0)
+	require.NoError(t, err)
+	var ids []string
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+	}
+	assert.Equal(t, []string{"d", "c", "b"}, ids)
+
+	runs, err = ReadHistory(dir, 2)
+	require.NoError(t, err)
+	assert.Len(t, runs, 2)
+
+	// a missing history is empty
+	runs, err = ReadHistory(t.TempDir(), 0)
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+
+	// a corrupted history is replaced rather than blocking the new runs
+	writeTestFile(t, filepath.Join(dir, historyFileName), "{")
+	_, err = ReadHistory(dir, 0)
+	assert.ErrorContains(t, err, "error parsing the sync history")
+	require.NoError(t, appendHistory(dir, &SyncRun{ID: "e"}, 3))
+	runs, err = ReadHistory(dir, 0)
+	require.NoError(t, err)
+	assert.Len(t, runs, 1)
+}
+
+func TestPrintHistory(t *testing.T) {
+	started := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	runs := []*SyncRun{
+		{ID: "0123abcd", Trigger: TriggerNetwork, StartedAt: started, FinishedAt: started.Add(42 * time.Second),
+			Outcome: RunFailed, Remotes: []*RemoteResult{
+				{Remote: "share1/", Outcome: RemoteOK, Added: []string{"a.epub"}, Updated: []string{"b.epub"},
+					Bytes: 3 << 20},
+				{Remote: "share2/", Outcome: RemoteFailed, Error: &RemoteError{Kind: RemoteErrorAuth}},
+			}},
+		{ID: "4567cdef", Trigger: TriggerFollowUp, StartedAt: started, FinishedAt: started, Outcome: RunSkipped,
+			Reason: "battery below 10%"},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, PrintHistory(buf, runs, false))
+	out := buf.String()
+	assert.Contains(t, out, "ID")
+	assert.Contains(t, out, "0123abcd")
+	assert.Contains(t, out, "42s")
+	assert.Contains(t, out, "3.0 MB")
+	assert.Contains(t, out, "share2/ (auth)")
+	assert.Contains(t, out, "battery below 10%")
+
+	buf.Reset()
+	require.NoError(t, PrintHistory(buf, runs, true))
+	var decoded []*SyncRun
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Len(t, decoded, 2)
+	assert.Equal(t, RunFailed, decoded[0].Outcome)
+	assert.Equal(t, []string{"a.epub"}, decoded[0].Remotes[0].Added)
+	// the messages of the errors survive the history
+	assert.Equal(t, RemoteErrorAuth, decoded[0].Remotes[1].Error.Kind)
+	assert.Equal(t, runs[0].Remotes[1].Error.Message(), decoded[0].Remotes[1].Error.Message())
+}
@@ -0,0 +1,298 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	updateStateFileName = "update-state.json"
+	// backupDirName is the directory, relative to the installation root, where the previous installation is kept
+	backupDirName = "usr/local/nextcloud-kobo.backup"
+	// maxFailedStarts is the number of consecutive starts without reaching the healthy state after which an update is
+	// rolled back
+	maxFailedStarts = 3
+)
+
+type updateStatus string
+
+const (
+	updateStatusHealthy    updateStatus = "healthy"
+	updateStatusPending    updateStatus = "pending_health"
+	updateStatusRolledBack updateStatus = "rolled_back"
+)
+
+// updateState is persisted in the config directory to track the health of the last installed update across restarts.
+type updateState struct {
+	Version         string       `json:"version,omitempty"`
+	PreviousVersion string       `json:"previous_version,omitempty"`
+	Status          updateStatus `json:"status,omitempty"`
+	FailedStarts    int          `json:"failed_starts"`
+	// AddedFiles are the files created by the update, that do not exist in the backup and are removed on rollback
+	AddedFiles []string `json:"added_files,omitempty"`
+	// Blacklist lists the versions that were rolled back, and that will not be installed again
+	Blacklist []string `json:"blacklist,omitempty"`
+}
+
+// installer applies the updates downloaded by the updater, keeping a backup of the previous installation, and rolls
+// them back if the new version does not reach the healthy state after maxFailedStarts starts.
+type installer struct {
+	configPath string
+	// root is the directory the release tarballs are extracted to, / on the device
+	root string
+}
+
+func newInstaller(configPath string) *installer {
+	return &installer{configPath: configPath, root: "/"}
+}
+
+// Prestart is run by the supervisor before every start of the daemon. It applies the pending update, if any and
+// applyUpdate is set, or counts the failed starts of the last update and rolls it back when they reach
+// maxFailedStarts. It returns true if the installation changed, so that the supervisor and run.sh can be reloaded.
+func Prestart(configPath string, applyUpdate bool) (changed bool, err error) {
+	return newInstaller(configPath).prestart(applyUpdate)
+}
+
+// MarkUpdateHealthy records that the running version started correctly, so that it is not rolled back.
+func MarkUpdateHealthy(configPath string) error {
+	i := newInstaller(configPath)
+	state, err := i.loadState()
+	if err != nil || state.Status != updateStatusPending {
+		return err
+	}
+	slog.Info("Update is healthy", "version", state.Version)
+	state.Status = updateStatusHealthy
+	state.FailedStarts = 0
+	return i.saveState(state)
+}
+
+func (i *installer) prestart(applyUpdate bool) (bool, error) {
+	state, err := i.loadState()
+	if err != nil {
+		return false, err
+	}
+	if _, err = os.Stat(i.pendingUpdatePath()); err == nil && applyUpdate {
+		return true, i.apply(state)
+	}
+	if state.Status != updateStatusPending {
+		return false, nil
+	}
+	state.FailedStarts++
+	if state.FailedStarts <= maxFailedStarts {
+		slog.Info("Starting the updated version", "version", state.Version, "attempt", state.FailedStarts,
+			"max_attempts", maxFailedStarts)
+		return false, i.saveState(state)
+	}
+	slog.Error("The updated version failed to start, rolling back", "version", state.Version,
+		"attempts", maxFailedStarts, "previous_version", state.PreviousVersion)
+	return true, i.rollback(state)
+}
+
+// apply backs up the files the pending update overwrites and extracts it.
+func (i *installer) apply(state *updateState) error {
+	archivePath := i.pendingUpdatePath()
+	//nolint:errcheck
+	defer os.Remove(archivePath)
+	version, _ := os.ReadFile(path.Join(i.configPath, versionFileName))
+	if slices.Contains(state.Blacklist, string(version)) {
+		slog.Warn("Discarding the update to a blacklisted version", "version", string(version))
+		return nil
+	}
+	if err := validateReleaseArchive(archivePath, math.MaxInt64); err != nil {
+		return err
+	}
+	backupDir := filepath.Join(i.root, backupDirName)
+	if err := os.RemoveAll(backupDir); err != nil {
+		return fmt.Errorf("failed to remove the old backup: %w", err)
+	}
+	var added []string
+	err := walkArchive(archivePath, func(header *tar.Header, name string, _ io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		err := copyFile(filepath.Join(i.root, name), filepath.Join(backupDir, name))
+		if os.IsNotExist(err) {
+			added = append(added, name)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up the current installation: %w", err)
+	}
+	// recorded before extracting, so that a rollback restores the running version even when the extraction fails
+	state.PreviousVersion = RunningVersion()
+	state.Version = string(version)
+	state.AddedFiles = added
+	slog.Info("Extracting the update", "version", string(version))
+	err = walkArchive(archivePath, func(header *tar.Header, name string, content io.Reader) error {
+		target := filepath.Join(i.root, name)
+		if header.Typeflag == tar.TypeDir {
+			return os.MkdirAll(target, 0755)
+		}
+		return writeFileAtomically(target, content, fs.FileMode(header.Mode).Perm())
+	})
+	if err != nil {
+		// leave the device with the previous installation, and do not try again with this version
+		slog.Error("Failed to extract the update, restoring the backup", "error", err)
+		return i.rollback(state)
+	}
+	state.Status = updateStatusPending
+	state.FailedStarts = 0
+	return i.saveState(state)
+}
+
+// rollback restores the backup of the previous installation and blacklists the current version.
+func (i *installer) rollback(state *updateState) error {
+	backupDir := filepath.Join(i.root, backupDirName)
+	err := filepath.WalkDir(backupDir, func(backupPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(backupDir, backupPath)
+		if err != nil {
+			return err
+		}
+		return copyFile(backupPath, filepath.Join(i.root, name))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore the backup: %w", err)
+	}
+	for _, name := range state.AddedFiles {
+		if err = os.Remove(filepath.Join(i.root, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	if state.Version != "" && !slices.Contains(state.Blacklist, state.Version) {
+		state.Blacklist = append(state.Blacklist, state.Version)
+	}
+	if err = os.WriteFile(path.Join(i.configPath, versionFileName), []byte(state.PreviousVersion), 0600); err != nil {
+		return fmt.Errorf("failed to write version file: %w", err)
+	}
+	state.Status = updateStatusRolledBack
+	state.AddedFiles = nil
+	return i.saveState(state)
+}
+
+func (i *installer) pendingUpdatePath() string {
+	return path.Join(i.configPath, releaseFileName)
+}
+
+// loadState reads the update state. A missing state file is not an error, and it returns an empty state.
+func (i *installer) loadState() (*updateState, error) {
+	return loadUpdateState(i.configPath)
+}
+
+func (i *installer) saveState(state *updateState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path.Join(i.configPath, updateStateFileName), bytes.NewReader(content), 0600)
+}
+
+func loadUpdateState(configPath string) (*updateState, error) {
+	state := &updateState{}
+	content, err := os.ReadFile(path.Join(configPath, updateStateFileName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the update state: %w", err)
+	}
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("error parsing the update state: %w", err)
+	}
+	return state, nil
+}
+
+// walkArchive calls fn for every entry of a gzipped tarball, with its cleaned name. The archive must have been
+// validated with validateReleaseArchive.
+func walkArchive(archivePath string, fn func(header *tar.Header, name string, content io.Reader) error) error {
+	file, err := os.Open(path.Clean(archivePath))
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer gz.Close()
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := archiveEntryName(header)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		if err = fn(header, name, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// copyFile copies src to dst, creating the parent directories of dst and preserving the permissions.
+func copyFile(src, dst string) error {
+	file, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(dst, file, info.Mode().Perm())
+}
+
+// writeFileAtomically writes the content to a temporary file and renames it to name, so that a running binary can be
+// replaced and no partially written file is left behind.
+func writeFileAtomically(name string, content io.Reader, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, content); err != nil {
+		//nolint:errcheck
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		//nolint:errcheck
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestInstaller(t *testing.T) *installer {
+	t.Helper()
+	i := &installer{configPath: t.TempDir(), root: t.TempDir()}
+	writeTestFile(t, filepath.Join(i.root, "usr/local/nextcloud-kobo/nextcloud-kobo"), "old binary")
+	writeTestFile(t, filepath.Join(i.root, "usr/local/nextcloud-kobo/run.sh"), "old run.sh")
+	return i
+}
+
+// stageUpdate stores a release where the updater does after a successful download.
+func stageUpdate(t *testing.T, i *installer, version string, files map[string]string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(i.pendingUpdatePath(), makeTarball(t, files), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(i.configPath, versionFileName), []byte(version), 0600))
+}
+
+func readInstalled(t *testing.T, i *installer, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(i.root, name))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestInstaller_rollback(t *testing.T) {
+	i := newTestInstaller(t)
+	stageUpdate(t, i, "v1.1.0", map[string]string{
+		"usr/local/nextcloud-kobo/nextcloud-kobo": "new binary",
+		"usr/local/nextcloud-kobo/run.sh":         "new run.sh",
+		"usr/local/nextcloud-kobo/new-file":       "new file",
+	})
+
+	changed, err := i.prestart(true)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "new binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	assert.Equal(t, "new file", readInstalled(t, i, "usr/local/nextcloud-kobo/new-file"))
+	assert.NoFileExists(t, i.pendingUpdatePath())
+	info, err := os.Stat(filepath.Join(i.root, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// the new version never becomes healthy
+	for range maxFailedStarts {
+		changed, err = i.prestart(true)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	}
+	changed, err = i.prestart(true)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "old binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	assert.Equal(t, "old run.sh", readInstalled(t, i, "usr/local/nextcloud-kobo/run.sh"))
+	assert.Empty(t, readInstalled(t, i, "usr/local/nextcloud-kobo/new-file"))
+	state, err := i.loadState()
+	require.NoError(t, err)
+	assert.Equal(t, updateStatusRolledBack, state.Status)
+	assert.Equal(t, []string{"v1.1.0"}, state.Blacklist)
+
+	// a blacklisted version is not installed again
+	stageUpdate(t, i, "v1.1.0", map[string]string{"usr/local/nextcloud-kobo/nextcloud-kobo": "new binary"})
+	_, err = i.prestart(true)
+	require.NoError(t, err)
+	assert.Equal(t, "old binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	assert.NoFileExists(t, i.pendingUpdatePath())
+
+	// the updater skips it too
+	u, err := newUpdater(&Config{configPath: i.configPath, UpdateSource: updateSourceGitHub,
+		UpdateChannel: updateChannelStable})
+	require.NoError(t, err)
+	release, err := u.selectUpdate("v1.0.0", []*release{{Tag: "v1.1.0"}})
+	assert.ErrorContains(t, err, "no stable release found")
+	assert.Nil(t, release)
+}
+
+func TestInstaller_healthy(t *testing.T) {
+	i := newTestInstaller(t)
+	stageUpdate(t, i, "v1.1.0", map[string]string{"usr/local/nextcloud-kobo/nextcloud-kobo": "new binary"})
+	// the update is postponed to the next boot
+	changed, err := i.prestart(false)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "old binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+
+	_, err = i.prestart(true)
+	require.NoError(t, err)
+	_, err = i.prestart(true)
+	require.NoError(t, err)
+
+	require.NoError(t, MarkUpdateHealthy(i.configPath))
+	for range maxFailedStarts + 1 {
+		changed, err = i.prestart(true)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	}
+	assert.Equal(t, "new binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	state, err := i.loadState()
+	require.NoError(t, err)
+	assert.Equal(t, updateStatusHealthy, state.Status)
+	assert.Equal(t, 0, state.FailedStarts)
+}
+
+func TestInstaller_failedExtraction(t *testing.T) {
+	original := Version
+	Version = "v1.0.0"
+	t.Cleanup(func() { Version = original })
+	i := newTestInstaller(t)
+	// the state of the update to the running version, whose previous version must not be restored
+	require.NoError(t, i.saveState(&updateState{Version: "v1.0.0", PreviousVersion: "v0.9.0",
+		Status: updateStatusHealthy}))
+	// z/inner cannot be extracted once z is a file
+	stageUpdate(t, i, "v1.1.0", map[string]string{
+		"usr/local/nextcloud-kobo/nextcloud-kobo": "new binary",
+		"usr/local/nextcloud-kobo/z":              "new file",
+		"usr/local/nextcloud-kobo/z/inner":        "new file",
+	})
+
+	changed, err := i.prestart(true)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "old binary", readInstalled(t, i, "usr/local/nextcloud-kobo/nextcloud-kobo"))
+	assert.Empty(t, readInstalled(t, i, "usr/local/nextcloud-kobo/z"))
+	version, err := os.ReadFile(filepath.Join(i.configPath, versionFileName))
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", string(version))
+	state, err := i.loadState()
+	require.NoError(t, err)
+	assert.Equal(t, updateStatusRolledBack, state.Status)
+	assert.Equal(t, "v1.0.0", state.PreviousVersion)
+	assert.Equal(t, []string{"v1.1.0"}, state.Blacklist)
+}
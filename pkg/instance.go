@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// InstanceDaemon and InstanceSupervisor are the processes that run at most once for each configuration directory
+	InstanceDaemon     = "daemon"
+	InstanceSupervisor = "supervisor"
+
+	// ExitCodeAlreadyRunning is the exit code of the commands that cannot lock their instance
+	ExitCodeAlreadyRunning = 7
+
+	// stopPollInterval is how often StopInstance checks whether the instance exited
+	stopPollInterval = 100 * time.Millisecond
+	// lockPollInterval is how often the supervisor checks whether the lock of the daemon is released
+	lockPollInterval = 5 * time.Second
+)
+
+var (
+	ErrAlreadyRunning = errors.New("already running")
+	ErrNotRunning     = errors.New("not running")
+)
+
+// InstanceLock is held by a running instance. It is an flock on a file of the configuration directory, that the
+// kernel releases when the process exits, even when it crashes, and that stores the PID of the process and its holder.
+type InstanceLock struct {
+	file *os.File
+}
+
+func instanceLockPath(configPath, instance string) string {
+	return filepath.Join(configPath, instance+".lock")
+}
+
+// LockInstance acquires the lock of the instance, failing with ErrAlreadyRunning if another process holds it. The
+// holder is the command taking the lock: the instance itself, or a command taking its place, such as sync.
+func LockInstance(configPath, instance, holder string) (*InstanceLock, error) {
+	name := instanceLockPath(configPath, instance)
+	file, err := os.OpenFile(filepath.Clean(name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the lock file: %w", err)
+	}
+	//nolint:gosec
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		//nolint:errcheck
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			pid, running, _ := readInstanceLock(name, instance)
+			return nil, fmt.Errorf("%s %w with PID %d", running, ErrAlreadyRunning, pid)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", name, err)
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), holder)), 0)
+	}
+	if err != nil {
+		//nolint:errcheck
+		file.Close()
+		return nil, fmt.Errorf("failed to write the PID to %s: %w", name, err)
+	}
+	return &InstanceLock{file: file}, nil
+}
+
+// Release releases the lock. The file is kept, as removing it would let another process lock a new file while a
+// third one still waits on the old one.
+func (l *InstanceLock) Release() error {
+	//nolint:errcheck
+	l.file.Truncate(0)
+	return l.file.Close()
+}
+
+// RunningInstance returns the PID and the holder of the process holding the lock of the instance, or ErrNotRunning.
+func RunningInstance(configPath, instance string) (pid int, holder string, err error) {
+	name := instanceLockPath(configPath, instance)
+	file, err := os.Open(filepath.Clean(name))
+	if os.IsNotExist(err) {
+		return 0, "", ErrNotRunning
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	//nolint:gosec
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	switch {
+	case err == nil:
+		// nobody holds the lock: the file is left from an instance that exited
+		return 0, "", ErrNotRunning
+	case !errors.Is(err, syscall.EWOULDBLOCK):
+		return 0, "", fmt.Errorf("failed to check the lock of %s: %w", name, err)
+	}
+	return readInstanceLock(name, instance)
+}
+
+// readInstanceLock reads the PID and the holder of the lock. The files written by the older versions only store the
+// PID of the instance.
+func readInstanceLock(name, instance string) (pid int, holder string, err error) {
+	content, err := os.ReadFile(filepath.Clean(name))
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, "", fmt.Errorf("invalid PID in %s: empty file", name)
+	}
+	if pid, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, "", fmt.Errorf("invalid PID in %s: %w", name, err)
+	}
+	holder = instance
+	if len(fields) > 1 {
+		holder = fields[1]
+	}
+	return pid, holder, nil
+}
+
+// runningInstance is RunningInstance failing if the lock is held by another command than the instance itself, e.g.
+// by a sync started by hand, that must not be stopped or restarted as the instance.
+func runningInstance(configPath, instance string) (int, error) {
+	pid, holder, err := RunningInstance(configPath, instance)
+	if err == nil && holder != instance {
+		return 0, fmt.Errorf("the %s is not running: %s with PID %d holds its lock", instance, holder, pid)
+	}
+	return pid, err
+}
+
+// StopInstance stops the supervisor, or the daemon if it runs without a supervisor, and waits for it to exit. The
+// daemon stops the sync in progress and shows the pending messages before exiting.
+func StopInstance(configPath string, timeout time.Duration) (instance string, err error) {
+	instance = InstanceSupervisor
+	pid, err := runningInstance(configPath, instance)
+	if errors.Is(err, ErrNotRunning) {
+		instance = InstanceDaemon
+		pid, err = runningInstance(configPath, instance)
+	}
+	if err != nil {
+		return instance, err
+	}
+	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return instance, fmt.Errorf("failed to stop the %s with PID %d: %w", instance, pid, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, _, err = RunningInstance(configPath, instance); errors.Is(err, ErrNotRunning) {
+			return instance, nil
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return instance, fmt.Errorf("the %s with PID %d did not exit within %s", instance, pid, timeout)
+}
+
+// RestartInstance asks the supervisor to restart the daemon, e.g. to load a new configuration. The daemon started
+// without a supervisor cannot restart itself: it has to be stopped and started again.
+func RestartInstance(configPath string) error {
+	pid, err := runningInstance(configPath, InstanceSupervisor)
+	if errors.Is(err, ErrNotRunning) {
+		return fmt.Errorf("the supervisor is %w: stop the daemon and start it again", ErrNotRunning)
+	}
+	if err != nil {
+		return err
+	}
+	if err = syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to restart the daemon of the supervisor with PID %d: %w", pid, err)
+	}
+	return nil
+}
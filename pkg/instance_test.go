@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockInstance(t *testing.T) {
+	configPath := t.TempDir()
+	_, _, err := RunningInstance(configPath, InstanceDaemon)
+	assert.ErrorIs(t, err, ErrNotRunning)
+
+	lock, err := LockInstance(configPath, InstanceDaemon, InstanceDaemon)
+	require.NoError(t, err)
+	pid, holder, err := RunningInstance(configPath, InstanceDaemon)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+	assert.Equal(t, InstanceDaemon, holder)
+	// the flocks of different open files conflict, even in the same process
+	_, err = LockInstance(configPath, InstanceDaemon, "sync")
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+	assert.ErrorContains(t, err, "daemon already running with PID")
+	// the supervisor has its own lock
+	supervisorLock, err := LockInstance(configPath, InstanceSupervisor, InstanceSupervisor)
+	require.NoError(t, err)
+	require.NoError(t, supervisorLock.Release())
+
+	require.NoError(t, lock.Release())
+	_, _, err = RunningInstance(configPath, InstanceDaemon)
+	assert.ErrorIs(t, err, ErrNotRunning)
+	lock, err = LockInstance(configPath, InstanceDaemon, InstanceDaemon)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+
+	// the files written by the older versions only store the PID
+	writeTestFile(t, filepath.Join(configPath, "daemon.lock"), "42\n")
+	pid, holder, err = readInstanceLock(filepath.Join(configPath, "daemon.lock"), InstanceDaemon)
+	require.NoError(t, err)
+	assert.Equal(t, 42, pid)
+	assert.Equal(t, InstanceDaemon, holder)
+}
+
+func TestStopInstance_sync(t *testing.T) {
+	configPath := t.TempDir()
+	// a sync started by hand holds the lock of the daemon: it is not stopped as the daemon
+	lock, err := LockInstance(configPath, InstanceDaemon, "sync")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		//nolint:errcheck
+		lock.Release()
+	})
+	_, err = StopInstance(configPath, 0)
+	assert.ErrorContains(t, err, "the daemon is not running: sync with PID")
+	assert.NotErrorIs(t, err, ErrNotRunning)
+	// update apply holds the lock of the supervisor too
+	supervisorLock, err := LockInstance(configPath, InstanceSupervisor, "update")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		//nolint:errcheck
+		supervisorLock.Release()
+	})
+	assert.ErrorContains(t, RestartInstance(configPath), "the supervisor is not running: update with PID")
+}
+
+func TestRestartInstance_withoutSupervisor(t *testing.T) {
+	assert.ErrorIs(t, RestartInstance(t.TempDir()), ErrNotRunning)
+	_, err := StopInstance(t.TempDir(), 0)
+	assert.ErrorIs(t, err, ErrNotRunning)
+}
@@ -0,0 +1,424 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// messageID is the name of a user-facing message, used to override its template in the configuration.
+type messageID string
+
+const (
+	msgSyncing           messageID = "syncing"
+	msgCaptivePortal     messageID = "captive_portal"
+	msgSyncFailed        messageID = "sync_failed"
+	msgSyncDisabled      messageID = "sync_disabled"
+	msgSyncSkipped       messageID = "sync_skipped"
+	msgSyncCancelled     messageID = "sync_cancelled"
+	msgDownloaded        messageID = "downloaded"
+	msgSummary           messageID = "summary"
+	msgNotificationTitle messageID = "notification_title"
+
+	msgLargeSyncTitle  messageID = "large_sync_title"
+	msgLargeSyncBody   messageID = "large_sync_body"
+	msgLargeSyncAccept messageID = "large_sync_accept"
+	msgLargeSyncReject messageID = "large_sync_reject"
+	msgDeleteTitle     messageID = "delete_title"
+	msgDeleteBody      messageID = "delete_body"
+	msgDeleteAccept    messageID = "delete_accept"
+	msgDeleteReject    messageID = "delete_reject"
+	msgUpdateTitle     messageID = "update_title"
+	msgUpdateBody      messageID = "update_body"
+	msgUpdateAccept    messageID = "update_accept"
+	msgUpdateReject    messageID = "update_reject"
+
+	msgUpdateFailed     messageID = "update_failed"
+	msgUpdateRestarting messageID = "update_restarting"
+	msgUpdateNextBoot   messageID = "update_next_boot"
+	msgUpdateApplying   messageID = "update_applying"
+
+	msgBatterySkip       messageID = "battery_skip"
+	msgBatterySmallFiles messageID = "battery_small_files"
+	msgBatteryLargeFiles messageID = "battery_large_files"
+	msgRemainingSkipped  messageID = "remaining_skipped"
+	msgFilesDeferred     messageID = "files_deferred"
+
+	msgErrorAuth          messageID = "error_auth"
+	msgErrorAuthShare     messageID = "error_auth_share"
+	msgErrorNotFound      messageID = "error_not_found"
+	msgErrorNotFoundShare messageID = "error_not_found_share"
+	msgErrorNetwork       messageID = "error_network"
+	msgErrorServer        messageID = "error_server"
+	msgErrorLocal         messageID = "error_local"
+	msgErrorUnknown       messageID = "error_unknown"
+
+	defaultLanguage = "en"
+)
+
+// koboConfigFile is the configuration of Nickel, where the language of its interface is read from.
+var koboConfigFile = "/mnt/onboard/.kobo/Kobo/Kobo eReader.conf"
+
+// summaryTemplate returns the template of the message shown at the end of a sync, with the given translations.
+func summaryTemplate(synced, remote, none string) string {
+	return "{{ if .Downloaded }}" + synced + "{{ range .Remotes }}{{ if .Files }}\n" + remote + " {{ .Remote }}" +
+		"{{ range .Files }}\n  - {{ . }}{{ end }}{{ end }}{{ end }}{{ else }}" + none + "{{ end }}" +
+		"{{ range .Failures }}\n{{ . }}{{ end }}{{ if .Note }}\n{{ .Note }}{{ end }}"
+}
+
+// catalogue has the templates of the messages by language. The English ones are used for the messages missing in
+// the other languages.
+var catalogue = map[string]map[messageID]string{
+	"en": {
+		msgSyncing:           "Syncing with Nextcloud{{ if .Profile }} (profile: {{ .Profile }}){{ end }}...",
+		msgCaptivePortal:     "Log into the Wi-Fi portal first",
+		msgSyncFailed:        "Failed to sync: {{ .Error }}",
+		msgSyncDisabled:      "Sync disabled by profile {{ .Profile }}",
+		msgSyncSkipped:       "Sync skipped: {{ .Reason }}",
+		msgSyncCancelled:     "Sync cancelled",
+		msgDownloaded:        "Downloaded {{ .File }}",
+		msgSummary:           summaryTemplate("Synced {{ .Downloaded }} files:", "Remote:", "No files updated"),
+		msgNotificationTitle: "Nextcloud sync {{ .Outcome }} on {{ .Device }}",
+
+		msgLargeSyncTitle:  "Large sync",
+		msgLargeSyncBody:   "The sync will download {{ .Files }} files ({{ .Size }}). Do you want to continue?",
+		msgLargeSyncAccept: "Download",
+		msgLargeSyncReject: "Cancel",
+		msgDeleteTitle:     "Delete books?",
+		msgDeleteBody: "The sync will delete {{ .Count }} files that were removed from Nextcloud:" +
+			"{{ range .Files }}\n{{ . }}{{ end }}{{ if .More }}\n...and {{ .More }} more{{ end }}",
+		msgDeleteAccept: "Delete",
+		msgDeleteReject: "Keep",
+		msgUpdateTitle:  "Nextcloud-Kobo update",
+		msgUpdateBody:   "Nextcloud-Kobo {{ .Version }} has been downloaded. Do you want to apply it now?",
+		msgUpdateAccept: "Now",
+		msgUpdateReject: "At next boot",
+
+		msgUpdateFailed:     "Update to {{ .Version }} failed: {{ .Error }}",
+		msgUpdateRestarting: "Nextcloud-Kobo {{ .Version }} downloaded, restarting to apply the update",
+		msgUpdateNextBoot:   "Nextcloud-Kobo {{ .Version }} will be applied at the next boot",
+		msgUpdateApplying:   "Restarting to apply Nextcloud-Kobo {{ .Version }}",
+
+		msgBatterySkip:       "battery at {{ .Capacity }}%, sync skipped",
+		msgBatterySmallFiles: "battery at {{ .Capacity }}%, files larger than {{ .SizeMB }} MB deferred",
+		msgBatteryLargeFiles: "files larger than {{ .SizeMB }} MB deferred until charging",
+		msgRemainingSkipped:  "Remaining remotes skipped: {{ .Reason }}",
+		msgFilesDeferred:     "{{ .Count }} files not downloaded: {{ .Reason }}",
+
+		msgErrorAuth:          "Wrong username or password for {{ .Remote }}",
+		msgErrorAuthShare:     "Share link expired or password changed for {{ .Remote }}",
+		msgErrorNotFound:      "Remote folder not found for {{ .Remote }}",
+		msgErrorNotFoundShare: "Share link not found for {{ .Remote }}",
+		msgErrorNetwork:       "Network error while syncing {{ .Remote }}",
+		msgErrorServer:        "Nextcloud server error ({{ .StatusCode }}) for {{ .Remote }}, try again later",
+		msgErrorLocal:         "Cannot write the files of {{ .Remote }}: {{ .Error }}",
+		msgErrorUnknown:       "Failed to sync {{ .Remote }}: {{ .Error }}",
+	},
+	"it": {
+		msgSyncing:       "Sincronizzazione con Nextcloud{{ if .Profile }} (profilo: {{ .Profile }}){{ end }}...",
+		msgCaptivePortal: "Accedi prima al portale della rete Wi-Fi",
+		msgSyncFailed:    "Sincronizzazione non riuscita: {{ .Error }}",
+		msgSyncDisabled:  "Sincronizzazione disattivata dal profilo {{ .Profile }}",
+		msgSyncSkipped:   "Sincronizzazione saltata: {{ .Reason }}",
+		msgSyncCancelled: "Sincronizzazione annullata",
+		msgDownloaded:    "Scaricato {{ .File }}",
+		msgSummary:       summaryTemplate("Sincronizzati {{ .Downloaded }} file:", "Remoto:", "Nessun file aggiornato"),
+		msgNotificationTitle: "Sincronizzazione Nextcloud {{ if eq .Outcome \"completed\" }}completata" +
+			"{{ else if eq .Outcome \"failed\" }}non riuscita{{ else if eq .Outcome \"skipped\" }}saltata" +
+			"{{ else }}annullata{{ end }} su {{ .Device }}",
+
+		msgLargeSyncTitle:  "Sincronizzazione di grandi dimensioni",
+		msgLargeSyncBody:   "La sincronizzazione scaricherà {{ .Files }} file ({{ .Size }}). Vuoi continuare?",
+		msgLargeSyncAccept: "Scarica",
+		msgLargeSyncReject: "Annulla",
+		msgDeleteTitle:     "Eliminare i libri?",
+		msgDeleteBody: "La sincronizzazione eliminerà {{ .Count }} file rimossi da Nextcloud:" +
+			"{{ range .Files }}\n{{ . }}{{ end }}{{ if .More }}\n...e altri {{ .More }}{{ end }}",
+		msgDeleteAccept: "Elimina",
+		msgDeleteReject: "Mantieni",
+		msgUpdateTitle:  "Aggiornamento di Nextcloud-Kobo",
+		msgUpdateBody:   "Nextcloud-Kobo {{ .Version }} è stato scaricato. Vuoi applicarlo ora?",
+		msgUpdateAccept: "Ora",
+		msgUpdateReject: "Al prossimo avvio",
+
+		msgUpdateFailed:     "Aggiornamento a {{ .Version }} non riuscito: {{ .Error }}",
+		msgUpdateRestarting: "Nextcloud-Kobo {{ .Version }} scaricato, riavvio per applicare l'aggiornamento",
+		msgUpdateNextBoot:   "Nextcloud-Kobo {{ .Version }} verrà applicato al prossimo avvio",
+		msgUpdateApplying:   "Riavvio per applicare Nextcloud-Kobo {{ .Version }}",
+
+		msgBatterySkip:       "batteria al {{ .Capacity }}%, sincronizzazione saltata",
+		msgBatterySmallFiles: "batteria al {{ .Capacity }}%, file più grandi di {{ .SizeMB }} MB rimandati",
+		msgBatteryLargeFiles: "file più grandi di {{ .SizeMB }} MB rimandati fino alla ricarica",
+		msgRemainingSkipped:  "Remoti rimanenti saltati: {{ .Reason }}",
+		msgFilesDeferred:     "{{ .Count }} file non scaricati: {{ .Reason }}",
+
+		msgErrorAuth:          "Nome utente o password errati per {{ .Remote }}",
+		msgErrorAuthShare:     "Link di condivisione scaduto o password cambiata per {{ .Remote }}",
+		msgErrorNotFound:      "Cartella remota non trovata per {{ .Remote }}",
+		msgErrorNotFoundShare: "Link di condivisione non trovato per {{ .Remote }}",
+		msgErrorNetwork:       "Errore di rete durante la sincronizzazione di {{ .Remote }}",
+		msgErrorServer:        "Errore del server Nextcloud ({{ .StatusCode }}) per {{ .Remote }}, riprova più tardi",
+		msgErrorLocal:         "Impossibile scrivere i file di {{ .Remote }}: {{ .Error }}",
+		msgErrorUnknown:       "Sincronizzazione di {{ .Remote }} non riuscita: {{ .Error }}",
+	},
+	"de": {
+		msgSyncing:       "Synchronisiere mit Nextcloud{{ if .Profile }} (Profil: {{ .Profile }}){{ end }}...",
+		msgCaptivePortal: "Melde dich zuerst im WLAN-Portal an",
+		msgSyncFailed:    "Synchronisierung fehlgeschlagen: {{ .Error }}",
+		msgSyncDisabled:  "Synchronisierung durch Profil {{ .Profile }} deaktiviert",
+		msgSyncSkipped:   "Synchronisierung übersprungen: {{ .Reason }}",
+		msgSyncCancelled: "Synchronisierung abgebrochen",
+		msgDownloaded:    "{{ .File }} heruntergeladen",
+		msgSummary: summaryTemplate("{{ .Downloaded }} Dateien synchronisiert:", "Remote:",
+			"Keine Dateien aktualisiert"),
+		msgNotificationTitle: "Nextcloud-Synchronisierung {{ if eq .Outcome \"completed\" }}abgeschlossen" +
+			"{{ else if eq .Outcome \"failed\" }}fehlgeschlagen{{ else if eq .Outcome \"skipped\" }}übersprungen" +
+			"{{ else }}abgebrochen{{ end }} auf {{ .Device }}",
+
+		msgLargeSyncTitle: "Große Synchronisierung",
+		msgLargeSyncBody: "Die Synchronisierung lädt {{ .Files }} Dateien ({{ .Size }}) herunter. " +
+			"Möchtest du fortfahren?",
+		msgLargeSyncAccept: "Herunterladen",
+		msgLargeSyncReject: "Abbrechen",
+		msgDeleteTitle:     "Bücher löschen?",
+		msgDeleteBody: "Die Synchronisierung löscht {{ .Count }} Dateien, die aus Nextcloud entfernt wurden:" +
+			"{{ range .Files }}\n{{ . }}{{ end }}{{ if .More }}\n...und {{ .More }} weitere{{ end }}",
+		msgDeleteAccept: "Löschen",
+		msgDeleteReject: "Behalten",
+		msgUpdateTitle:  "Nextcloud-Kobo-Update",
+		msgUpdateBody:   "Nextcloud-Kobo {{ .Version }} wurde heruntergeladen. Möchtest du es jetzt installieren?",
+		msgUpdateAccept: "Jetzt",
+		msgUpdateReject: "Beim nächsten Start",
+
+		msgUpdateFailed:     "Update auf {{ .Version }} fehlgeschlagen: {{ .Error }}",
+		msgUpdateRestarting: "Nextcloud-Kobo {{ .Version }} heruntergeladen, Neustart zum Installieren des Updates",
+		msgUpdateNextBoot:   "Nextcloud-Kobo {{ .Version }} wird beim nächsten Start installiert",
+		msgUpdateApplying:   "Neustart zum Installieren von Nextcloud-Kobo {{ .Version }}",
+
+		msgBatterySkip:       "Akku bei {{ .Capacity }}%, Synchronisierung übersprungen",
+		msgBatterySmallFiles: "Akku bei {{ .Capacity }}%, Dateien über {{ .SizeMB }} MB zurückgestellt",
+		msgBatteryLargeFiles: "Dateien über {{ .SizeMB }} MB bis zum Laden zurückgestellt",
+		msgRemainingSkipped:  "Übrige Remotes übersprungen: {{ .Reason }}",
+		msgFilesDeferred:     "{{ .Count }} Dateien nicht heruntergeladen: {{ .Reason }}",
+
+		msgErrorAuth:          "Falscher Benutzername oder falsches Passwort für {{ .Remote }}",
+		msgErrorAuthShare:     "Freigabelink abgelaufen oder Passwort geändert für {{ .Remote }}",
+		msgErrorNotFound:      "Remote-Ordner nicht gefunden für {{ .Remote }}",
+		msgErrorNotFoundShare: "Freigabelink nicht gefunden für {{ .Remote }}",
+		msgErrorNetwork:       "Netzwerkfehler beim Synchronisieren von {{ .Remote }}",
+		msgErrorServer:        "Nextcloud-Serverfehler ({{ .StatusCode }}) für {{ .Remote }}, versuche es später erneut",
+		msgErrorLocal:         "Die Dateien von {{ .Remote }} können nicht geschrieben werden: {{ .Error }}",
+		msgErrorUnknown:       "Synchronisierung von {{ .Remote }} fehlgeschlagen: {{ .Error }}",
+	},
+}
+
+// defaultMessages are the English messages, used when the configuration is not loaded, e.g. in the tests.
+var defaultMessages = mustNewMessages(defaultLanguage, nil)
+
+// msgData is the data the templates of the messages are rendered with.
+type msgData map[string]interface{}
+
+// sampleMessageData is data like the one each message is rendered with. The templates of the configuration are
+// rendered with it when they are loaded, so that a misspelled field fails the validation.
+var sampleMessageData = map[messageID]msgData{
+	msgSyncing:      {"Profile": "home"},
+	msgSyncFailed:   {"Error": "timeout"},
+	msgSyncDisabled: {"Profile": "home"},
+	msgSyncSkipped:  {"Reason": "low battery"},
+	msgDownloaded:   {"File": "a.epub"},
+	msgSummary: {"Run": &SyncRun{}, "Profile": "home", "Downloaded": 1, "Added": 1, "Updated": 0, "Deleted": 0,
+		"Size": "1.0 MB", "Remotes": []summaryRemote{{Remote: "books/", Files: []string{"a.epub"}}},
+		"Failures": []string{"Network error while syncing comics/"}, "Note": "low battery"},
+	msgNotificationTitle: {"Outcome": "completed", "Device": "kobo"},
+
+	msgLargeSyncTitle:  {"Files": 1, "Size": "1.0 MB"},
+	msgLargeSyncBody:   {"Files": 1, "Size": "1.0 MB"},
+	msgLargeSyncAccept: {"Files": 1, "Size": "1.0 MB"},
+	msgLargeSyncReject: {"Files": 1, "Size": "1.0 MB"},
+	msgDeleteTitle:     {"Count": 1, "Files": []string{"a.epub"}, "More": 0},
+	msgDeleteBody:      {"Count": 1, "Files": []string{"a.epub"}, "More": 0},
+	msgDeleteAccept:    {"Count": 1, "Files": []string{"a.epub"}, "More": 0},
+	msgDeleteReject:    {"Count": 1, "Files": []string{"a.epub"}, "More": 0},
+	msgUpdateTitle:     {"Version": "v1.0.0"},
+	msgUpdateBody:      {"Version": "v1.0.0"},
+	msgUpdateAccept:    {"Version": "v1.0.0"},
+	msgUpdateReject:    {"Version": "v1.0.0"},
+
+	msgUpdateFailed:     {"Version": "v1.0.0", "Error": "timeout"},
+	msgUpdateRestarting: {"Version": "v1.0.0"},
+	msgUpdateNextBoot:   {"Version": "v1.0.0"},
+	msgUpdateApplying:   {"Version": "v1.0.0"},
+
+	msgBatterySkip:       {"Capacity": 10},
+	msgBatterySmallFiles: {"Capacity": 10, "SizeMB": 5},
+	msgBatteryLargeFiles: {"SizeMB": 5},
+	msgRemainingSkipped:  {"Reason": "low battery"},
+	msgFilesDeferred:     {"Count": 1, "Reason": "low battery"},
+
+	msgErrorAuth:          {"Remote": "books/", "StatusCode": 401, "Error": "unauthorized"},
+	msgErrorAuthShare:     {"Remote": "books/", "StatusCode": 401, "Error": "unauthorized"},
+	msgErrorNotFound:      {"Remote": "books/", "StatusCode": 404, "Error": "not found"},
+	msgErrorNotFoundShare: {"Remote": "books/", "StatusCode": 404, "Error": "not found"},
+	msgErrorNetwork:       {"Remote": "books/", "StatusCode": 0, "Error": "timeout"},
+	msgErrorServer:        {"Remote": "books/", "StatusCode": 500, "Error": "internal server error"},
+	msgErrorLocal:         {"Remote": "books/", "StatusCode": 0, "Error": "no space left on device"},
+	msgErrorUnknown:       {"Remote": "books/", "StatusCode": 0, "Error": "boom"},
+}
+
+// messages renders the user-facing messages in a language, with the templates of the configuration overriding the
+// ones of the catalogue.
+type messages struct {
+	language  string
+	templates map[messageID]*template.Template
+	// fallback are the messages of the catalogue in the same language, rendered when a template of the
+	// configuration fails
+	fallback *messages
+}
+
+func newMessages(language string, overrides map[string]string) (*messages, error) {
+	if _, ok := catalogue[language]; !ok {
+		return nil, fmt.Errorf("language must be one of %s", strings.Join(supportedLanguages(), ", "))
+	}
+	m := &messages{language: language, templates: map[messageID]*template.Template{}}
+	for id, text := range catalogue[defaultLanguage] {
+		if translated, ok := catalogue[language][id]; ok {
+			text = translated
+		}
+		if override, ok := overrides[string(id)]; ok {
+			text = override
+		}
+		tmpl, err := template.New(string(id)).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid messages template of %s: %w", id, err)
+		}
+		m.templates[id] = tmpl
+	}
+	for id := range overrides {
+		tmpl, ok := m.templates[messageID(id)]
+		if !ok {
+			return nil, fmt.Errorf("unknown message %s in messages", id)
+		}
+		if err := tmpl.Execute(io.Discard, sampleMessageData[messageID(id)]); err != nil {
+			return nil, fmt.Errorf("invalid messages template of %s: %w", id, err)
+		}
+	}
+	if len(overrides) > 0 {
+		fallback, err := newMessages(language, nil)
+		if err != nil {
+			return nil, err
+		}
+		m.fallback = fallback
+	}
+	return m, nil
+}
+
+func mustNewMessages(language string, overrides map[string]string) *messages {
+	m, err := newMessages(language, overrides)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// format renders the message. If a template of the configuration fails, the message of the catalogue in the same
+// language is returned.
+func (m *messages) format(id messageID, data msgData) string {
+	var b strings.Builder
+	if err := m.templates[id].Execute(&b, data); err != nil {
+		slog.Warn("Failed to render the message", "message", id, "error", err)
+		switch {
+		case m.fallback != nil:
+			return m.fallback.format(id, data)
+		case m != defaultMessages:
+			return defaultMessages.format(id, data)
+		}
+		return string(id)
+	}
+	return b.String()
+}
+
+func supportedLanguages() []string {
+	languages := make([]string, 0, len(catalogue))
+	for language := range catalogue {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// text renders a user-facing message in the language of the configuration.
+func (c *Config) text(id messageID, data msgData) string {
+	return c.localizer().format(id, data)
+}
+
+func (c *Config) localizer() *messages {
+	if c == nil || c.messages == nil {
+		return defaultMessages
+	}
+	return c.messages
+}
+
+// setupMessages loads the messages in the configured language or, if not set, in the language of Nickel on the Kobo
+// and of the environment elsewhere. The languages without a translation fall back to English.
+func (c *Config) setupMessages() error {
+	language := c.Language
+	if language == "" {
+		if c.usesNickel() {
+			language = nickelLanguage(koboConfigFile)
+		} else {
+			language = envLanguage(os.Getenv)
+		}
+		if _, ok := catalogue[language]; !ok {
+			language = defaultLanguage
+		}
+	}
+	var err error
+	c.messages, err = newMessages(language, c.Messages)
+	return err
+}
+
+// nickelLanguage returns the language of the Nickel interface, read from the CurrentLocale key of its configuration,
+// or an empty string if it is unknown.
+func nickelLanguage(configFile string) string {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return ""
+	}
+	//nolint:errcheck
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(key) == "CurrentLocale" {
+			return localeLanguage(value)
+		}
+	}
+	return ""
+}
+
+// envLanguage returns the language of the messages of the environment, or an empty string if it is unknown.
+func envLanguage(getenv func(string) string) string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := getenv(name); value != "" {
+			return localeLanguage(value)
+		}
+	}
+	return ""
+}
+
+// localeLanguage returns the language of a locale like it_IT.UTF-8 or de-DE.
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(strings.TrimSpace(locale), ".")
+	language, _, _ = strings.Cut(language, "_")
+	language, _, _ = strings.Cut(language, "-")
+	language = strings.ToLower(language)
+	if language == "c" || language == "posix" {
+		return ""
+	}
+	return language
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessages(t *testing.T) {
+	run := &SyncRun{Outcome: RunFailed, Note: "battery low", Remotes: []*RemoteResult{
+		{Remote: "books/", Added: []string{"books/a.epub"}, Updated: []string{"books/b.epub"}},
+		{Remote: "comics/", Outcome: RemoteFailed, Error: &RemoteError{Remote: "comics/", Kind: RemoteErrorNetwork}},
+	}}
+	assert.Equal(t, "Synced 2 files:\nRemote: books/\n  - books/a.epub\n  - books/b.epub\n"+
+		"Network error while syncing comics/\nbattery low", run.Summary())
+
+	m, err := newMessages("it", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Sincronizzati 2 file:\nRemoto: books/\n  - books/a.epub\n  - books/b.epub\n"+
+		"Errore di rete durante la sincronizzazione di comics/\nbattery low", run.summary(m))
+	assert.Equal(t, "Sincronizzazione Nextcloud non riuscita su kobo",
+		m.format(msgNotificationTitle, msgData{"Outcome": string(RunFailed), "Device": "kobo"}))
+	assert.Equal(t, "Sincronizzazione con Nextcloud (profilo: home)...",
+		m.format(msgSyncing, msgData{"Profile": "home"}))
+
+	m, err = newMessages("de", map[string]string{
+		"summary":    "{{ .Added }} new, {{ .Updated }} updated ({{ .Size }}){{ range .Failures }}; {{ . }}{{ end }}",
+		"downloaded": "⬇ {{ slice .File 2 }}",
+	})
+	require.NoError(t, err)
+	run.Remotes[0].Bytes = 2048
+	assert.Equal(t, "1 new, 1 updated (2.0 KB); Netzwerkfehler beim Synchronisieren von comics/", run.summary(m))
+	// the overrides failing to render fall back to the messages of the language
+	assert.Equal(t, "⬇ epub", m.format(msgDownloaded, msgData{"File": "a.epub"}))
+	assert.Equal(t, "b heruntergeladen", m.format(msgDownloaded, msgData{"File": "b"}))
+	assert.Equal(t, "Nextcloud-Kobo-Update", m.format(msgUpdateTitle, nil))
+}
+
+func TestNewMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		language  string
+		overrides map[string]string
+		errMsg    string
+	}{
+		{name: "english", language: "en"},
+		{name: "override", language: "it", overrides: map[string]string{"downloaded": "⬇ {{ .File }}"}},
+		{name: "unknown language", language: "fr", errMsg: "language must be one of de, en, it"},
+		{name: "unknown message", language: "en", overrides: map[string]string{"synced": "Done"},
+			errMsg: "unknown message synced"},
+		{name: "invalid template", language: "en", overrides: map[string]string{"summary": "{{ .Downloaded "},
+			errMsg: "invalid messages template of summary"},
+		{name: "misspelled field", language: "it", overrides: map[string]string{"downloaded": "⬇ {{ .Flie }}"},
+			errMsg: "invalid messages template of downloaded"},
+		{name: "field of another message", language: "en", overrides: map[string]string{"sync_cancelled": "{{ .Reason }}"},
+			errMsg: "invalid messages template of sync_cancelled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newMessages(tt.language, tt.overrides)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	// every translation renders with the sample data of the message, that the overrides are validated with
+	for language, messages := range catalogue {
+		m, err := newMessages(language, nil)
+		require.NoError(t, err)
+		for id := range messages {
+			_, ok := catalogue[defaultLanguage][id]
+			assert.True(t, ok, "%s: %s", language, id)
+			assert.NoError(t, m.templates[id].Execute(io.Discard, sampleMessageData[id]), "%s: %s", language, id)
+		}
+	}
+}
+
+func TestLanguageDetection(t *testing.T) {
+	koboConfig := filepath.Join(t.TempDir(), "Kobo eReader.conf")
+	writeTestFile(t, koboConfig, "[ApplicationPreferences]\nCurrentLocale=it_IT\n")
+	assert.Equal(t, "it", nickelLanguage(koboConfig))
+	assert.Empty(t, nickelLanguage(filepath.Join(t.TempDir(), "missing.conf")))
+
+	env := map[string]string{"LANG": "de_DE.UTF-8"}
+	assert.Equal(t, "de", envLanguage(func(name string) string { return env[name] }))
+	env["LC_MESSAGES"] = "C"
+	assert.Empty(t, envLanguage(func(name string) string { return env[name] }))
+
+	original := koboConfigFile
+	koboConfigFile = koboConfig
+	t.Cleanup(func() { koboConfigFile = original })
+	config := &Config{}
+	require.NoError(t, config.setupMessages())
+	assert.Equal(t, "Sincronizzazione annullata", config.text(msgSyncCancelled, nil))
+	config = &Config{Language: "en"}
+	require.NoError(t, config.setupMessages())
+	assert.Equal(t, "Sync cancelled", config.text(msgSyncCancelled, nil))
+	writeTestFile(t, koboConfig, "[ApplicationPreferences]\nCurrentLocale=ja_JP\n")
+	config = &Config{}
+	require.NoError(t, config.setupMessages())
+	assert.Equal(t, "Sync cancelled", config.text(msgSyncCancelled, nil))
+}
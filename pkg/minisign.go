@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignPublicKey is a minisign (https://jedisct1.github.io/minisign/) Ed25519 public key.
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// parseMinisignPublicKey parses a public key as the base64 line of a minisign .pub file. The untrusted comment line
+// can be included, and it is ignored.
+func parseMinisignPublicKey(encoded string) (*minisignPublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(encoded), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid public key: unsupported format")
+	}
+	pk := &minisignPublicKey{key: ed25519.PublicKey(raw[10:])}
+	copy(pk.keyID[:], raw[2:10])
+	return pk, nil
+}
+
+// Verify checks a minisign signature of message. Both the legacy (Ed) and the pre-hashed (ED) signatures are
+// supported, and the trusted comment is verified as well.
+func (pk *minisignPublicKey) Verify(message, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 {
+		return fmt.Errorf("invalid signature: unexpected number of lines")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature: malformed signature line")
+	}
+	if !bytes.Equal(sig[2:10], pk.keyID[:]) {
+		return fmt.Errorf("invalid signature: signed with key %X, expected key %X", sig[2:10], pk.keyID)
+	}
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		digest := blake2b.Sum512(message)
+		message = digest[:]
+	default:
+		return fmt.Errorf("invalid signature: unsupported algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pk.key, message, sig[10:]) {
+		return fmt.Errorf("signature verification failed")
+	}
+	trustedComment, found := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !found {
+		return fmt.Errorf("invalid signature: missing trusted comment")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature: malformed global signature")
+	}
+	if !ed25519.Verify(pk.key, append(sig[10:], trustedComment...), globalSig) {
+		return fmt.Errorf("trusted comment verification failed")
+	}
+	return nil
+}
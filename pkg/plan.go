@@ -0,0 +1,216 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+type plannedDownload struct {
+	RemotePath string
+	LocalPath  string
+	Size       int64
+	// New is set if the file does not exist locally
+	New bool
+}
+
+// remotePlan lists the changes that a sync would apply to the local copy of a remote. It is computed without touching
+// the local filesystem, so that the user can be asked for confirmation before anything is downloaded or deleted.
+type remotePlan struct {
+	remote *Remote
+	client *gowebdav.Client
+	// retry retries the listings and the downloads that fail for a transient reason
+	retry      backoff
+	retryAfter *retryAfterTransport
+	// bandwidthLimit is the download speed limit in bytes per second set by the profile, 0 means no limit
+	bandwidthLimit int64
+	// keep is a local file never deleted, even if it is not on the remote: the sync report
+	keep string
+	// Dirs are the local directories mirroring the remote ones
+	Dirs      []string
+	Downloads []plannedDownload
+	// Deletions are the local files and directories that no longer exist on the remote
+	Deletions []string
+	// DeletedFiles counts the regular files removed by Deletions, including the ones in the deleted directories
+	DeletedFiles int
+}
+
+type syncPlan struct {
+	Remotes []*remotePlan
+	// Failed are the results of the remotes that could not be planned
+	Failed []*RemoteResult
+	// SkipDeletions is set when the user chose to keep the remotely deleted files
+	SkipDeletions bool
+}
+
+// planSync lists the changes to apply for every remote enabled by the profile. The remotes that cannot be planned are
+// reported in the Failed results of the plan, and the other remotes are planned anyway. It only returns an error if
+// the context is done, along with the plan computed so far.
+func (n *NetworkConnectionReconciler) planSync(ctx context.Context, profile *Profile) (*syncPlan, error) {
+	plan := &syncPlan{}
+	for _, r := range profile.selectRemotes(n.config.Remotes) {
+		if err := ctx.Err(); err != nil {
+			loggerFrom(ctx).Info("The context has been canceled, interrupting")
+			return plan, err
+		}
+		client := gowebdav.NewClient(r.remoteURL.String(), r.Username, r.Password)
+		retryAfter := &retryAfterTransport{next: r.transport}
+		client.SetTransport(retryAfter)
+		// 10 Mb/s * 4 min * 60 s/min * 1/8 B/b = 300 MB per file/book max with a 10 Mbps connection(?)
+		client.SetTimeout(time.Minute * 4)
+		logger := loggerFrom(ctx).With("remote", r.String())
+		rp := &remotePlan{remote: r, client: client, retry: n.config.Retry.backoff(), retryAfter: retryAfter,
+			bandwidthLimit: profile.bandwidthLimit(), keep: n.config.reportPath()}
+		if err := planFolder(withLogger(ctx, logger), rp, r.RemoteFolder, r.LocalPath); err != nil {
+			if ctx.Err() != nil {
+				return plan, ctx.Err()
+			}
+			logger.Error("Failed to plan the sync of the remote", "error", err)
+			plan.Failed = append(plan.Failed, newRemoteResult(r, err))
+			continue
+		}
+		logger.Info("Planned the sync of the remote", "downloads", len(rp.Downloads), "deletions", len(rp.Deletions))
+		plan.Remotes = append(plan.Remotes, rp)
+	}
+	return plan, nil
+}
+
+func planFolder(ctx context.Context, plan *remotePlan, remotePath, localPath string) error {
+	var remoteFiles []os.FileInfo
+	err := plan.retry.do(ctx, "Listing "+remotePath, plan.retryAfter, func() (err error) {
+		remoteFiles, err = plan.client.ReadDir(remotePath)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	plan.Dirs = append(plan.Dirs, localPath)
+	localFileMap := make(map[string]string)
+	for _, file := range remoteFiles {
+		if ctx.Err() != nil {
+			loggerFrom(ctx).Info("The context has been canceled, interrupting")
+			return ctx.Err()
+		}
+		remoteFilePath := path.Join(remotePath, file.Name())
+		localFilePath := path.Join(localPath, file.Name())
+		loggerFrom(ctx).Debug("Checking file", "remote_path", remoteFilePath, "local_path", localFilePath)
+		localFileMap[localFilePath] = localFilePath
+		if file.IsDir() {
+			if err = planFolder(ctx, plan, remoteFilePath, localFilePath); err != nil {
+				return err
+			}
+		} else if shouldDownloadFile(localFilePath, file.ModTime(), file.Size()) {
+			_, statErr := os.Stat(localFilePath)
+			plan.Downloads = append(plan.Downloads, plannedDownload{
+				RemotePath: remoteFilePath,
+				LocalPath:  localFilePath,
+				Size:       file.Size(),
+				New:        os.IsNotExist(statErr),
+			})
+		} else {
+			loggerFrom(ctx).Debug("Skipping file", "remote_path", remoteFilePath)
+		}
+	}
+	for _, deletion := range listRemotelyDeletedFiles(localFileMap, localPath) {
+		if plan.keep != "" && (deletion == plan.keep || strings.HasPrefix(plan.keep, deletion+"/")) {
+			loggerFrom(ctx).Debug("Keeping the sync report", "path", deletion)
+			continue
+		}
+		plan.Deletions = append(plan.Deletions, deletion)
+		plan.DeletedFiles += countFiles(deletion)
+	}
+	return nil
+}
+
+// applyRemotePlan creates the directories, downloads the files allowed by the battery policy and removes the remotely
+// deleted files, unless skipDeletions is set. The result lists the changes applied, even if an error interrupts it.
+func (n *NetworkConnectionReconciler) applyRemotePlan(ctx context.Context, plan *remotePlan, power *powerDecision,
+	skipDeletions bool) (result *RemoteResult, err error) {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("remote", plan.remote.String()))
+	logger := loggerFrom(ctx)
+	result = newRemoteResult(plan.remote, nil)
+	for _, dir := range plan.Dirs {
+		if err = ensureDirExists(dir); err != nil {
+			return
+		}
+	}
+	for _, download := range plan.Downloads {
+		if ctx.Err() != nil {
+			logger.Info("The context has been canceled, interrupting")
+			err = ctx.Err()
+			return
+		}
+		if !power.allows(download.Size) {
+			logger.Info("Deferring file because of the battery policy", "remote_path", download.RemotePath)
+			power.Deferred++
+			continue
+		}
+		err = plan.retry.do(ctx, "Downloading "+download.RemotePath, plan.retryAfter, func() error {
+			return downloadFile(ctx, plan.client, download.RemotePath, download.LocalPath, plan.bandwidthLimit)
+		})
+		if err != nil {
+			return
+		}
+		if download.New {
+			result.Added = append(result.Added, download.LocalPath)
+		} else {
+			result.Updated = append(result.Updated, download.LocalPath)
+		}
+		result.Bytes += download.Size
+		n.toast(ctx, n.config.text(msgDownloaded, msgData{"File": download.RemotePath}))
+	}
+	if skipDeletions {
+		if len(plan.Deletions) > 0 {
+			logger.Info("Keeping the remotely deleted files", "deletions", len(plan.Deletions))
+		}
+		return
+	}
+	if err = removeLocalFiles(plan.Deletions); err == nil {
+		result.Deleted = plan.Deletions
+	}
+	return
+}
+
+// downloadSize returns the number of files and bytes that would be downloaded with the given battery policy decision.
+func (p *syncPlan) downloadSize(power powerDecision) (files int, size int64) {
+	for _, rp := range p.Remotes {
+		for _, download := range rp.Downloads {
+			if power.allows(download.Size) {
+				files++
+				size += download.Size
+			}
+		}
+	}
+	return
+}
+
+func (p *syncPlan) deletedFiles() (files int) {
+	for _, rp := range p.Remotes {
+		files += rp.DeletedFiles
+	}
+	return
+}
+
+func (p *syncPlan) deletions() (deletions []string) {
+	for _, rp := range p.Remotes {
+		deletions = append(deletions, rp.Deletions...)
+	}
+	return
+}
+
+// countFiles returns the number of regular files in the given path, recursively.
+func countFiles(localPath string) (files int) {
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		// not a directory
+		return 1
+	}
+	for _, entry := range entries {
+		files += countFiles(path.Join(localPath, entry.Name()))
+	}
+	return
+}
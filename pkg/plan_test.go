@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVServer serves the given files over WebDAV at the path used by the Nextcloud public shares.
+func newWebDAVServer(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newWebDAVHandler(t, files))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newWebDAVHandler(t *testing.T, files map[string]string) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/public.php/webdav/", &webdav.Handler{
+		Prefix:     "/public.php/webdav",
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	})
+	return mux
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	require.NoError(t, os.WriteFile(name, []byte(content), 0644))
+}
+
+// newTestReconciler returns a reconciler syncing the given WebDAV server to a temporary directory. The bus is never
+// connected, so the Nickel calls fail fast.
+func newTestReconciler(t *testing.T, servers ...*httptest.Server) *NetworkConnectionReconciler {
+	t.Helper()
+	config := &Config{basePath: t.TempDir(), configPath: t.TempDir(), PowerSupplyPath: t.TempDir(),
+		HistorySize: defaultHistorySize}
+	config.Confirm.setDefaults()
+	for i, srv := range servers {
+		r := Remote{URL: srv.URL + "/s/token", LocalPath: "share" + string(rune('1'+i))}
+		require.NoError(t, r.validateAndSetup(config.basePath))
+		config.Remotes = append(config.Remotes, r)
+	}
+	n := &NetworkConnectionReconciler{
+		bus:           newBusSupervisor(nil, nickelDBusName),
+		config:        config,
+		toastsChan:    make(chan string, 100),
+		dialogResults: make(chan int32, 1),
+		ssid:          fakeSSIDProvider(""),
+		now:           time.Now,
+	}
+	n.state = newSyncStateMachine(n.runSync)
+	return n
+}
+
+func TestPlanAndApply(t *testing.T) {
+	srv := newWebDAVServer(t, map[string]string{
+		"book1.epub":       "book1",
+		"saga/book2.epub":  "book2",
+		"saga/book3.kepub": "book3",
+	})
+	n := newTestReconciler(t, srv)
+	localPath := n.config.Remotes[0].LocalPath
+	writeTestFile(t, filepath.Join(localPath, "saga", "book3.kepub"), "book3")
+	writeTestFile(t, filepath.Join(localPath, "deleted.epub"), "deleted")
+	writeTestFile(t, filepath.Join(localPath, "old-saga", "book4.epub"), "book4")
+	writeTestFile(t, filepath.Join(localPath, "old-saga", "book5.epub"), "book5")
+
+	plan, err := n.planSync(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, plan.Remotes, 1)
+	rp := plan.Remotes[0]
+	assert.ElementsMatch(t, []string{
+		filepath.Join(localPath, "book1.epub"),
+		filepath.Join(localPath, "saga", "book2.epub"),
+	}, []string{rp.Downloads[0].LocalPath, rp.Downloads[1].LocalPath})
+	assert.ElementsMatch(t, []string{
+		filepath.Join(localPath, "deleted.epub"),
+		filepath.Join(localPath, "old-saga"),
+	}, rp.Deletions)
+	assert.Equal(t, 3, rp.DeletedFiles)
+	files, size := plan.downloadSize(powerDecision{})
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(10), size)
+
+	// planning does not touch the local files
+	assert.NoFileExists(t, filepath.Join(localPath, "book1.epub"))
+	assert.FileExists(t, filepath.Join(localPath, "deleted.epub"))
+
+	result, err := n.applyRemotePlan(context.Background(), rp, &powerDecision{}, true)
+	require.NoError(t, err)
+	assert.Len(t, result.Added, 2)
+	assert.Empty(t, result.Deleted)
+	assert.FileExists(t, filepath.Join(localPath, "saga", "book2.epub"))
+	assert.FileExists(t, filepath.Join(localPath, "deleted.epub"))
+
+	result, err = n.applyRemotePlan(context.Background(), rp, &powerDecision{}, false)
+	require.NoError(t, err)
+	assert.Len(t, result.Deleted, 2)
+	assert.NoFileExists(t, filepath.Join(localPath, "deleted.epub"))
+	assert.NoDirExists(t, filepath.Join(localPath, "old-saga"))
+}
+
+func TestConfirmPlan_SafeChoiceWithoutAnswer(t *testing.T) {
+	n := newTestReconciler(t)
+	plan := &syncPlan{Remotes: []*remotePlan{{
+		Downloads:    []plannedDownload{{Size: 20 << 20}},
+		Deletions:    []string{"a", "b"},
+		DeletedFiles: 2,
+	}}}
+
+	// below the thresholds, no dialog is needed
+	n.config.Confirm = ConfirmPolicy{DeletionsAbove: 5, DownloadsAboveMB: 50, TimeoutSeconds: 1}
+	assert.Equal(t, confirmProceed, n.confirmPlan(context.Background(), plan, powerDecision{}))
+
+	// the dialog cannot be shown: the deletions are skipped
+	n.config.Confirm.DeletionsAbove = 1
+	assert.Equal(t, confirmSkipDeletions, n.confirmPlan(context.Background(), plan, powerDecision{}))
+
+	// ...and the large downloads are cancelled
+	n.config.Confirm.DownloadsAboveMB = 10
+	assert.Equal(t, confirmAbort, n.confirmPlan(context.Background(), plan, powerDecision{}))
+
+	// the files deferred by the battery policy do not count
+	assert.Equal(t, confirmSkipDeletions, n.confirmPlan(context.Background(), plan, powerDecision{MaxFileSize: 1 << 20}))
+}
+
+func TestSync_disabledProfile(t *testing.T) {
+	var probes int
+	probeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(probeSrv.Close)
+	n := newTestReconciler(t, newWebDAVServer(t, map[string]string{"book1.epub": "book1"}))
+	n.config.ConnectivityProbe = ConnectivityProbe{Mode: probeModeGenerate204, URL: probeSrv.URL}
+	n.config.ConnectivityProbe.setDefaults()
+	run := &SyncRun{}
+	n.sync(context.Background(), &Profile{Name: "quiet hours", Disabled: true}, run)
+	assert.Equal(t, RunSkipped, run.Outcome)
+	assert.Equal(t, "disabled by profile quiet hours", run.Reason)
+	assert.Zero(t, probes)
+	assert.Equal(t, "Sync disabled by profile quiet hours", <-n.toastsChan)
+}
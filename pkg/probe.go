@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// probeModeStatus fetches the status.php of the remotes
+	probeModeStatus = "status"
+	// probeModeGenerate204 fetches a URL that answers with 204 No Content
+	probeModeGenerate204 = "generate_204"
+	// probeModeNone does not check the connectivity
+	probeModeNone = "none"
+
+	defaultProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+	// maxProbeBodySize limits the size of the probe responses
+	maxProbeBodySize = 64 << 10
+)
+
+var errCaptivePortal = fmt.Errorf("captive portal detected")
+
+// ConnectivityProbe defines how the daemon checks that the network is usable before syncing.
+type ConnectivityProbe struct {
+	// Mode is status (the default) to fetch the status.php of the remotes, generate_204 to fetch URL, or none.
+	Mode string `yaml:"mode,omitempty"`
+	// URL is the URL fetched in the generate_204 mode. It must answer with 204 No Content.
+	URL string `yaml:"url,omitempty"`
+	// Attempts is the number of probes before giving up. Defaults to 10.
+	Attempts int `yaml:"attempts,omitempty"`
+	// IntervalSeconds is the time between two probes. Defaults to 1 second.
+	IntervalSeconds int `yaml:"interval_seconds,omitempty"`
+	// TimeoutSeconds is the timeout of a single probe. Defaults to 5 seconds.
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"`
+}
+
+// probeTarget is a URL to probe and the check of its response.
+type probeTarget struct {
+	url    string
+	client *http.Client
+	// check returns errCaptivePortal if the response does not come from the expected server
+	check func(resp *http.Response) error
+}
+
+func (p *ConnectivityProbe) setDefaults() {
+	if p.Mode == "" {
+		p.Mode = probeModeStatus
+	}
+	if p.Mode == probeModeGenerate204 && p.URL == "" {
+		p.URL = defaultProbeURL
+	}
+	if p.Attempts == 0 {
+		p.Attempts = 10
+	}
+	if p.IntervalSeconds == 0 {
+		p.IntervalSeconds = 1
+	}
+	if p.TimeoutSeconds == 0 {
+		p.TimeoutSeconds = 5
+	}
+}
+
+func (p *ConnectivityProbe) validate() error {
+	switch p.Mode {
+	case probeModeStatus, probeModeNone:
+	case probeModeGenerate204:
+		if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid connectivity_probe url %q", p.URL)
+		}
+	default:
+		return fmt.Errorf("connectivity_probe mode must be one of %s, %s or %s", probeModeStatus, probeModeGenerate204,
+			probeModeNone)
+	}
+	if p.Attempts < 0 || p.IntervalSeconds < 0 || p.TimeoutSeconds < 0 {
+		return fmt.Errorf("connectivity_probe values must not be negative")
+	}
+	return nil
+}
+
+// targets returns the URLs to probe for the given remotes.
+func (p *ConnectivityProbe) targets(remotes []*Remote) []probeTarget {
+	switch p.Mode {
+	case probeModeGenerate204:
+		return []probeTarget{{url: p.URL, client: p.client(http.DefaultTransport, true), check: checkGenerate204}}
+	case probeModeStatus:
+		targets := make([]probeTarget, 0, len(remotes))
+		for _, remote := range remotes {
+			targets = append(targets, probeTarget{url: remote.statusURL.String(),
+				client: p.client(remote.transport, false), check: checkStatusPHP})
+		}
+		return targets
+	}
+	return nil
+}
+
+// client returns the client of the probes. With sameHost, the redirects to other hosts are not followed: captive
+// portals redirect to their own login page. Otherwise the redirects are followed, e.g. to the canonical host of a
+// Nextcloud server, and the check of the final response detects the portals.
+func (p *ConnectivityProbe) client(transport http.RoundTripper, sameHost bool) *http.Client {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(p.TimeoutSeconds) * time.Second,
+	}
+	if sameHost {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}
+	}
+	return client
+}
+
+// checkNetwork probes the targets until one of them answers as expected, a captive portal is detected or the
+// attempts are exhausted.
+func (p *ConnectivityProbe) checkNetwork(ctx context.Context, targets []probeTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	interval := time.Duration(p.IntervalSeconds) * time.Second
+	for i := 0; i < p.Attempts; i++ {
+		for _, target := range targets {
+			err := target.probe(ctx)
+			if err == nil {
+				loggerFrom(ctx).Info("Connectivity probe successful", "url", target.url, "attempt", i+1,
+					"attempts", p.Attempts)
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			loggerFrom(ctx).Warn("Connectivity probe failed", "url", target.url, "attempt", i+1, "attempts", p.Attempts,
+				"error", err)
+			if errors.Is(err, errCaptivePortal) {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return networkConnectionFailedErr
+}
+
+func (t *probeTarget) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNetworkAuthenticationRequired ||
+		(resp.StatusCode >= 300 && resp.StatusCode < 400) {
+		return errCaptivePortal
+	}
+	return t.check(resp)
+}
+
+func checkGenerate204(resp *http.Response) error {
+	if resp.StatusCode != http.StatusNoContent {
+		return errCaptivePortal
+	}
+	return nil
+}
+
+// checkStatusPHP expects the JSON status of a Nextcloud server. Any other successful response comes from something
+// standing between the device and the server.
+func checkStatusPHP(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// the network works, the server will report its own errors during the sync
+		slog.Warn("Unexpected status from status.php", "status", resp.Status)
+		return nil
+	}
+	var status struct {
+		Installed *bool `json:"installed"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProbeBodySize)).Decode(&status); err != nil ||
+		status.Installed == nil {
+		return errCaptivePortal
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectivityProbe(t *testing.T) {
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		w.Write([]byte("<html>Accept the terms of use</html>"))
+	}))
+	t.Cleanup(portal.Close)
+	nextcloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		w.Write([]byte(`{"installed":true}`))
+	}))
+	t.Cleanup(nextcloud.Close)
+
+	tests := []struct {
+		name    string
+		mode    string
+		handler func(failures *atomic.Int32) http.HandlerFunc
+		err     error
+	}{
+		{
+			name: "nextcloud status",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, "/status.php", r.URL.Path)
+					//nolint:errcheck
+					w.Write([]byte(`{"installed":true,"maintenance":false,"productname":"Nextcloud"}`))
+				}
+			},
+		},
+		{
+			name: "network up after a while",
+			mode: probeModeStatus,
+			handler: func(failures *atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if failures.Add(1) < 3 {
+						// simulate a connection failure
+						panic(http.ErrAbortHandler)
+					}
+					//nolint:errcheck
+					w.Write([]byte(`{"installed":true}`))
+				}
+			},
+		},
+		{
+			name: "server error",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			},
+		},
+		{
+			name: "portal page instead of the status",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					//nolint:errcheck
+					w.Write([]byte("<html>Log in</html>"))
+				}
+			},
+			err: errCaptivePortal,
+		},
+		{
+			name: "redirect to the portal",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, portal.URL+"/login", http.StatusFound)
+				}
+			},
+			err: errCaptivePortal,
+		},
+		{
+			name: "redirect to the canonical host",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, nextcloud.URL+"/status.php", http.StatusMovedPermanently)
+				}
+			},
+		},
+		{
+			name: "generate_204 redirected to the portal",
+			mode: probeModeGenerate204,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, portal.URL+"/login", http.StatusFound)
+				}
+			},
+			err: errCaptivePortal,
+		},
+		{
+			name: "network authentication required",
+			mode: probeModeGenerate204,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNetworkAuthenticationRequired)
+				}
+			},
+			err: errCaptivePortal,
+		},
+		{
+			name: "generate_204",
+			mode: probeModeGenerate204,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNoContent)
+				}
+			},
+		},
+		{
+			name: "generate_204 intercepted",
+			mode: probeModeGenerate204,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					//nolint:errcheck
+					w.Write([]byte("<html>Log in</html>"))
+				}
+			},
+			err: errCaptivePortal,
+		},
+		{
+			name: "no network",
+			mode: probeModeStatus,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					panic(http.ErrAbortHandler)
+				}
+			},
+			err: networkConnectionFailedErr,
+		},
+		{
+			name: "disabled",
+			mode: probeModeNone,
+			handler: func(*atomic.Int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					t.Error("unexpected probe")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := &atomic.Int32{}
+			srv := httptest.NewServer(tt.handler(failures))
+			t.Cleanup(srv.Close)
+			probe := &ConnectivityProbe{Mode: tt.mode, URL: srv.URL + "/generate_204", Attempts: 3}
+			probe.setDefaults()
+			require.NoError(t, probe.validate())
+			probe.IntervalSeconds = 0
+			remote := &Remote{URL: srv.URL + "/s/token", LocalPath: "books"}
+			require.NoError(t, remote.validateAndSetup(t.TempDir()))
+
+			err := probe.checkNetwork(context.Background(), probe.targets([]*Remote{remote}))
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestConnectivityProbe_cancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(srv.Close)
+	probe := &ConnectivityProbe{Mode: probeModeGenerate204, URL: srv.URL, IntervalSeconds: 3600}
+	probe.setDefaults()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err := probe.checkNetwork(ctx, probe.targets(nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
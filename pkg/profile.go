@@ -0,0 +1,274 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultWPASupplicantSocket = "/var/run/wpa_supplicant/eth0"
+
+// Profile customizes the sync depending on the Wi-Fi network the device is connected to and on the time of the day.
+// The first profile matching both the SSID and the time windows is used; if no profile matches, all the remotes are
+// synced without limits.
+type Profile struct {
+	Name string `yaml:"name"`
+	// SSIDs is the list of networks the profile applies to. If empty, the profile applies to any network.
+	SSIDs []string `yaml:"ssids,omitempty"`
+	// Hours is a list of time windows in the HH:MM-HH:MM format the profile applies to. A window can span midnight,
+	// e.g. 22:00-07:00. If empty, the profile applies at any time.
+	Hours []string `yaml:"hours,omitempty"`
+	// Remotes is the list of the local paths of the remotes to sync, as they are written in the remotes section.
+	// If empty, all the remotes are synced.
+	Remotes []string `yaml:"remotes,omitempty"`
+	// BandwidthLimitKBps limits the download speed of each file, in KiB/s. 0 means no limit.
+	BandwidthLimitKBps int64 `yaml:"bandwidth_limit_kbps,omitempty"`
+	// Disabled disables the sync entirely.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	windows []timeWindow
+}
+
+// timeWindow is a time window expressed in minutes since midnight. If start > end, the window spans midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// ssidProvider returns the SSID of the Wi-Fi network the device is connected to.
+type ssidProvider interface {
+	SSID(ctx context.Context) (string, error)
+}
+
+// wpaSupplicantSSIDProvider queries the wpa_supplicant control socket for the SSID of the current network.
+type wpaSupplicantSSIDProvider struct {
+	socket string
+}
+
+func (p *Profile) validateAndSetup(remotes []Remote) error {
+	if p.Name == "" {
+		return fmt.Errorf("profile name is required")
+	}
+	if p.BandwidthLimitKBps < 0 {
+		return fmt.Errorf("profile %s: bandwidth limit must not be negative", p.Name)
+	}
+	p.windows = nil
+	for _, hours := range p.Hours {
+		window, err := parseTimeWindow(hours)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		p.windows = append(p.windows, window)
+	}
+	for _, localPath := range p.Remotes {
+		if !p.hasRemote(remotes, localPath) {
+			return fmt.Errorf("profile %s: unknown remote %s", p.Name, localPath)
+		}
+	}
+	return nil
+}
+
+func (p *Profile) hasRemote(remotes []Remote, localPath string) bool {
+	for i := range remotes {
+		if remotes[i].is(localPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the profile applies to the given SSID at the given time.
+func (p *Profile) matches(ssid string, now time.Time) bool {
+	if len(p.SSIDs) > 0 {
+		found := false
+		for _, s := range p.SSIDs {
+			found = found || s == ssid
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.windows) == 0 {
+		return true
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	for _, w := range p.windows {
+		if w.contains(minutes) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectRemotes returns the remotes enabled by the profile. A nil profile enables all of them.
+func (p *Profile) selectRemotes(remotes []Remote) (selected []*Remote) {
+	for i := range remotes {
+		if p == nil || len(p.Remotes) == 0 {
+			selected = append(selected, &remotes[i])
+			continue
+		}
+		for _, localPath := range p.Remotes {
+			if remotes[i].is(localPath) {
+				selected = append(selected, &remotes[i])
+				break
+			}
+		}
+	}
+	return
+}
+
+// bandwidthLimit returns the bandwidth limit in bytes per second. A nil profile has no limit.
+func (p *Profile) bandwidthLimit() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.BandwidthLimitKBps << 10
+}
+
+func (p *Profile) String() string {
+	if p == nil {
+		return "default"
+	}
+	return p.Name
+}
+
+func parseTimeWindow(window string) (timeWindow, error) {
+	from, to, found := strings.Cut(window, "-")
+	if !found {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: expected HH:MM-HH:MM", window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %w", window, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %w", window, err)
+	}
+	return timeWindow{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+func (w timeWindow) contains(minutes int) bool {
+	if w.start <= w.end {
+		return minutes >= w.start && minutes < w.end
+	}
+	return minutes >= w.start || minutes < w.end
+}
+
+// is returns true if the remote is the one configured with the given local path.
+func (r *Remote) is(localPath string) bool {
+	return path.Clean(r.configuredLocalPath) == path.Clean(localPath)
+}
+
+// SSID sends the STATUS command to wpa_supplicant and parses the ssid field of the reply.
+func (w *wpaSupplicantSSIDProvider) SSID(ctx context.Context) (string, error) {
+	// wpa_supplicant replies to the address of the client socket, so it has to be bound to a local path
+	localPath := filepath.Join(os.TempDir(), fmt.Sprintf("nextcloud-kobo-wpa-%d", os.Getpid()))
+	//nolint:errcheck
+	os.Remove(localPath)
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: localPath, Net: "unixgram"},
+		&net.UnixAddr{Name: w.socket, Net: "unixgram"})
+	if err != nil {
+		return "", fmt.Errorf("error connecting to wpa_supplicant: %w", err)
+	}
+	defer func() {
+		//nolint:errcheck
+		conn.Close()
+		//nolint:errcheck
+		os.Remove(localPath)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	if _, err = conn.Write([]byte("STATUS")); err != nil {
+		return "", fmt.Errorf("error querying wpa_supplicant: %w", err)
+	}
+	buf := make([]byte, 4096)
+	nRead, err := conn.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("error reading the wpa_supplicant status: %w", err)
+	}
+	for _, line := range strings.Split(string(buf[:nRead]), "\n") {
+		if ssid, found := strings.CutPrefix(line, "ssid="); found {
+			return decodeWPAString(ssid), nil
+		}
+	}
+	return "", fmt.Errorf("not connected to a Wi-Fi network")
+}
+
+// decodeWPAString decodes the printf-style escaping wpa_supplicant applies to the SSIDs in its status: \\, \", \n, \r,
+// \t, \e and \xNN for the other non-printable bytes, e.g. in the UTF-8 names.
+func decodeWPAString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'e':
+			b.WriteByte('\033')
+		case 'x':
+			end := i + 1
+			for end < len(s) && end < i+3 && strings.ContainsRune("0123456789abcdefABCDEF", rune(s[end])) {
+				end++
+			}
+			if end == i+1 {
+				b.WriteByte(s[i])
+				continue
+			}
+			value, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+			b.WriteByte(byte(value))
+			i = end - 1
+		default:
+			// \\, \" and the unknown escapes
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// selectProfile returns the profile chosen on the command line, if any, or the first profile matching the current
+// network and time, or nil if none matches.
+func (n *NetworkConnectionReconciler) selectProfile(ctx context.Context) *Profile {
+	if n.profile != nil {
+		loggerFrom(ctx).Info("Using profile", "profile", n.profile.Name)
+		return n.profile
+	}
+	if len(n.config.Profiles) == 0 {
+		return nil
+	}
+	ssid, err := n.ssid.SSID(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("Failed to get the SSID of the current network", "error", err)
+	}
+	now := n.now()
+	for i := range n.config.Profiles {
+		if n.config.Profiles[i].matches(ssid, now) {
+			loggerFrom(ctx).Info("Using profile", "profile", n.config.Profiles[i].Name, "ssid", ssid)
+			return &n.config.Profiles[i]
+		}
+	}
+	loggerFrom(ctx).Info("No profile matches the current network, using the default one", "ssid", ssid)
+	return nil
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSSIDProvider string
+
+func (f fakeSSIDProvider) SSID(context.Context) (string, error) {
+	return string(f), nil
+}
+
+func TestSelectProfile(t *testing.T) {
+	n := newTestReconciler(t)
+	n.config.Remotes = []Remote{
+		{URL: "https://nextcloud.example.com/s/abc", LocalPath: "share1/"},
+		{URL: "https://nextcloud.example.com/s/def", LocalPath: "share2/"},
+	}
+	for i := range n.config.Remotes {
+		require.NoError(t, n.config.Remotes[i].validateAndSetup(n.config.basePath))
+	}
+	n.config.Profiles = []Profile{
+		{Name: "quiet hours", Hours: []string{"22:00-07:00"}, Disabled: true},
+		{Name: "tethering", SSIDs: []string{"phone"}, Remotes: []string{"share1"}, BandwidthLimitKBps: 100},
+		{Name: "home", SSIDs: []string{"home", "home-5g"}},
+	}
+	for i := range n.config.Profiles {
+		require.NoError(t, n.config.Profiles[i].validateAndSetup(n.config.Remotes))
+	}
+	at := func(clock string) func() time.Time {
+		return func() time.Time {
+			now, _ := time.Parse("15:04", clock)
+			return now
+		}
+	}
+
+	n.ssid, n.now = fakeSSIDProvider("home"), at("23:30")
+	assert.Equal(t, "quiet hours", n.selectProfile(context.Background()).String())
+	n.now = at("06:59")
+	assert.Equal(t, "quiet hours", n.selectProfile(context.Background()).String())
+
+	n.now = at("07:00")
+	profile := n.selectProfile(context.Background())
+	assert.Equal(t, "home", profile.String())
+	assert.Len(t, profile.selectRemotes(n.config.Remotes), 2)
+	assert.Equal(t, int64(0), profile.bandwidthLimit())
+
+	n.ssid = fakeSSIDProvider("phone")
+	profile = n.selectProfile(context.Background())
+	assert.Equal(t, "tethering", profile.String())
+	remotes := profile.selectRemotes(n.config.Remotes)
+	require.Len(t, remotes, 1)
+	assert.Equal(t, &n.config.Remotes[0], remotes[0])
+	assert.Equal(t, int64(100<<10), profile.bandwidthLimit())
+
+	n.ssid = fakeSSIDProvider("hotel")
+	profile = n.selectProfile(context.Background())
+	assert.Nil(t, profile)
+	assert.Equal(t, "default", profile.String())
+	assert.Len(t, profile.selectRemotes(n.config.Remotes), 2)
+}
+
+func TestProfile_validateAndSetup(t *testing.T) {
+	remotes := []Remote{{configuredLocalPath: "share1/"}}
+	assert.NoError(t, (&Profile{Name: "p", Remotes: []string{"share1"}, Hours: []string{"9:00 - 17:30"}}).
+		validateAndSetup(remotes))
+	assert.Error(t, (&Profile{}).validateAndSetup(remotes))
+	assert.Error(t, (&Profile{Name: "p", Remotes: []string{"share2"}}).validateAndSetup(remotes))
+	assert.Error(t, (&Profile{Name: "p", Hours: []string{"9:00"}}).validateAndSetup(remotes))
+	assert.Error(t, (&Profile{Name: "p", Hours: []string{"9:00-25:00"}}).validateAndSetup(remotes))
+}
+
+func TestWPASupplicantSSIDProvider(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "wlan0")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 64)
+		n, addr, err := server.ReadFromUnix(buf)
+		if err != nil || string(buf[:n]) != "STATUS" {
+			return
+		}
+		//nolint:errcheck
+		server.WriteToUnix([]byte("bssid=00:11:22:33:44:55\nfreq=2437\nssid=My Network\nid=0\nwpa_state=COMPLETED\n"), addr)
+	}()
+
+	ssid, err := (&wpaSupplicantSSIDProvider{socket: socket}).SSID(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "My Network", ssid)
+
+	_, err = (&wpaSupplicantSSIDProvider{socket: filepath.Join(t.TempDir(), "missing")}).SSID(context.Background())
+	assert.Error(t, err)
+}
+
+func TestDecodeWPAString(t *testing.T) {
+	for encoded, ssid := range map[string]string{
+		`My Network`:            "My Network",
+		`Caf\xc3\xa9 \"Libri\"`: `Café "Libri"`,
+		`back\\slash\ttab`:      "back\\slash\ttab",
+		`\x7`:                   "\x07",
+		`trailing\`:             `trailing\`,
+		`\xzz`:                  "xzz",
+	} {
+		assert.Equal(t, ssid, decodeWPAString(encoded), encoded)
+	}
+}
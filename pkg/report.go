@@ -0,0 +1,389 @@
+package pkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReportPath = "Nextcloud Sync Report.epub"
+	defaultReportRuns = 5
+	// reportIdentifier is the same for every version of the report, so that the reader sees it as the same book
+	reportIdentifier = "urn:nextcloud-kobo:sync-report"
+	// maxEPUBMetadataSize limits the size of the metadata read from the synced books
+	maxEPUBMetadataSize = 1 << 20
+)
+
+// SyncReport is an EPUB book in the library that reports the last sync runs: the new books, the deletions, the errors
+// and a summary of the configuration.
+type SyncReport struct {
+	// Enabled writes the report after every sync.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Path is the path of the report, relative to the base path. It defaults to "Nextcloud Sync Report.epub". The
+	// report is regenerated in place and never deleted by the sync, even if it is in the local path of a remote.
+	Path string `yaml:"path,omitempty"`
+	// Runs is the number of runs in the report. It defaults to 5.
+	Runs int `yaml:"runs,omitempty"`
+
+	// fullPath is Path joined to the base path
+	fullPath string
+}
+
+func (r *SyncReport) setDefaults() {
+	if r.Path == "" {
+		r.Path = defaultReportPath
+	}
+	if r.Runs == 0 {
+		r.Runs = defaultReportRuns
+	}
+}
+
+func (r *SyncReport) validate() error {
+	if !filepath.IsLocal(r.Path) || !strings.HasSuffix(r.Path, ".epub") {
+		return fmt.Errorf("sync_report path must be a relative path ending with .epub")
+	}
+	if r.Runs < 0 {
+		return fmt.Errorf("sync_report runs must not be negative")
+	}
+	return nil
+}
+
+// reportPath returns the path of the report, or an empty string if it is disabled.
+func (c *Config) reportPath() string {
+	if !c.SyncReport.Enabled {
+		return ""
+	}
+	return c.SyncReport.fullPath
+}
+
+type reportBook struct {
+	ID     string
+	Title  string
+	Remote string
+	Path   string
+	Run    *SyncRun
+}
+
+// reportRun is a run of the report, with the reason and the note redacted: they can contain the URLs of the failed
+// requests.
+type reportRun struct {
+	*SyncRun
+	Reason string
+	Note   string
+}
+
+type reportRemote struct {
+	URL           string
+	LocalPath     string
+	Authenticated bool
+}
+
+type reportData struct {
+	Generated time.Time
+	Runs      []reportRun
+	NewBooks  []reportBook
+	Deleted   []string
+	Errors    []string
+	Remotes   []reportRemote
+	Config    *Config
+}
+
+// writeSyncReport regenerates the report with the last runs of the history.
+func (n *NetworkConnectionReconciler) writeSyncReport(ctx context.Context) {
+	reportPath := n.config.reportPath()
+	if reportPath == "" {
+		return
+	}
+	runs, err := ReadHistory(n.config.configPath, n.config.SyncReport.Runs)
+	if err == nil {
+		err = writeReport(reportPath, newReportData(n.config, runs, n.now()))
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to write the sync report", "error", err)
+	}
+}
+
+func newReportData(config *Config, runs []*SyncRun, now time.Time) *reportData {
+	r := newRedactor(config.logOptions().secrets)
+	data := &reportData{Generated: now, Config: config}
+	for _, run := range runs {
+		data.Runs = append(data.Runs, reportRun{SyncRun: run, Reason: r.redact(run.Reason), Note: r.redact(run.Note)})
+		if run.Reason != "" && run.Outcome != RunCompleted {
+			data.Errors = append(data.Errors, fmt.Sprintf("%s: %s", run.StartedAt.Local().Format(time.DateTime),
+				r.redact(run.Reason)))
+		}
+		for _, result := range run.Remotes {
+			for _, file := range result.Added {
+				data.NewBooks = append(data.NewBooks, reportBook{
+					ID:     fmt.Sprintf("book-%d", len(data.NewBooks)+1),
+					Title:  epubTitle(file),
+					Remote: result.Remote,
+					Path:   file,
+					Run:    run,
+				})
+			}
+			data.Deleted = append(data.Deleted, result.Deleted...)
+			if result.Error != nil {
+				data.Errors = append(data.Errors, fmt.Sprintf("%s: %s", run.StartedAt.Local().Format(time.DateTime),
+					r.redact(result.Error.localized(config.localizer()))))
+			}
+		}
+	}
+	for _, remote := range config.Remotes {
+		data.Remotes = append(data.Remotes, reportRemote{
+			URL:           r.redact(remote.URL),
+			LocalPath:     remote.configuredLocalPath,
+			Authenticated: remote.Password != "" || !remote.isShareLink() && remote.Username != "",
+		})
+	}
+	return data
+}
+
+// epubTitle returns the title in the metadata of an EPUB file, or its file name.
+func epubTitle(name string) string {
+	fallback := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".epub"), ".kepub")
+	if !strings.HasSuffix(name, ".epub") && !strings.HasSuffix(name, ".kepub") {
+		return path.Base(name)
+	}
+	book, err := zip.OpenReader(filepath.Clean(name))
+	if err != nil {
+		return fallback
+	}
+	//nolint:errcheck
+	defer book.Close()
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err = readZipXML(&book.Reader, "META-INF/container.xml", &container); err != nil ||
+		len(container.Rootfiles) == 0 {
+		return fallback
+	}
+	var opf struct {
+		Titles []string `xml:"metadata>title"`
+	}
+	if err = readZipXML(&book.Reader, container.Rootfiles[0].FullPath, &opf); err != nil || len(opf.Titles) == 0 ||
+		strings.TrimSpace(opf.Titles[0]) == "" {
+		return fallback
+	}
+	return strings.TrimSpace(opf.Titles[0])
+}
+
+func readZipXML(book *zip.Reader, name string, v any) error {
+	file, err := book.Open(name)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer file.Close()
+	return xml.NewDecoder(io.LimitReader(file, maxEPUBMetadataSize)).Decode(v)
+}
+
+// writeReport writes the EPUB report, replacing the previous one atomically.
+func writeReport(name string, data *reportData) error {
+	buf := &bytes.Buffer{}
+	book := zip.NewWriter(buf)
+	// the mimetype must be the first entry, and it must not be compressed
+	mimetype, err := book.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+	for _, entry := range []struct {
+		name     string
+		template *template.Template
+	}{
+		{"META-INF/container.xml", containerTemplate},
+		{"OEBPS/content.opf", opfTemplate},
+		{"OEBPS/toc.ncx", ncxTemplate},
+		{"OEBPS/nav.xhtml", navTemplate},
+		{"OEBPS/report.xhtml", reportTemplate},
+	} {
+		w, err := book.Create(entry.name)
+		if err != nil {
+			return err
+		}
+		// html/template escapes the prolog as text: it is written before the templates
+		if _, err = io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		if err = entry.template.Execute(w, data); err != nil {
+			return fmt.Errorf("error rendering %s: %w", entry.name, err)
+		}
+	}
+	if err = book.Close(); err != nil {
+		return err
+	}
+	if err = ensureDirExists(filepath.Dir(name)); err != nil {
+		return err
+	}
+	return writeFileAtomically(name, buf, 0644)
+}
+
+var reportFuncs = template.FuncMap{
+	"datetime": func(t time.Time) string { return t.Local().Format(time.DateTime) },
+	"modified": func(t time.Time) string { return t.UTC().Format("2006-01-02T15:04:05Z") },
+	"duration": func(run *SyncRun) string { return run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String() },
+	"counts": func(run *SyncRun) string {
+		added, updated, deleted, size := run.Counts()
+		return fmt.Sprintf("%d added, %d updated, %d deleted, %s", added, updated, deleted, formatBytes(size))
+	},
+	"add": func(a, b int) int { return a + b },
+}
+
+// newReportTemplate parses the template of an XML document of the report. The leading newline of text is dropped: the
+// document follows the XML prolog.
+func newReportTemplate(name, text string) *template.Template {
+	return template.Must(template.New(name).Funcs(reportFuncs).Parse(strings.TrimPrefix(text, "\n")))
+}
+
+var containerTemplate = newReportTemplate("container", `
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`)
+
+var opfTemplate = newReportTemplate("opf", `
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">`+reportIdentifier+`</dc:identifier>
+    <dc:title>Nextcloud Sync Report</dc:title>
+    <dc:creator>Nextcloud-Kobo</dc:creator>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">{{ modified .Generated }}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="report" href="report.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="report"/>
+  </spine>
+</package>
+`)
+
+var ncxTemplate = newReportTemplate("ncx", `
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="`+reportIdentifier+`"/>
+  </head>
+  <docTitle><text>Nextcloud Sync Report</text></docTitle>
+  <navMap>
+    <navPoint id="runs" playOrder="1">
+      <navLabel><text>Last syncs</text></navLabel>
+      <content src="report.xhtml#runs"/>
+    </navPoint>
+    <navPoint id="new-books" playOrder="2">
+      <navLabel><text>New books</text></navLabel>
+      <content src="report.xhtml#new-books"/>
+      {{- range $i, $book := .NewBooks }}
+      <navPoint id="{{ $book.ID }}" playOrder="{{ add $i 3 }}">
+        <navLabel><text>{{ $book.Title }}</text></navLabel>
+        <content src="report.xhtml#{{ $book.ID }}"/>
+      </navPoint>
+      {{- end }}
+    </navPoint>
+  </navMap>
+</ncx>
+`)
+
+var navTemplate = newReportTemplate("nav", `
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Contents</title></head>
+<body>
+  <nav epub:type="toc">
+    <ol>
+      <li><a href="report.xhtml#runs">Last syncs</a></li>
+      <li><a href="report.xhtml#new-books">New books</a>
+        {{- if .NewBooks }}
+        <ol>
+          {{- range .NewBooks }}
+          <li><a href="report.xhtml#{{ .ID }}">{{ .Title }}</a></li>
+          {{- end }}
+        </ol>
+        {{- end }}
+      </li>
+      <li><a href="report.xhtml#deletions">Deletions</a></li>
+      <li><a href="report.xhtml#errors">Errors</a></li>
+      <li><a href="report.xhtml#configuration">Configuration</a></li>
+    </ol>
+  </nav>
+</body>
+</html>
+`)
+
+var reportTemplate = newReportTemplate("report", `
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Nextcloud Sync Report</title></head>
+<body>
+  <h1>Nextcloud Sync Report</h1>
+  <p>Generated on {{ datetime .Generated }}.</p>
+
+  <h2 id="runs">Last syncs</h2>
+  {{- range .Runs }}
+  <p><b>{{ datetime .StartedAt }}</b> ({{ .Trigger }}{{ if .Profile }}, profile {{ .Profile }}{{ end }}): {{ .Outcome }}
+    in {{ duration .SyncRun }}. {{ counts .SyncRun }}.
+    {{- if .Reason }} {{ .Reason }}.{{ end }}{{ if .Note }} {{ .Note }}.{{ end }}</p>
+  {{- else }}
+  <p>No sync recorded yet.</p>
+  {{- end }}
+
+  <h2 id="new-books">New books</h2>
+  {{- range .NewBooks }}
+  <p id="{{ .ID }}"><b>{{ .Title }}</b><br/>{{ .Path }}<br/>From {{ .Remote }} on {{ datetime .Run.StartedAt }}</p>
+  {{- else }}
+  <p>No new books.</p>
+  {{- end }}
+
+  <h2 id="deletions">Deletions</h2>
+  {{- if .Deleted }}
+  <ul>
+    {{- range .Deleted }}
+    <li>{{ . }}</li>
+    {{- end }}
+  </ul>
+  {{- else }}
+  <p>No deletions.</p>
+  {{- end }}
+
+  <h2 id="errors">Errors</h2>
+  {{- if .Errors }}
+  <ul>
+    {{- range .Errors }}
+    <li>{{ . }}</li>
+    {{- end }}
+  </ul>
+  {{- else }}
+  <p>No errors.</p>
+  {{- end }}
+
+  <h2 id="configuration">Configuration</h2>
+  <ul>
+    {{- range .Remotes }}
+    <li>Remote {{ .URL }} synced to {{ .LocalPath }}{{ if .Authenticated }}, with a password{{ end }}</li>
+    {{- end }}
+    <li>Automatic updates: {{ if .Config.AutoUpdate }}on, {{ .Config.UpdateChannel }} channel{{ else }}off{{ end }}</li>
+    {{- range .Config.Profiles }}
+    <li>Profile {{ .Name }}{{ if .Disabled }}, sync disabled{{ end }}</li>
+    {{- end }}
+    <li>Connectivity probe: {{ .Config.ConnectivityProbe.Mode }}</li>
+    <li>Log level: {{ .Config.LogLevel }}</li>
+  </ul>
+</body>
+</html>
+`)
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// RemoteErrorKind classifies the errors of the sync of a remote.
+type RemoteErrorKind string
+
+const (
+	// RemoteErrorAuth is returned when the credentials or the share link are rejected
+	RemoteErrorAuth RemoteErrorKind = "auth"
+	// RemoteErrorNotFound is returned when the share link or the remote folder do not exist
+	RemoteErrorNotFound RemoteErrorKind = "not_found"
+	// RemoteErrorNetwork is returned when the server cannot be reached or the connection drops
+	RemoteErrorNetwork RemoteErrorKind = "network"
+	// RemoteErrorServer is returned when the server fails with a 5xx status
+	RemoteErrorServer RemoteErrorKind = "server"
+	// RemoteErrorLocal is returned when the files cannot be written on the device
+	RemoteErrorLocal RemoteErrorKind = "local"
+	// RemoteErrorUnknown is returned for any other error
+	RemoteErrorUnknown RemoteErrorKind = "unknown"
+)
+
+// RemoteError is an error of the sync of a remote, classified to show an actionable message.
+type RemoteError struct {
+	// Remote is the local path of the remote, as configured
+	Remote     string
+	Kind       RemoteErrorKind
+	StatusCode int
+	ShareLink  bool
+	Err        error
+	// messages are the messages Message renders the error with, English if nil
+	messages *messages
+	// message is the message recorded in the history. The errors recorded by the older versions, where legacy is set,
+	// only have this message.
+	message string
+	legacy  bool
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s error: %v", e.Remote, e.Kind, e.Err)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Message returns a short message telling the user what went wrong and what to do about it, in the language of the
+// configuration if the error was localized, or as it was recorded in the history otherwise.
+func (e *RemoteError) Message() string {
+	if e.messages == nil && e.message != "" {
+		return e.message
+	}
+	return e.localized(e.messages)
+}
+
+// localized returns the message in the language of the messages, English if nil. The errors recorded by the older
+// versions keep the message they were recorded with.
+func (e *RemoteError) localized(m *messages) string {
+	if e.legacy {
+		return e.message
+	}
+	if m == nil {
+		m = defaultMessages
+	}
+	data := msgData{"Remote": e.Remote, "StatusCode": e.StatusCode, "Error": fmt.Sprint(e.Err)}
+	switch e.Kind {
+	case RemoteErrorAuth:
+		if e.ShareLink {
+			return m.format(msgErrorAuthShare, data)
+		}
+		return m.format(msgErrorAuth, data)
+	case RemoteErrorNotFound:
+		if e.ShareLink {
+			return m.format(msgErrorNotFoundShare, data)
+		}
+		return m.format(msgErrorNotFound, data)
+	case RemoteErrorNetwork:
+		return m.format(msgErrorNetwork, data)
+	case RemoteErrorServer:
+		return m.format(msgErrorServer, data)
+	case RemoteErrorLocal:
+		return m.format(msgErrorLocal, data)
+	}
+	return m.format(msgErrorUnknown, data)
+}
+
+// remoteErrorJSON stores what the message is rendered from, so that it can be rendered in another language, and the
+// message for the consumers of the JSON.
+type remoteErrorJSON struct {
+	Kind       RemoteErrorKind `json:"kind"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Remote     string          `json:"remote,omitempty"`
+	ShareLink  bool            `json:"share_link,omitempty"`
+	// Error is the original error. The older versions did not record it.
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *RemoteError) MarshalJSON() ([]byte, error) {
+	v := remoteErrorJSON{Kind: e.Kind, StatusCode: e.StatusCode, Remote: e.Remote, ShareLink: e.ShareLink,
+		Message: e.Message()}
+	if !e.legacy && e.Err != nil {
+		v.Error = e.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+func (e *RemoteError) UnmarshalJSON(data []byte) error {
+	var v remoteErrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = RemoteError{Kind: v.Kind, StatusCode: v.StatusCode, Remote: v.Remote, ShareLink: v.ShareLink,
+		Err: errors.New(v.Error), message: v.Message, legacy: v.Error == ""}
+	if e.legacy {
+		e.Err = errors.New(v.Message)
+	}
+	return nil
+}
+
+// connectionErrnos are the errors of the system calls that mean that the network failed. The other ones come from
+// the device.
+var connectionErrnos = []syscall.Errno{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ETIMEDOUT,
+	syscall.EHOSTUNREACH, syscall.ENETUNREACH}
+
+// classifyRemoteError wraps err in a RemoteError of the kind matching its cause.
+func classifyRemoteError(remote *Remote, err error) *RemoteError {
+	remoteErr := &RemoteError{Remote: remote.configuredLocalPath, ShareLink: remote.isShareLink(), Err: err,
+		Kind: RemoteErrorUnknown}
+	var (
+		statusErr gowebdav.StatusError
+		urlErr    *url.Error
+		opErr     *net.OpError
+		pathErr   *fs.PathError
+		netErr    net.Error
+		errno     syscall.Errno
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		remoteErr.StatusCode = statusErr.Status
+		switch {
+		case statusErr.Status == http.StatusUnauthorized || statusErr.Status == http.StatusForbidden:
+			remoteErr.Kind = RemoteErrorAuth
+		case statusErr.Status == http.StatusNotFound:
+			remoteErr.Kind = RemoteErrorNotFound
+		case statusErr.Status >= 500:
+			remoteErr.Kind = RemoteErrorServer
+		}
+	// checked before the path errors, as the WebDAV client wraps the errors of the requests in them
+	case errors.As(err, &urlErr), errors.As(err, &opErr), errors.Is(err, io.ErrUnexpectedEOF),
+		slices.ContainsFunc(connectionErrnos, func(errno syscall.Errno) bool { return errors.Is(err, errno) }):
+		remoteErr.Kind = RemoteErrorNetwork
+	case errors.As(err, &pathErr):
+		remoteErr.Kind = RemoteErrorLocal
+	// syscall.Errno implements net.Error too: the other errors of the system calls come from the device
+	case errors.As(err, &errno):
+		remoteErr.Kind = RemoteErrorLocal
+	case errors.As(err, &netErr):
+		remoteErr.Kind = RemoteErrorNetwork
+	}
+	return remoteErr
+}
+
+func (r *Remote) isShareLink() bool {
+	return strings.Contains(r.URL, "/s/")
+}
+
+// RemoteOutcome is the outcome of the sync of a remote.
+type RemoteOutcome string
+
+const (
+	RemoteOK RemoteOutcome = "ok"
+	// RemotePartial means that some files were synced before an error
+	RemotePartial RemoteOutcome = "partial"
+	RemoteFailed  RemoteOutcome = "failed"
+	// RemoteSkipped means that the remote was not synced, e.g. because of the battery policy
+	RemoteSkipped RemoteOutcome = "skipped"
+)
+
+// RemoteResult is the result of the sync of a remote.
+type RemoteResult struct {
+	Remote  string        `json:"remote"`
+	Outcome RemoteOutcome `json:"outcome"`
+	// Added are the downloaded files that did not exist locally
+	Added []string `json:"added,omitempty"`
+	// Updated are the downloaded files that replaced an older local copy
+	Updated []string `json:"updated,omitempty"`
+	// Deleted are the local files and directories removed because they no longer exist on the remote
+	Deleted []string `json:"deleted,omitempty"`
+	// Bytes is the size of the downloaded files
+	Bytes int64        `json:"bytes,omitempty"`
+	Error *RemoteError `json:"error,omitempty"`
+}
+
+// newRemoteResult returns the result of a remote that failed before any change was applied, or the successful result
+// of a remote to apply changes to if err is nil.
+func newRemoteResult(remote *Remote, err error) *RemoteResult {
+	result := &RemoteResult{Remote: remote.configuredLocalPath, Outcome: RemoteOK}
+	result.fail(remote, err)
+	return result
+}
+
+// fail records the error of the remote, if any. The result is partial if some changes were applied before the error.
+func (r *RemoteResult) fail(remote *Remote, err error) {
+	if err == nil {
+		return
+	}
+	r.Error = classifyRemoteError(remote, err)
+	r.Outcome = RemoteFailed
+	if r.changes() > 0 {
+		r.Outcome = RemotePartial
+	}
+}
+
+// downloaded returns the added and updated files.
+func (r *RemoteResult) downloaded() []string {
+	return append(append([]string(nil), r.Added...), r.Updated...)
+}
+
+func (r *RemoteResult) changes() int {
+	return len(r.Added) + len(r.Updated) + len(r.Deleted)
+}
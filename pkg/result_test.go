@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestClassifyRemoteError(t *testing.T) {
+	share := &Remote{URL: "https://cloud.example.com/s/token", configuredLocalPath: "share1/"}
+	folder := &Remote{URL: "https://cloud.example.com/remote.php/dav/files/user/books", configuredLocalPath: "books/"}
+	tests := []struct {
+		name    string
+		remote  *Remote
+		err     error
+		kind    RemoteErrorKind
+		message string
+	}{
+		{name: "expired share link", remote: share, err: gowebdav.StatusError{Status: http.StatusUnauthorized},
+			kind: RemoteErrorAuth, message: "Share link expired or password changed for share1/"},
+		{name: "wrong credentials", remote: folder, err: gowebdav.StatusError{Status: http.StatusForbidden},
+			kind: RemoteErrorAuth, message: "Wrong username or password for books/"},
+		{name: "deleted share", remote: share,
+			err:  fmt.Errorf("listing: %w", gowebdav.StatusError{Status: http.StatusNotFound}),
+			kind: RemoteErrorNotFound, message: "Share link not found for share1/"},
+		{name: "server error", remote: share, err: gowebdav.StatusError{Status: http.StatusBadGateway},
+			kind: RemoteErrorServer, message: "Nextcloud server error (502) for share1/, try again later"},
+		{name: "connection refused", remote: share, err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED),
+			kind: RemoteErrorNetwork, message: "Network error while syncing share1/"},
+		{name: "disk full", remote: share, err: &fs.PathError{Op: "write", Path: "book.epub", Err: syscall.ENOSPC},
+			kind: RemoteErrorLocal},
+		{name: "connection reset", remote: share,
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			kind: RemoteErrorNetwork},
+		{name: "unreachable host", remote: share, err: &url.Error{Op: "Get", URL: "https://cloud.example.com",
+			Err: syscall.EHOSTUNREACH}, kind: RemoteErrorNetwork},
+		{name: "request in a path error", remote: share, err: &fs.PathError{Op: "ReadDir", Path: "/",
+			Err: &url.Error{Op: "Propfind", URL: "https://cloud.example.com", Err: io.EOF}}, kind: RemoteErrorNetwork},
+		{name: "missing local directory", remote: share,
+			err: &fs.PathError{Op: "open", Path: "books/book.epub", Err: syscall.ENOENT}, kind: RemoteErrorLocal,
+			message: "Cannot write the files of share1/: open books/book.epub: no such file or directory"},
+		{name: "local path is a file", remote: share,
+			err: fmt.Errorf("creating the directory: %w", &fs.PathError{Op: "mkdir", Path: "books",
+				Err: syscall.ENOTDIR}), kind: RemoteErrorLocal},
+		{name: "input/output error", remote: share, err: fmt.Errorf("write: %w", syscall.EIO), kind: RemoteErrorLocal},
+		{name: "directory instead of a file", remote: share,
+			err: &fs.PathError{Op: "open", Path: "books/book.epub", Err: syscall.EISDIR}, kind: RemoteErrorLocal},
+		{name: "unknown", remote: share, err: errors.New("boom"), kind: RemoteErrorUnknown,
+			message: "Failed to sync share1/: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteErr := classifyRemoteError(tt.remote, tt.err)
+			assert.Equal(t, tt.kind, remoteErr.Kind)
+			assert.ErrorIs(t, remoteErr, tt.err)
+			if tt.message != "" {
+				assert.Equal(t, tt.message, remoteErr.Message())
+			}
+		})
+	}
+}
+
+func TestSyncRemotes_continuesAfterFailure(t *testing.T) {
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(unauthorized.Close)
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1"})
+	n := newTestReconciler(t, unauthorized, srv)
+
+	results, _, err := n.syncRemotes(context.Background(), nil, powerDecision{})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, RemoteFailed, results[0].Outcome)
+	require.NotNil(t, results[0].Error)
+	assert.Equal(t, RemoteErrorAuth, results[0].Error.Kind)
+	assert.Equal(t, RemoteOK, results[1].Outcome)
+	assert.Len(t, results[1].Added, 1)
+	assert.FileExists(t, filepath.Join(n.config.Remotes[1].LocalPath, "book1.epub"))
+
+	summary := (&SyncRun{Remotes: results}).Summary()
+	assert.Contains(t, summary, "Synced 1 files")
+	assert.Contains(t, summary, "Share link expired or password changed for")
+}
+
+func TestRemoteError_localized(t *testing.T) {
+	italian, err := newMessages("it", nil)
+	require.NoError(t, err)
+	german, err := newMessages("de", nil)
+	require.NoError(t, err)
+	run := &SyncRun{Remotes: []*RemoteResult{{Remote: "share1/", Outcome: RemoteFailed,
+		Error: &RemoteError{Remote: "share1/", Kind: RemoteErrorNetwork, Err: errors.New("timeout")}}}}
+	run.localize(italian)
+	data, err := json.Marshal(run)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"message":"Errore di rete durante la sincronizzazione di share1/"`)
+
+	decoded := &SyncRun{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	remoteErr := decoded.Remotes[0].Error
+	// the message is recorded in the language of the configuration, and it can be rendered in another one
+	assert.Equal(t, "Errore di rete durante la sincronizzazione di share1/", remoteErr.Message())
+	assert.Equal(t, "Netzwerkfehler beim Synchronisieren von share1/", remoteErr.localized(german))
+	assert.Equal(t, "timeout", remoteErr.Err.Error())
+
+	// the errors recorded by the older versions only have their message
+	legacy := &RemoteError{}
+	require.NoError(t, json.Unmarshal([]byte(`{"kind":"network","message":"Network error while syncing share1/"}`),
+		legacy))
+	assert.Equal(t, "Network error while syncing share1/", legacy.localized(german))
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// RetryPolicy defines how the WebDAV listings and downloads are retried when they fail for a transient reason, e.g. a
+// 502 from a proxy or a connection reset.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts of an operation. Defaults to 4, 1 disables the retries.
+	Attempts int `yaml:"attempts,omitempty"`
+	// InitialDelaySeconds is the delay before the first retry, doubled at every retry. Defaults to 1 second.
+	InitialDelaySeconds int `yaml:"initial_delay_seconds,omitempty"`
+	// MaxDelaySeconds caps the delay between two attempts, including the one asked by the server with Retry-After.
+	// Defaults to 60 seconds.
+	MaxDelaySeconds int `yaml:"max_delay_seconds,omitempty"`
+}
+
+func (p *RetryPolicy) setDefaults() {
+	if p.Attempts == 0 {
+		p.Attempts = 4
+	}
+	if p.InitialDelaySeconds == 0 {
+		p.InitialDelaySeconds = 1
+	}
+	if p.MaxDelaySeconds == 0 {
+		p.MaxDelaySeconds = 60
+	}
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.Attempts < 0 || p.InitialDelaySeconds < 0 || p.MaxDelaySeconds < 0 {
+		return fmt.Errorf("retry values must not be negative")
+	}
+	if p.MaxDelaySeconds < p.InitialDelaySeconds {
+		return fmt.Errorf("retry max_delay_seconds must not be lower than initial_delay_seconds")
+	}
+	return nil
+}
+
+func (p *RetryPolicy) backoff() backoff {
+	return backoff{
+		attempts: p.Attempts,
+		initial:  time.Duration(p.InitialDelaySeconds) * time.Second,
+		max:      time.Duration(p.MaxDelaySeconds) * time.Second,
+	}
+}
+
+// backoff is the exponential backoff computed from a RetryPolicy.
+type backoff struct {
+	attempts int
+	initial  time.Duration
+	max      time.Duration
+}
+
+// delay returns the time to wait before the given retry, starting from 1. The exponential delay is randomized between
+// its half and its full value, so that the devices behind the same failing server do not retry all at once. The delay
+// asked by the server with Retry-After is used if it is longer.
+func (b backoff) delay(retry int, retryAfter time.Duration) time.Duration {
+	delay := b.max
+	if retry < 32 && b.initial<<(retry-1) < b.max {
+		delay = b.initial << (retry - 1)
+	}
+	if delay > 0 {
+		//nolint:gosec
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay
+}
+
+// do runs fn until it succeeds, fails with a permanent error, the attempts are exhausted or the context is done.
+func (b backoff) do(ctx context.Context, operation string, retryAfter *retryAfterTransport, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || attempt >= b.attempts || !isRetryable(err) {
+			return err
+		}
+		delay := b.delay(attempt, retryAfter.take())
+		loggerFrom(ctx).Warn("Operation failed, retrying", "operation", operation, "attempt", attempt,
+			"attempts", b.attempts, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable tells whether err is a transient failure that may not happen again: 5xx statuses except the ones
+// meaning that the request will never be served, 408, 429, timeouts and dropped connections. The authentication and
+// not found errors, the TLS verification errors and the local errors are permanent.
+func isRetryable(err error) bool {
+	var (
+		statusErr gowebdav.StatusError
+		certErr   *tls.CertificateVerificationError
+		opErr     *net.OpError
+		netErr    net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &statusErr):
+		switch statusErr.Status {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	case errors.As(err, &certErr):
+		return false
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.As(err, &opErr):
+		return true
+	case errors.As(err, &netErr):
+		// syscall.Errno implements net.Error too: only the timeouts are transient
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// retryAfterTransport records the delay asked by the server with the Retry-After header of the last 429 or 503
+// response, which gowebdav does not expose in its errors.
+type retryAfterTransport struct {
+	next       http.RoundTripper
+	retryAfter atomic.Int64
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusServiceUnavailable) {
+		t.retryAfter.Store(int64(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())))
+	}
+	return resp, err
+}
+
+// take returns the last delay asked by the server and forgets it.
+func (t *retryAfterTransport) take() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.retryAfter.Swap(0))
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failureInjector answers with the queued failures of a request method before passing the requests to the WebDAV
+// handler. Like Nextcloud, it asks for the credentials of the share: the requests sent by gowebdav to negotiate the
+// authentication are not counted.
+type failureInjector struct {
+	next     http.Handler
+	mu       sync.Mutex
+	failures map[string][]func(w http.ResponseWriter)
+	requests map[string]int
+}
+
+func (f *failureInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Nextcloud"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	f.requests[r.Method]++
+	var fail func(w http.ResponseWriter)
+	if queue := f.failures[r.Method]; len(queue) > 0 {
+		fail, f.failures[r.Method] = queue[0], queue[1:]
+	}
+	f.mu.Unlock()
+	if fail != nil {
+		fail(w)
+		return
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+func failWithStatus(status int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+	}
+}
+
+// resetConnection sends part of a response and drops the connection.
+func resetConnection(w http.ResponseWriter) {
+	w.Header().Set("Content-Length", "1000")
+	//nolint:errcheck
+	w.Write([]byte("partial"))
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestSync_retriesTransientFailures(t *testing.T) {
+	injector := &failureInjector{
+		next: newWebDAVHandler(t, map[string]string{"book1.epub": "book1", "saga/book2.epub": "book2"}),
+		failures: map[string][]func(w http.ResponseWriter){
+			"PROPFIND": {failWithStatus(http.StatusBadGateway), failWithStatus(http.StatusServiceUnavailable)},
+			"GET":      {resetConnection, failWithStatus(http.StatusGatewayTimeout)},
+		},
+		requests: map[string]int{},
+	}
+	srv := httptest.NewServer(injector)
+	t.Cleanup(srv.Close)
+	n := newTestReconciler(t, srv)
+	n.config.Retry = RetryPolicy{Attempts: 3}
+
+	results, _, err := n.syncRemotes(context.Background(), nil, powerDecision{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, RemoteOK, results[0].Outcome)
+	assert.Len(t, results[0].Added, 2)
+	content, err := os.ReadFile(filepath.Join(n.config.Remotes[0].LocalPath, "book1.epub"))
+	require.NoError(t, err)
+	assert.Equal(t, "book1", string(content))
+	// 2 directories, 2 files and 2 failures each
+	assert.Equal(t, 4, injector.requests["PROPFIND"])
+	assert.Equal(t, 4, injector.requests["GET"])
+}
+
+func TestSync_permanentFailuresAreNotRetried(t *testing.T) {
+	injector := &failureInjector{
+		next: newWebDAVHandler(t, nil),
+		failures: map[string][]func(w http.ResponseWriter){
+			"PROPFIND": {failWithStatus(http.StatusNotFound)},
+		},
+		requests: map[string]int{},
+	}
+	srv := httptest.NewServer(injector)
+	t.Cleanup(srv.Close)
+	n := newTestReconciler(t, srv)
+	n.config.Retry = RetryPolicy{Attempts: 3}
+
+	results, _, err := n.syncRemotes(context.Background(), nil, powerDecision{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NotNil(t, results[0].Error)
+	assert.Equal(t, RemoteErrorNotFound, results[0].Error.Kind)
+	assert.Equal(t, 1, injector.requests["PROPFIND"])
+}
+
+func TestSync_retriesExhausted(t *testing.T) {
+	injector := &failureInjector{
+		next: newWebDAVHandler(t, nil),
+		failures: map[string][]func(w http.ResponseWriter){
+			"PROPFIND": {failWithStatus(http.StatusBadGateway), failWithStatus(http.StatusBadGateway),
+				failWithStatus(http.StatusBadGateway)},
+		},
+		requests: map[string]int{},
+	}
+	srv := httptest.NewServer(injector)
+	t.Cleanup(srv.Close)
+	n := newTestReconciler(t, srv)
+	n.config.Retry = RetryPolicy{Attempts: 3}
+
+	results, _, err := n.syncRemotes(context.Background(), nil, powerDecision{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, RemoteErrorServer, results[0].Error.Kind)
+	assert.Equal(t, 3, injector.requests["PROPFIND"])
+}
+
+func TestBackoff_delay(t *testing.T) {
+	b := backoff{attempts: 5, initial: time.Second, max: 10 * time.Second}
+	for retry, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second} {
+		delay := b.delay(retry+1, 0)
+		assert.GreaterOrEqual(t, delay, expected/2)
+		assert.LessOrEqual(t, delay, expected)
+	}
+	// the server asks for a longer delay
+	assert.Equal(t, 7*time.Second, b.delay(1, 7*time.Second))
+	// ...but not longer than the maximum
+	assert.Equal(t, 10*time.Second, b.delay(1, time.Hour))
+	// a huge number of retries does not overflow
+	assert.LessOrEqual(t, b.delay(100, 0), 10*time.Second)
+}
+
+func TestBackoff_cancelled(t *testing.T) {
+	b := backoff{attempts: 5, initial: time.Hour, max: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	calls := 0
+	err := b.do(ctx, "test", nil, func() error {
+		calls++
+		return &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, calls)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Mon, 01 Jan 2024 12:00:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Mon, 01 Jan 2024 11:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(srv.Close)
+	transport := &retryAfterTransport{next: http.DefaultTransport}
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	require.NoError(t, err)
+	//nolint:errcheck
+	resp.Body.Close()
+	assert.Equal(t, 42*time.Second, transport.take())
+	assert.Equal(t, time.Duration(0), transport.take())
+}
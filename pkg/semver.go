@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// describePattern matches the git describe output of a commit after a tag, e.g. v1.2.0-3-gabc1234
+	describePattern = regexp.MustCompile(`^(.+)-\d+-g[0-9a-f]+$`)
+	// pseudoVersionPattern matches the end of the Go pseudo-versions, e.g. v0.0.0-20240101120000-abcdef123456
+	pseudoVersionPattern = regexp.MustCompile(`\d{14}-[0-9a-f]{12}$`)
+)
+
+// semver is a semantic version (https://semver.org/). The build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseSemver parses a version in the MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] format, with an optional v prefix.
+func parseSemver(version string) (*semver, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	v, _, _ = strings.Cut(v, "+")
+	v, prerelease, hasPrerelease := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid version %q: expected MAJOR.MINOR.PATCH", version)
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || (len(part) > 1 && part[0] == '0') {
+			return nil, fmt.Errorf("invalid version %q: %q is not a valid number", version, part)
+		}
+		numbers[i] = number
+	}
+	s := &semver{major: numbers[0], minor: numbers[1], patch: numbers[2]}
+	if hasPrerelease {
+		s.prerelease = strings.Split(prerelease, ".")
+		for _, identifier := range s.prerelease {
+			if identifier == "" {
+				return nil, fmt.Errorf("invalid version %q: empty pre-release identifier", version)
+			}
+		}
+	}
+	return s, nil
+}
+
+// parseBuildVersion parses the version embedded in a binary. The git describe output of a commit after a tag and the
+// builds of a dirty tree are development builds of the tag, i.e. newer than it rather than pre-releases of it. The
+// bare commit hashes and the Go pseudo-versions are not versions.
+func parseBuildVersion(version string) (v *semver, dev bool, err error) {
+	build := strings.TrimSpace(version)
+	for _, suffix := range []string{"+dirty", "-dirty"} {
+		if strings.HasSuffix(build, suffix) {
+			build, dev = strings.TrimSuffix(build, suffix), true
+		}
+	}
+	if match := describePattern.FindStringSubmatch(build); match != nil {
+		build, dev = match[1], true
+	}
+	if pseudoVersionPattern.MatchString(build) {
+		return nil, false, fmt.Errorf("invalid version %q: pseudo-version of an untagged commit", version)
+	}
+	v, err = parseSemver(build)
+	return v, dev, err
+}
+
+func (s *semver) isPrerelease() bool {
+	return len(s.prerelease) > 0
+}
+
+// compare returns -1, 0 or 1 if s is lower, equal or greater than other, following the semver precedence rules.
+func (s *semver) compare(other *semver) int {
+	for _, d := range []int{s.major - other.major, s.minor - other.minor, s.patch - other.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	// a version without pre-release has a higher precedence than the same version with a pre-release
+	switch {
+	case !s.isPrerelease() && !other.isPrerelease():
+		return 0
+	case !s.isPrerelease():
+		return 1
+	case !other.isPrerelease():
+		return -1
+	}
+	for i := 0; i < len(s.prerelease) && i < len(other.prerelease); i++ {
+		if c := comparePrereleaseIdentifiers(s.prerelease[i], other.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(s.prerelease) - len(other.prerelease))
+}
+
+func (s *semver) String() string {
+	version := fmt.Sprintf("v%d.%d.%d", s.major, s.minor, s.patch)
+	if s.isPrerelease() {
+		version += "-" + strings.Join(s.prerelease, ".")
+	}
+	return version
+}
+
+// comparePrereleaseIdentifiers compares numeric identifiers numerically and the others lexically. Numeric identifiers
+// have a lower precedence than the alphanumeric ones.
+func comparePrereleaseIdentifiers(a, b string) int {
+	aNumber, aErr := strconv.Atoi(a)
+	bNumber, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(aNumber - bNumber)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
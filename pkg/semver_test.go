@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemver_compare(t *testing.T) {
+	// ordered by precedence, from https://semver.org/#spec-item-11
+	versions := []string{
+		"0.9.0",
+		"v1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"v1.0.0",
+		"1.0.1",
+		"1.2.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i := range versions {
+		for j := range versions {
+			a, err := parseSemver(versions[i])
+			require.NoError(t, err)
+			b, err := parseSemver(versions[j])
+			require.NoError(t, err)
+			assert.Equal(t, sign(i-j), a.compare(b), "%s <=> %s", versions[i], versions[j])
+		}
+	}
+
+	a, _ := parseSemver("v1.0.0+build.1")
+	b, _ := parseSemver("1.0.0+build.2")
+	assert.Equal(t, 0, a.compare(b))
+	assert.Equal(t, "v1.0.0", a.String())
+}
+
+func TestParseSemver(t *testing.T) {
+	version, err := parseSemver("v1.2.3-rc.1+abc")
+	assert.NoError(t, err)
+	assert.Equal(t, &semver{major: 1, minor: 2, patch: 3, prerelease: []string{"rc", "1"}}, version)
+	assert.True(t, version.isPrerelease())
+	assert.Equal(t, "v1.2.3-rc.1", version.String())
+
+	for _, invalid := range []string{"", "nightly", "v1.2", "1.2.3.4", "1.02.3", "1.2.3-", "1.2.3-rc..1", "1.-2.3"} {
+		_, err = parseSemver(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseBuildVersion(t *testing.T) {
+	for build, expected := range map[string]struct {
+		version string
+		dev     bool
+	}{
+		"v1.2.0":                  {version: "v1.2.0"},
+		"v1.3.0-rc.1":             {version: "v1.3.0-rc.1"},
+		"v1.2.0-3-gabc1234":       {version: "v1.2.0", dev: true},
+		"v1.2.0-3-gabc1234-dirty": {version: "v1.2.0", dev: true},
+		"v1.3.0-rc.1-2-g0123abcd": {version: "v1.3.0-rc.1", dev: true},
+		"v1.2.0-dirty":            {version: "v1.2.0", dev: true},
+		"v1.2.0+dirty":            {version: "v1.2.0", dev: true},
+	} {
+		version, dev, err := parseBuildVersion(build)
+		if assert.NoError(t, err, build) {
+			assert.Equal(t, expected.version, version.String(), build)
+			assert.Equal(t, expected.dev, dev, build)
+		}
+	}
+	for _, invalid := range []string{"", "abc1234", "abc1234-dirty", "v0.0.0-20240101120000-abcdef123456",
+		"v1.2.1-0.20240101120000-abcdef123456+dirty"} {
+		_, _, err := parseBuildVersion(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
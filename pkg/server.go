@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusServerShutdownTimeout bounds the time spent answering the pending requests before exiting
+const statusServerShutdownTimeout = 5 * time.Second
+
+// StatusServer exposes the status of the daemon and its metrics over HTTP, e.g. to monitor the devices on the LAN.
+type StatusServer struct {
+	// Address is the host:port to listen on, e.g. ":8080" or "192.168.1.10:8080". The server is disabled if empty.
+	Address string `yaml:"address,omitempty"`
+	// Username and Password enable the basic authentication, if set.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func (s *StatusServer) validate() error {
+	if s.Address != "" {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("invalid status_server address: %w", err)
+		}
+	}
+	if (s.Username == "") != (s.Password == "") {
+		return fmt.Errorf("status_server username and password must be set together")
+	}
+	return nil
+}
+
+// DaemonStatus is the status served by the /status endpoint.
+type DaemonStatus struct {
+	Version string     `json:"version"`
+	Sync    SyncStatus `json:"sync"`
+	Bus     BusHealth  `json:"bus"`
+}
+
+// syncMetrics accumulates the metrics of the sync runs since the daemon started.
+type syncMetrics struct {
+	mu               sync.Mutex
+	runs             map[RunOutcome]int
+	durationSum      float64
+	durationCount    int
+	bytes            map[string]int64
+	files            map[[2]string]int
+	errors           map[[2]string]int
+	lastSuccess      time.Time
+	lastSuccessKnown bool
+}
+
+func newSyncMetrics() *syncMetrics {
+	return &syncMetrics{
+		runs:   map[RunOutcome]int{},
+		bytes:  map[string]int64{},
+		files:  map[[2]string]int{},
+		errors: map[[2]string]int{},
+	}
+}
+
+// loadLastSuccess reads the time of the last completed run from the history, so that it survives the restarts.
+func (m *syncMetrics) loadLastSuccess(configPath string) error {
+	runs, err := ReadHistory(configPath, 0)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, run := range runs {
+		if run.Outcome == RunCompleted && run.FinishedAt.After(m.lastSuccess) {
+			m.lastSuccess, m.lastSuccessKnown = run.FinishedAt, true
+		}
+	}
+	return nil
+}
+
+func (m *syncMetrics) observe(run *SyncRun) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[run.Outcome]++
+	m.durationSum += run.FinishedAt.Sub(run.StartedAt).Seconds()
+	m.durationCount++
+	for _, result := range run.Remotes {
+		m.bytes[result.Remote] += result.Bytes
+		m.files[[2]string{result.Remote, "added"}] += len(result.Added)
+		m.files[[2]string{result.Remote, "updated"}] += len(result.Updated)
+		m.files[[2]string{result.Remote, "deleted"}] += len(result.Deleted)
+		if result.Error != nil {
+			m.errors[[2]string{result.Remote, string(result.Error.Kind)}]++
+		}
+	}
+	if run.Outcome == RunCompleted {
+		m.lastSuccess, m.lastSuccessKnown = run.FinishedAt, true
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *syncMetrics) write(w io.Writer, status DaemonStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("nextcloud_kobo_build_info", "gauge", "The version of the daemon.")
+	fmt.Fprintf(&b, "nextcloud_kobo_build_info{version=\"%s\"} 1\n", escapeLabel(status.Version))
+	metric("nextcloud_kobo_sync_state", "gauge", "The current state of the sync, 1 for the current one.")
+	for _, state := range []SyncState{StateIdle, StateCheckingNetwork, StateSyncing, StateUpdating, StateCancelling} {
+		fmt.Fprintf(&b, "nextcloud_kobo_sync_state{state=\"%s\"} %d\n", state, boolToInt(status.Sync.State == state))
+	}
+	metric("nextcloud_kobo_bus_connected", "gauge", "Whether the service triggering the syncs is reachable.")
+	fmt.Fprintf(&b, "nextcloud_kobo_bus_connected %d\n",
+		boolToInt(status.Bus.Connected && status.Bus.ServiceAvailable))
+	metric("nextcloud_kobo_sync_runs_total", "counter", "The sync runs since the daemon started, by outcome.")
+	for _, outcome := range []RunOutcome{RunCompleted, RunFailed, RunSkipped, RunCancelled} {
+		fmt.Fprintf(&b, "nextcloud_kobo_sync_runs_total{outcome=\"%s\"} %d\n", outcome, m.runs[outcome])
+	}
+	metric("nextcloud_kobo_sync_duration_seconds", "summary", "The duration of the sync runs.")
+	fmt.Fprintf(&b, "nextcloud_kobo_sync_duration_seconds_sum %g\nnextcloud_kobo_sync_duration_seconds_count %d\n",
+		m.durationSum, m.durationCount)
+	metric("nextcloud_kobo_downloaded_bytes_total", "counter", "The bytes downloaded, by remote.")
+	for _, remote := range sortedKeys(m.bytes) {
+		fmt.Fprintf(&b, "nextcloud_kobo_downloaded_bytes_total{remote=\"%s\"} %d\n", escapeLabel(remote),
+			m.bytes[remote])
+	}
+	metric("nextcloud_kobo_files_total", "counter", "The files added, updated and deleted, by remote.")
+	for _, key := range sortedKeys(m.files) {
+		fmt.Fprintf(&b, "nextcloud_kobo_files_total{remote=\"%s\",change=\"%s\"} %d\n", escapeLabel(key[0]), key[1],
+			m.files[key])
+	}
+	metric("nextcloud_kobo_remote_errors_total", "counter", "The failed syncs of a remote, by remote and kind.")
+	for _, key := range sortedKeys(m.errors) {
+		fmt.Fprintf(&b, "nextcloud_kobo_remote_errors_total{remote=\"%s\",kind=\"%s\"} %d\n", escapeLabel(key[0]),
+			key[1], m.errors[key])
+	}
+	if m.lastSuccessKnown {
+		metric("nextcloud_kobo_last_success_timestamp_seconds", "gauge", "The end of the last completed sync.")
+		fmt.Fprintf(&b, "nextcloud_kobo_last_success_timestamp_seconds %d\n", m.lastSuccess.Unix())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sortedKeys returns the keys of the metric values in a stable order.
+func sortedKeys[K string | [2]string, V any](values map[K]V) []K {
+	keys := make([]K, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
+
+// statusHandler serves /status and /metrics.
+func (n *NetworkConnectionReconciler) statusHandler() http.Handler {
+	r := newRedactor(n.config.logOptions().secrets)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.MarshalIndent(n.daemonStatus(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// the error messages of the remotes can contain URLs
+		//nolint:errcheck
+		io.WriteString(w, r.redact(string(data))+"\n")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		//nolint:errcheck
+		n.metrics.write(w, n.daemonStatus())
+	})
+	options := n.config.StatusServer
+	if options.Username == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(options.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(options.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nextcloud-kobo"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func (n *NetworkConnectionReconciler) daemonStatus() DaemonStatus {
+	return DaemonStatus{Version: RunningVersion(), Sync: n.Status(), Bus: n.Health()}
+}
+
+// serveStatus serves the status and the metrics on the configured address until the context is done. The daemon
+// keeps syncing if the address cannot be bound.
+func (n *NetworkConnectionReconciler) serveStatus(ctx context.Context, listener net.Listener) {
+	server := &http.Server{Handler: n.statusHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), statusServerShutdownTimeout)
+		defer cancel()
+		//nolint:errcheck
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Serving the status", "address", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Status server failed", "error", err)
+	}
+}
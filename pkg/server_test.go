@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusServer(t *testing.T) {
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(unauthorized.Close)
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1", "book2.epub": "book2"})
+	n := newTestReconciler(t, srv, unauthorized)
+	n.config.StatusServer = StatusServer{Address: "127.0.0.1:0", Username: "admin", Password: "secret-password"}
+	previous := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	require.NoError(t, appendHistory(n.config.configPath, &SyncRun{ID: "a", Outcome: RunCompleted,
+		FinishedAt: previous}, 10))
+	n.metrics = newSyncMetrics()
+	require.NoError(t, n.metrics.loadLastSuccess(n.config.configPath))
+	server := httptest.NewServer(n.statusHandler())
+	t.Cleanup(server.Close)
+
+	get := func(path, username, password string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := get("/metrics", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get("/status", "admin", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, body := get("/metrics", "admin", "secret-password")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "nextcloud_kobo_last_success_timestamp_seconds 1714550400\n")
+
+	// a failed remote does not update the last success
+	n.runSync(context.Background())
+	code, body = get("/metrics", "admin", "secret-password")
+	assert.Equal(t, http.StatusOK, code)
+	for _, line := range []string{
+		"nextcloud_kobo_sync_state{state=\"idle\"} 1\n",
+		"nextcloud_kobo_sync_runs_total{outcome=\"failed\"} 1\n",
+		"nextcloud_kobo_sync_duration_seconds_count 1\n",
+		"nextcloud_kobo_downloaded_bytes_total{remote=\"share1\"} 10\n",
+		"nextcloud_kobo_files_total{remote=\"share1\",change=\"added\"} 2\n",
+		"nextcloud_kobo_remote_errors_total{remote=\"share2\",kind=\"auth\"} 1\n",
+		"nextcloud_kobo_last_success_timestamp_seconds 1714550400\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+
+	code, body = get("/status", "admin", "secret-password")
+	assert.Equal(t, http.StatusOK, code)
+	var status DaemonStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, StateIdle, status.Sync.State)
+	require.NotNil(t, status.Sync.LastRun)
+	assert.Equal(t, RunFailed, status.Sync.LastRun.Outcome)
+	require.Len(t, status.Sync.LastRun.Remotes, 2)
+	for _, result := range status.Sync.LastRun.Remotes {
+		if result.Remote == "share2" {
+			require.NotNil(t, result.Error)
+			assert.Equal(t, RemoteErrorAuth, result.Error.Kind)
+		}
+	}
+	assert.Equal(t, nickelDBusName, status.Bus.Service)
+	assert.NotContains(t, body, "secret-password")
+
+	n.runSync(context.Background())
+	_, body = get("/metrics", "admin", "secret-password")
+	assert.Contains(t, body, "nextcloud_kobo_sync_runs_total{outcome=\"failed\"} 2\n")
+}
+
+func TestStatusServer_validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		server StatusServer
+		errMsg string
+	}{
+		{name: "disabled"},
+		{name: "all interfaces", server: StatusServer{Address: ":8080"}},
+		{name: "basic auth", server: StatusServer{Address: "192.168.1.10:8080", Username: "admin", Password: "pw"}},
+		{name: "missing port", server: StatusServer{Address: "192.168.1.10"}, errMsg: "invalid status_server address"},
+		{name: "missing password", server: StatusServer{Address: ":8080", Username: "admin"},
+			errMsg: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.server.validate()
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// sinkWebhook posts a JSON document, the default one or the rendered template, to the URL
+	sinkWebhook = "webhook"
+	// sinkNtfy publishes a message to the ntfy topic of the URL
+	sinkNtfy = "ntfy"
+	// sinkGotify sends a message to the Gotify server of the URL with an application token
+	sinkGotify = "gotify"
+	// sinkNextcloud sends a Nextcloud notification, with the notifications app, authenticated with an app password
+	sinkNextcloud = "nextcloud"
+
+	// sinkOnChanges notifies the runs that changed some files or failed
+	sinkOnChanges = "changes"
+	// sinkOnFailures notifies the failed runs only
+	sinkOnFailures = "failures"
+	// sinkOnAlways notifies every run, including the skipped ones
+	sinkOnAlways = "always"
+
+	defaultSinkTimeoutSeconds = 10
+	// maxSinkResponseSize limits the size of the error responses of the sinks included in the logs
+	maxSinkResponseSize = 512
+	// maxNextcloudShortMessage is the maximum length of the subject of a Nextcloud notification
+	maxNextcloudShortMessage = 255
+)
+
+// NotificationSink sends a notification to a phone or a service at the end of the sync runs.
+type NotificationSink struct {
+	// Type is webhook, ntfy, gotify or nextcloud.
+	Type string `yaml:"type"`
+	// URL is the URL of the webhook, the ntfy topic, e.g. https://ntfy.sh/my-kobo, the Gotify server or the Nextcloud
+	// server.
+	URL string `yaml:"url"`
+	// On is the runs to notify: changes (the default) for the runs that changed some files or failed, failures for
+	// the failed ones, or always.
+	On string `yaml:"on,omitempty"`
+	// Token is the Gotify application token, or the ntfy access token.
+	Token string `yaml:"token,omitempty"`
+	// Username and Password authenticate to ntfy or to Nextcloud, with an app password. The Nextcloud user must be an
+	// administrator to send notifications.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Recipient is the Nextcloud user to notify. It defaults to Username.
+	Recipient string `yaml:"recipient,omitempty"`
+	// Template is the text/template of the webhook body, rendered with .Device, .Title, .Message and .Run, the
+	// SyncRun. The json function encodes a value as JSON. The body defaults to the JSON of these fields.
+	Template string `yaml:"template,omitempty"`
+	// Headers are added to the webhook requests, e.g. for the authentication.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// TimeoutSeconds bounds the time to send the notification. Defaults to 10 seconds.
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"`
+
+	template *template.Template
+	timeout  time.Duration
+}
+
+// sinkEvent is what the sinks notify.
+type sinkEvent struct {
+	Device  string   `json:"device"`
+	Title   string   `json:"title"`
+	Message string   `json:"message"`
+	Run     *SyncRun `json:"run"`
+}
+
+func (s *NotificationSink) validateAndSetup() error {
+	switch s.Type {
+	case sinkWebhook, sinkNtfy, sinkGotify, sinkNextcloud:
+	default:
+		return fmt.Errorf("notification_sinks type must be one of %s, %s, %s or %s", sinkWebhook, sinkNtfy,
+			sinkGotify, sinkNextcloud)
+	}
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid notification_sinks url %q", s.URL)
+	}
+	if s.On == "" {
+		s.On = sinkOnChanges
+	}
+	switch s.On {
+	case sinkOnChanges, sinkOnFailures, sinkOnAlways:
+	default:
+		return fmt.Errorf("notification_sinks on must be one of %s, %s or %s", sinkOnChanges, sinkOnFailures,
+			sinkOnAlways)
+	}
+	switch {
+	case s.Type == sinkGotify && s.Token == "":
+		return fmt.Errorf("the gotify notification sinks require a token")
+	case s.Type == sinkNextcloud && (s.Username == "" || s.Password == ""):
+		return fmt.Errorf("the nextcloud notification sinks require a username and an app password")
+	case s.Template != "" && s.Type != sinkWebhook:
+		return fmt.Errorf("the template is only supported by the webhook notification sinks")
+	}
+	if s.Recipient == "" {
+		s.Recipient = s.Username
+	}
+	if s.Template != "" {
+		var err error
+		s.template, err = template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(s.Template)
+		if err != nil {
+			return fmt.Errorf("invalid notification_sinks template: %w", err)
+		}
+	}
+	if s.TimeoutSeconds < 0 {
+		return fmt.Errorf("notification_sinks timeout_seconds must not be negative")
+	}
+	if s.TimeoutSeconds == 0 {
+		s.TimeoutSeconds = defaultSinkTimeoutSeconds
+	}
+	s.timeout = time.Duration(s.TimeoutSeconds) * time.Second
+	return nil
+}
+
+// matches returns true if the run has to be notified to the sink.
+func (s *NotificationSink) matches(run *SyncRun) bool {
+	switch s.On {
+	case sinkOnAlways:
+		return true
+	case sinkOnFailures:
+		return run.Outcome == RunFailed
+	}
+	added, updated, deleted, _ := run.Counts()
+	return run.Outcome == RunFailed || added+updated+deleted > 0
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// newSinkEvent returns the notification of the run, with the passwords and the share tokens redacted.
+func newSinkEvent(config *Config, run *SyncRun) sinkEvent {
+	r := newRedactor(config.logOptions().secrets)
+	device := config.DeviceName
+	if device == "" {
+		device, _ = os.Hostname()
+	}
+	title := config.text(msgNotificationTitle, msgData{"Outcome": string(run.Outcome), "Device": device})
+	message := run.summary(config.localizer())
+	if run.Reason != "" {
+		message = run.Reason
+	}
+	// the run is shared with the state machine: redact a copy of its errors
+	data, err := json.Marshal(run)
+	redactedRun := &SyncRun{}
+	if err == nil {
+		err = json.Unmarshal([]byte(r.redact(string(data))), redactedRun)
+	}
+	if err != nil {
+		redactedRun = nil
+	} else {
+		redactedRun.localize(config.localizer())
+	}
+	return sinkEvent{Device: device, Title: title, Message: r.redact(message), Run: redactedRun}
+}
+
+// send sends the notification of the event with the client, within the timeout of the sink.
+func (s *NotificationSink) send(ctx context.Context, client *http.Client, event sinkEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := s.newRequest(ctx, event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSinkResponseSize))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *NotificationSink) newRequest(ctx context.Context, event sinkEvent) (*http.Request, error) {
+	failed := event.Run != nil && event.Run.Outcome == RunFailed
+	var (
+		body        []byte
+		contentType = "application/json"
+		target      = s.URL
+		err         error
+	)
+	switch s.Type {
+	case sinkWebhook:
+		if s.template == nil {
+			body, err = json.Marshal(event)
+		} else {
+			buf := &bytes.Buffer{}
+			err = s.template.Execute(buf, event)
+			body = buf.Bytes()
+		}
+	case sinkNtfy:
+		body, contentType = []byte(event.Message), "text/plain; charset=utf-8"
+	case sinkGotify:
+		priority := 5
+		if failed {
+			priority = 8
+		}
+		target = strings.TrimSuffix(s.URL, "/") + "/message"
+		body, err = json.Marshal(map[string]interface{}{"title": event.Title, "message": event.Message,
+			"priority": priority})
+	case sinkNextcloud:
+		shortMessage := event.Title
+		if len(shortMessage) > maxNextcloudShortMessage {
+			// cut on a rune boundary: the localized titles are not ASCII
+			end := maxNextcloudShortMessage
+			for end > 0 && !utf8.RuneStart(shortMessage[end]) {
+				end--
+			}
+			shortMessage = shortMessage[:end]
+		}
+		target = strings.TrimSuffix(s.URL, "/") + "/ocs/v2.php/apps/notifications/api/v2/admin_notifications/" +
+			url.PathEscape(s.Recipient)
+		body = []byte(url.Values{"shortMessage": {shortMessage}, "longMessage": {event.Message}}.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch s.Type {
+	case sinkWebhook:
+		for name, value := range s.Headers {
+			req.Header.Set(name, value)
+		}
+	case sinkNtfy:
+		req.Header.Set("Title", event.Title)
+		if failed {
+			req.Header.Set("Priority", strconv.Itoa(4))
+			req.Header.Set("Tags", "warning")
+		} else {
+			req.Header.Set("Tags", "books")
+		}
+	case sinkGotify:
+		req.Header.Set("X-Gotify-Key", s.Token)
+	case sinkNextcloud:
+		req.Header.Set("OCS-APIRequest", "true")
+		req.Header.Set("Accept", "application/json")
+	}
+	switch {
+	case s.Username != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	case s.Type == sinkNtfy && s.Token != "":
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return req, nil
+}
+
+// notifySinks sends the notifications of the run in the background. They are bounded by the timeouts of the sinks and
+// waited for before exiting, even if the run is cancelled.
+func (n *NetworkConnectionReconciler) notifySinks(ctx context.Context, run *SyncRun) {
+	var event *sinkEvent
+	logger := loggerFrom(ctx)
+	// the sinks on the host of a remote, e.g. the nextcloud ones, use its certificates and proxy
+	client := &http.Client{Transport: newHostTransport(n.config.Remotes)}
+	for i := range n.config.NotificationSinks {
+		sink := &n.config.NotificationSinks[i]
+		if !sink.matches(run) {
+			continue
+		}
+		if event == nil {
+			e := newSinkEvent(n.config, run)
+			event = &e
+		}
+		n.sinks.Add(1)
+		go func() {
+			defer n.sinks.Done()
+			if err := sink.send(context.WithoutCancel(ctx), client, *event); err != nil {
+				logger.Warn("Failed to send the notification", "sink", sink.Type, "error", err)
+				return
+			}
+			logger.Debug("Notification sent", "sink", sink.Type)
+		}()
+	}
+}
@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sinkRequest struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// newSinkServer returns a server recording the requests, and the channel they are sent to.
+func newSinkServer(t *testing.T) (*httptest.Server, chan sinkRequest) {
+	t.Helper()
+	requests := make(chan sinkRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		requests <- sinkRequest{path: r.URL.Path, header: r.Header, body: string(body)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestNotificationSink_send(t *testing.T) {
+	srv, requests := newSinkServer(t)
+	run := &SyncRun{ID: "a", Outcome: RunFailed, Remotes: []*RemoteResult{
+		{Remote: "books/", Outcome: RemoteOK, Added: []string{"books/new.epub"}},
+		{Remote: "comics/", Outcome: RemoteFailed, Error: &RemoteError{Remote: "comics/", Kind: RemoteErrorAuth,
+			ShareLink: true}},
+	}}
+	event := newSinkEvent(&Config{DeviceName: "kobo-kitchen"}, run)
+	assert.Equal(t, "Nextcloud sync failed on kobo-kitchen", event.Title)
+
+	tests := []struct {
+		name  string
+		sink  NotificationSink
+		check func(t *testing.T, r sinkRequest)
+	}{
+		{name: "webhook", sink: NotificationSink{Type: sinkWebhook, URL: srv.URL + "/hook",
+			Headers: map[string]string{"X-Api-Key": "key1"}},
+			check: func(t *testing.T, r sinkRequest) {
+				assert.Equal(t, "/hook", r.path)
+				assert.Equal(t, "key1", r.header.Get("X-Api-Key"))
+				var decoded sinkEvent
+				require.NoError(t, json.Unmarshal([]byte(r.body), &decoded))
+				assert.Equal(t, "kobo-kitchen", decoded.Device)
+				assert.Equal(t, []string{"books/new.epub"}, decoded.Run.Remotes[0].Added)
+			}},
+		{name: "webhook template", sink: NotificationSink{Type: sinkWebhook, URL: srv.URL + "/hook",
+			Template: `{"text": {{ json .Message }}, "failed": {{ eq .Run.Outcome "failed" }}}`},
+			check: func(t *testing.T, r sinkRequest) {
+				var decoded struct {
+					Text   string `json:"text"`
+					Failed bool   `json:"failed"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(r.body), &decoded))
+				assert.Equal(t, "Synced 1 files:\nRemote: books/\n  - books/new.epub\n"+
+					"Share link expired or password changed for comics/", decoded.Text)
+				assert.True(t, decoded.Failed)
+			}},
+		{name: "ntfy", sink: NotificationSink{Type: sinkNtfy, URL: srv.URL + "/my-kobo", Token: "tk_token"},
+			check: func(t *testing.T, r sinkRequest) {
+				assert.Equal(t, "/my-kobo", r.path)
+				assert.Equal(t, "Bearer tk_token", r.header.Get("Authorization"))
+				assert.Equal(t, "Nextcloud sync failed on kobo-kitchen", r.header.Get("Title"))
+				assert.Equal(t, "4", r.header.Get("Priority"))
+				assert.Contains(t, r.body, "Synced 1 files")
+			}},
+		{name: "gotify", sink: NotificationSink{Type: sinkGotify, URL: srv.URL + "/", Token: "appToken"},
+			check: func(t *testing.T, r sinkRequest) {
+				assert.Equal(t, "/message", r.path)
+				assert.Equal(t, "appToken", r.header.Get("X-Gotify-Key"))
+				assert.JSONEq(t, `{"title": "Nextcloud sync failed on kobo-kitchen", "message": `+
+					`"Synced 1 files:\nRemote: books/\n  - books/new.epub\n`+
+					`Share link expired or password changed for comics/", "priority": 8}`, r.body)
+			}},
+		{name: "nextcloud", sink: NotificationSink{Type: sinkNextcloud, URL: srv.URL, Username: "admin",
+			Password: "app-password", Recipient: "alice"},
+			check: func(t *testing.T, r sinkRequest) {
+				assert.Equal(t, "/ocs/v2.php/apps/notifications/api/v2/admin_notifications/alice", r.path)
+				assert.Equal(t, "true", r.header.Get("OCS-APIRequest"))
+				username, password, ok := (&http.Request{Header: r.header}).BasicAuth()
+				assert.True(t, ok)
+				assert.Equal(t, []string{"admin", "app-password"}, []string{username, password})
+				values, err := url.ParseQuery(r.body)
+				require.NoError(t, err)
+				assert.Equal(t, "Nextcloud sync failed on kobo-kitchen", values.Get("shortMessage"))
+				assert.Contains(t, values.Get("longMessage"), "books/new.epub")
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.sink.validateAndSetup())
+			require.NoError(t, tt.sink.send(context.Background(), http.DefaultClient, event))
+			tt.check(t, <-requests)
+		})
+	}
+}
+
+func TestNotificationSink_nextcloudShortMessage(t *testing.T) {
+	srv, requests := newSinkServer(t)
+	sink := NotificationSink{Type: sinkNextcloud, URL: srv.URL, Username: "admin", Password: "app-password",
+		Recipient: "alice"}
+	require.NoError(t, sink.validateAndSetup())
+	// 2 bytes per rune: the limit falls in the middle of the 128th one
+	title := strings.Repeat("è", 200)
+	require.NoError(t, sink.send(context.Background(), http.DefaultClient, sinkEvent{Title: title}))
+	values, err := url.ParseQuery((<-requests).body)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("è", 127), values.Get("shortMessage"))
+}
+
+func TestNotificationSink_timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	sink := NotificationSink{Type: sinkNtfy, URL: srv.URL + "/topic"}
+	require.NoError(t, sink.validateAndSetup())
+	sink.timeout = 50 * time.Millisecond
+	started := time.Now()
+	err := sink.send(context.Background(), http.DefaultClient, sinkEvent{Message: "Synced"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	}))
+	t.Cleanup(failing.Close)
+	sink = NotificationSink{Type: sinkGotify, URL: failing.URL, Token: "wrong"}
+	require.NoError(t, sink.validateAndSetup())
+	assert.ErrorContains(t, sink.send(context.Background(), http.DefaultClient, sinkEvent{}),
+		"401 Unauthorized: invalid token")
+}
+
+func TestRunSync_notifiesSinks(t *testing.T) {
+	sinkSrv, requests := newSinkServer(t)
+	srv := newWebDAVServer(t, map[string]string{"book1.epub": "book1"})
+	n := newTestReconciler(t, srv)
+	n.config.DeviceName = "kobo"
+	n.config.NotificationSinks = []NotificationSink{
+		{Type: sinkWebhook, URL: sinkSrv.URL + "/changes"},
+		{Type: sinkWebhook, URL: sinkSrv.URL + "/failures", On: sinkOnFailures},
+		{Type: sinkWebhook, URL: sinkSrv.URL + "/always", On: sinkOnAlways},
+	}
+	for i := range n.config.NotificationSinks {
+		require.NoError(t, n.config.NotificationSinks[i].validateAndSetup())
+	}
+
+	n.runSync(context.Background())
+	n.sinks.Wait()
+	// nothing changes in the second run
+	n.runSync(context.Background())
+	n.sinks.Wait()
+	close(requests)
+	var paths []string
+	for r := range requests {
+		paths = append(paths, r.path)
+		if r.path == "/changes" {
+			var event sinkEvent
+			require.NoError(t, json.Unmarshal([]byte(r.body), &event))
+			assert.Equal(t, "Nextcloud sync completed on kobo", event.Title)
+			assert.Contains(t, event.Message, "Synced 1 files")
+		}
+	}
+	assert.ElementsMatch(t, []string{"/changes", "/always", "/always"}, paths)
+}
+
+func TestNotifySinks_remoteTransport(t *testing.T) {
+	requests := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+	}))
+	t.Cleanup(srv.Close)
+	n := newTestReconciler(t)
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	remote := Remote{URL: srv.URL + "/s/token", LocalPath: "books", PinnedFingerprint: hex.EncodeToString(sum[:])}
+	require.NoError(t, remote.validateAndSetup(n.config.basePath))
+	n.config.Remotes = []Remote{remote}
+	n.config.NotificationSinks = []NotificationSink{{Type: sinkNextcloud, URL: srv.URL, Username: "admin",
+		Password: "app-password", Recipient: "reader", On: sinkOnAlways}}
+	require.NoError(t, n.config.NotificationSinks[0].validateAndSetup())
+
+	// the nextcloud sink on the host of the remote trusts its pinned certificate
+	n.notifySinks(context.Background(), &SyncRun{ID: "a", Outcome: RunCompleted})
+	n.sinks.Wait()
+	close(requests)
+	assert.Equal(t, "/ocs/v2.php/apps/notifications/api/v2/admin_notifications/reader", <-requests)
+}
+
+func TestNotificationSink_validateAndSetup(t *testing.T) {
+	tests := []struct {
+		name   string
+		sink   NotificationSink
+		errMsg string
+	}{
+		{name: "ntfy", sink: NotificationSink{Type: sinkNtfy, URL: "https://ntfy.sh/kobo"}},
+		{name: "unknown type", sink: NotificationSink{Type: "email", URL: "https://example.com"},
+			errMsg: "type must be one of"},
+		{name: "invalid url", sink: NotificationSink{Type: sinkNtfy, URL: "ntfy.sh/kobo"}, errMsg: "invalid"},
+		{name: "unknown on", sink: NotificationSink{Type: sinkNtfy, URL: "https://ntfy.sh/kobo", On: "never"},
+			errMsg: "on must be one of"},
+		{name: "gotify without token", sink: NotificationSink{Type: sinkGotify, URL: "https://gotify.example.com"},
+			errMsg: "require a token"},
+		{name: "nextcloud without password", sink: NotificationSink{Type: sinkNextcloud,
+			URL: "https://cloud.example.com", Username: "admin"}, errMsg: "require a username and an app password"},
+		{name: "template of ntfy", sink: NotificationSink{Type: sinkNtfy, URL: "https://ntfy.sh/kobo",
+			Template: "{{ .Title }}"}, errMsg: "only supported by the webhook"},
+		{name: "invalid template", sink: NotificationSink{Type: sinkWebhook, URL: "https://example.com",
+			Template: "{{ .Title "}, errMsg: "invalid notification_sinks template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sink.validateAndSetup()
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, sinkOnChanges, tt.sink.On)
+			assert.Equal(t, defaultSinkTimeoutSeconds*time.Second, tt.sink.timeout)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v55/github"
+)
+
+const (
+	updateSourceGitHub   = "github"
+	updateSourceGitea    = "gitea"
+	updateSourceManifest = "manifest"
+	// maxReleasesListSize limits the size of the release lists and manifests
+	maxReleasesListSize = 4 << 20
+)
+
+// release is a release published by an update source.
+type release struct {
+	Tag        string
+	Prerelease bool
+	Draft      bool
+	Assets     []*releaseAsset
+}
+
+type releaseAsset struct {
+	Name string
+	URL  string
+	Size int64
+}
+
+// updateSource lists the releases available for the updates.
+type updateSource interface {
+	// Releases returns the most recent releases, in any order.
+	Releases(ctx context.Context) ([]*release, error)
+}
+
+func newUpdateSource(config *Config, httpClient *http.Client) (updateSource, error) {
+	switch config.UpdateSource {
+	case updateSourceGitHub:
+		client := github.NewClient(httpClient)
+		if config.UpdateURL != "" {
+			baseURL, err := url.Parse(strings.TrimSuffix(config.UpdateURL, "/") + "/")
+			if err != nil {
+				return nil, fmt.Errorf("invalid update_url: %w", err)
+			}
+			client.BaseURL = baseURL
+		}
+		return &githubSource{client: client, owner: config.RepoOwner, repo: config.RepoName}, nil
+	case updateSourceGitea:
+		return &giteaSource{baseURL: strings.TrimSuffix(config.UpdateURL, "/"), owner: config.RepoOwner,
+			repo: config.RepoName, httpClient: httpClient}, nil
+	case updateSourceManifest:
+		return &manifestSource{url: config.UpdateURL, httpClient: httpClient}, nil
+	}
+	return nil, fmt.Errorf("unknown update_source %q", config.UpdateSource)
+}
+
+// githubSource lists the releases of a GitHub repository, or of a GitHub Enterprise one with a custom API URL.
+type githubSource struct {
+	client *github.Client
+	owner  string
+	repo   string
+}
+
+func (s *githubSource) Releases(ctx context.Context) ([]*release, error) {
+	ghReleases, _, err := s.client.Repositories.ListReleases(ctx, s.owner, s.repo,
+		&github.ListOptions{PerPage: maxListedReleases})
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]*release, 0, len(ghReleases))
+	for _, r := range ghReleases {
+		rel := &release{Tag: r.GetTagName(), Prerelease: r.GetPrerelease(), Draft: r.GetDraft()}
+		for _, asset := range r.Assets {
+			rel.Assets = append(rel.Assets, &releaseAsset{
+				Name: asset.GetName(), URL: asset.GetBrowserDownloadURL(), Size: int64(asset.GetSize()),
+			})
+		}
+		releases = append(releases, rel)
+	}
+	return releases, nil
+}
+
+// giteaSource lists the releases of a Gitea or Forgejo repository.
+type giteaSource struct {
+	// baseURL is the URL of the Gitea server, e.g. https://codeberg.org
+	baseURL    string
+	owner      string
+	repo       string
+	httpClient *http.Client
+}
+
+type giteaRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name               string `json:"name"`
+		Size               int64  `json:"size"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (s *giteaSource) Releases(ctx context.Context) ([]*release, error) {
+	releasesURL := fmt.Sprintf("%s/api/v1/repos/%s/%s/releases?limit=%d", s.baseURL,
+		url.PathEscape(s.owner), url.PathEscape(s.repo), maxListedReleases)
+	var giteaReleases []giteaRelease
+	if err := getJSON(ctx, s.httpClient, releasesURL, &giteaReleases); err != nil {
+		return nil, err
+	}
+	releases := make([]*release, 0, len(giteaReleases))
+	for _, r := range giteaReleases {
+		rel := &release{Tag: r.TagName, Prerelease: r.Prerelease, Draft: r.Draft}
+		for _, asset := range r.Assets {
+			rel.Assets = append(rel.Assets, &releaseAsset{Name: asset.Name, URL: asset.BrowserDownloadURL, Size: asset.Size})
+		}
+		releases = append(releases, rel)
+	}
+	return releases, nil
+}
+
+// manifestSource reads the releases from a JSON manifest served over HTTP, e.g. by a Nextcloud public share or a
+// local web server. The asset URLs can be relative to the manifest URL. The manifest looks like:
+//
+//	{"releases": [
+//	  {"version": "v1.2.0", "prerelease": false, "assets": [{"name": "KoboRoot.tgz", "url": "KoboRoot.tgz"}]}
+//	]}
+type manifestSource struct {
+	url        string
+	httpClient *http.Client
+}
+
+type manifest struct {
+	Releases []struct {
+		Version    string `json:"version"`
+		Prerelease bool   `json:"prerelease,omitempty"`
+		Assets     []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+			Size int64  `json:"size,omitempty"`
+		} `json:"assets"`
+	} `json:"releases"`
+}
+
+func (s *manifestSource) Releases(ctx context.Context) ([]*release, error) {
+	manifestURL, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err = getJSON(ctx, s.httpClient, s.url, m); err != nil {
+		return nil, err
+	}
+	releases := make([]*release, 0, len(m.Releases))
+	for _, r := range m.Releases {
+		rel := &release{Tag: r.Version, Prerelease: r.Prerelease}
+		for _, asset := range r.Assets {
+			assetURL, err := manifestURL.Parse(asset.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL for asset %s of release %s: %w", asset.Name, r.Version, err)
+			}
+			rel.Assets = append(rel.Assets, &releaseAsset{Name: asset.Name, URL: assetURL.String(), Size: asset.Size})
+		}
+		releases = append(releases, rel)
+	}
+	return releases, nil
+}
+
+// getJSON decodes the JSON document at url into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	if err = json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxReleasesListSize)).Decode(v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", url, err)
+	}
+	return nil
+}
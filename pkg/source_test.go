@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateSources(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/api/v1/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "50", r.URL.Query().Get("limit"))
+		//nolint:errcheck
+		w.Write([]byte(`[
+			{"tag_name": "v1.2.0-rc.1", "prerelease": true, "assets": []},
+			{"tag_name": "v1.1.0", "assets": [
+				{"name": "KoboRoot.tgz", "size": 42, "browser_download_url": "` + srv.URL + `/download/KoboRoot.tgz"}
+			]}
+		]`))
+	})
+	mux.HandleFunc("/updates/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		w.Write([]byte(`{"releases": [
+			{"version": "v1.1.0", "assets": [
+				{"name": "KoboRoot.tgz", "url": "v1.1.0/KoboRoot.tgz", "size": 42},
+				{"name": "SHA256SUMS", "url": "https://example.com/SHA256SUMS"}
+			]}
+		]}`))
+	})
+
+	tests := []struct {
+		name     string
+		config   *Config
+		expected []*release
+		errMsg   string
+	}{
+		{
+			name:   "gitea",
+			config: &Config{UpdateSource: updateSourceGitea, UpdateURL: srv.URL + "/", RepoOwner: "owner", RepoName: "repo"},
+			expected: []*release{
+				{Tag: "v1.2.0-rc.1", Prerelease: true},
+				{Tag: "v1.1.0", Assets: []*releaseAsset{
+					{Name: "KoboRoot.tgz", URL: srv.URL + "/download/KoboRoot.tgz", Size: 42},
+				}},
+			},
+		},
+		{
+			name:   "manifest",
+			config: &Config{UpdateSource: updateSourceManifest, UpdateURL: srv.URL + "/updates/manifest.json"},
+			expected: []*release{
+				{Tag: "v1.1.0", Assets: []*releaseAsset{
+					{Name: "KoboRoot.tgz", URL: srv.URL + "/updates/v1.1.0/KoboRoot.tgz", Size: 42},
+					{Name: "SHA256SUMS", URL: "https://example.com/SHA256SUMS"},
+				}},
+			},
+		},
+		{
+			name:   "missing manifest",
+			config: &Config{UpdateSource: updateSourceManifest, UpdateURL: srv.URL + "/manifest.json"},
+			errMsg: "404 Not Found",
+		},
+		{
+			name:   "unknown source",
+			config: &Config{UpdateSource: "gitlab"},
+			errMsg: `unknown update_source "gitlab"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := newUpdateSource(tt.config, srv.Client())
+			if err == nil {
+				var releases []*release
+				releases, err = source.Releases(context.Background())
+				if tt.errMsg == "" {
+					require.NoError(t, err)
+					assert.Equal(t, tt.expected, releases)
+					return
+				}
+			}
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestUpdater_installFromManifest(t *testing.T) {
+	signer := newTestSigner(t)
+	tarball := makeTarball(t, map[string]string{"usr/local/nextcloud-kobo/nextcloud-kobo": "binary"})
+	release := newSignedRelease(signer, "v1.1.0", tarball)
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		w.Write([]byte(`{"releases": [{"version": "v1.1.0", "assets": [
+			{"name": "KoboRoot.tgz", "url": "KoboRoot.tgz"},
+			{"name": "SHA256SUMS", "url": "SHA256SUMS"},
+			{"name": "SHA256SUMS.minisig", "url": "SHA256SUMS.minisig"}
+		]}]}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		w.Write(release.assets[r.URL.Path[1:]])
+	})
+
+	u, err := newUpdater(&Config{configPath: t.TempDir(), UpdateSource: updateSourceManifest,
+		UpdateURL: srv.URL + "/manifest.json", UpdateAsset: defaultUpdateAsset, MaxUpdateSizeMB: 1,
+		UpdateChannel: updateChannelStable})
+	require.NoError(t, err)
+	u.publicKey = signer.PublicKey()
+	releases, err := u.source.Releases(context.Background())
+	require.NoError(t, err)
+	selected, err := u.selectUpdate("v1.0.0", releases)
+	require.NoError(t, err)
+	require.NotNil(t, selected)
+	assert.NoError(t, u.install(context.Background(), selected))
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type SyncState string
+
+const (
+	StateIdle            SyncState = "idle"
+	StateCheckingNetwork SyncState = "checking_network"
+	StateSyncing         SyncState = "syncing"
+	StateUpdating        SyncState = "updating"
+	StateCancelling      SyncState = "cancelling"
+)
+
+// maxTransitions is the number of transitions kept in memory for status queries
+const maxTransitions = 32
+
+type StateTransition struct {
+	From SyncState `json:"from"`
+	To   SyncState `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// SyncStatus is a snapshot of the syncStateMachine.
+type SyncStatus struct {
+	State SyncState `json:"state"`
+	Since time.Time `json:"since"`
+	// Pending is true when a trigger was received during a run and a follow-up run is scheduled
+	Pending bool `json:"pending"`
+	// Runs is the number of runs started since the daemon started
+	Runs        int               `json:"runs"`
+	Transitions []StateTransition `json:"transitions"`
+	// LastRun is the record of the last completed run
+	LastRun *SyncRun `json:"last_run,omitempty"`
+}
+
+// syncStateMachine serializes the sync runs. A trigger received while idle starts a run; triggers received while a
+// run is in progress are coalesced into at most one follow-up run, that starts as soon as the current one completes.
+type syncStateMachine struct {
+	run func(ctx context.Context)
+
+	mu          sync.Mutex
+	state       SyncState
+	since       time.Time
+	pending     bool
+	runs        int
+	transitions []StateTransition
+	lastRun     *SyncRun
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func newSyncStateMachine(run func(ctx context.Context)) *syncStateMachine {
+	done := make(chan struct{})
+	close(done)
+	return &syncStateMachine{
+		run:   run,
+		state: StateIdle,
+		since: time.Now(),
+		done:  done,
+	}
+}
+
+// Trigger starts a run if the state machine is idle, or schedules a follow-up run otherwise.
+// It returns true if a new run was started.
+func (m *syncStateMachine) Trigger(ctx context.Context) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.state {
+	case StateIdle:
+		m.start(ctx)
+		return true
+	case StateCancelling:
+		slog.Info("Sync is being cancelled, ignoring trigger")
+	default:
+		if !m.pending {
+			slog.Info("Sync already in progress, scheduling a follow-up run", "state", m.state)
+		}
+		m.pending = true
+	}
+	return false
+}
+
+// Cancel stops the current run, if any, and drops the pending follow-up run.
+func (m *syncStateMachine) Cancel() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = false
+	if m.state == StateIdle || m.state == StateCancelling {
+		return
+	}
+	m.transitionLocked(StateCancelling)
+	m.cancel()
+}
+
+// Wait blocks until the state machine goes back to idle.
+func (m *syncStateMachine) Wait() {
+	m.mu.Lock()
+	done := m.done
+	m.mu.Unlock()
+	<-done
+}
+
+// Transition moves the state machine to the given state. It is meant to be called by the run function to report its
+// progress; transitions are ignored if the machine is idle or the run is being cancelled.
+func (m *syncStateMachine) Transition(to SyncState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateIdle || m.state == StateCancelling || to == StateIdle || to == StateCancelling {
+		return
+	}
+	m.transitionLocked(to)
+}
+
+// SetLastRun records the last completed run.
+func (m *syncStateMachine) SetLastRun(run *SyncRun) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRun = run
+}
+
+func (m *syncStateMachine) Status() SyncStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return SyncStatus{
+		State:       m.state,
+		Since:       m.since,
+		Pending:     m.pending,
+		Runs:        m.runs,
+		Transitions: append([]StateTransition(nil), m.transitions...),
+		LastRun:     m.lastRun,
+	}
+}
+
+// start must be called with the lock held.
+func (m *syncStateMachine) start(ctx context.Context) {
+	runCtx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	m.runs++
+	m.transitionLocked(StateCheckingNetwork)
+	go m.loop(ctx, runCtx, m.done)
+}
+
+func (m *syncStateMachine) loop(ctx, runCtx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		m.run(runCtx)
+		m.mu.Lock()
+		m.cancel()
+		if !m.pending || ctx.Err() != nil {
+			m.pending = false
+			m.transitionLocked(StateIdle)
+			m.mu.Unlock()
+			return
+		}
+		slog.Info("Starting the follow-up sync run")
+		m.pending = false
+		m.runs++
+		runCtx, m.cancel = context.WithCancel(withTrigger(ctx, TriggerFollowUp))
+		m.transitionLocked(StateCheckingNetwork)
+		m.mu.Unlock()
+	}
+}
+
+// transitionLocked must be called with the lock held.
+func (m *syncStateMachine) transitionLocked(to SyncState) {
+	if m.state == to {
+		return
+	}
+	t := StateTransition{From: m.state, To: to, At: time.Now()}
+	slog.Debug("State transition", "from", t.From, "to", t.To)
+	m.state, m.since = to, t.At
+	m.transitions = append(m.transitions, t)
+	if len(m.transitions) > maxTransitions {
+		m.transitions = m.transitions[len(m.transitions)-maxTransitions:]
+	}
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncStateMachine_CoalescesTriggers(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	var m *syncStateMachine
+	m = newSyncStateMachine(func(ctx context.Context) {
+		runs.Add(1)
+		m.Transition(StateSyncing)
+		<-release
+	})
+	ctx := context.Background()
+
+	assert.True(t, m.Trigger(ctx))
+	require.Eventually(t, func() bool { return m.Status().State == StateSyncing }, time.Second, time.Millisecond)
+
+	// triggers received during the run are coalesced into one follow-up run
+	for i := 0; i < 5; i++ {
+		assert.False(t, m.Trigger(ctx))
+	}
+	assert.True(t, m.Status().Pending)
+
+	release <- struct{}{}
+	require.Eventually(t, func() bool { return runs.Load() == 2 }, time.Second, time.Millisecond)
+	assert.False(t, m.Status().Pending)
+	release <- struct{}{}
+	m.Wait()
+
+	status := m.Status()
+	assert.Equal(t, StateIdle, status.State)
+	assert.Equal(t, 2, status.Runs)
+	assert.Equal(t, int32(2), runs.Load())
+	assert.Equal(t, []SyncState{StateCheckingNetwork, StateSyncing, StateCheckingNetwork, StateSyncing, StateIdle},
+		transitionTargets(status.Transitions))
+}
+
+func TestSyncStateMachine_Cancel(t *testing.T) {
+	started := make(chan struct{})
+	var m *syncStateMachine
+	m = newSyncStateMachine(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		// transitions reported while cancelling are ignored
+		m.Transition(StateUpdating)
+	})
+
+	m.Trigger(context.Background())
+	<-started
+	m.Trigger(context.Background())
+	m.Cancel()
+	assert.Equal(t, StateCancelling, m.Status().State)
+	assert.False(t, m.Trigger(context.Background()))
+	m.Wait()
+
+	status := m.Status()
+	assert.Equal(t, StateIdle, status.State)
+	assert.Equal(t, 1, status.Runs)
+	assert.Equal(t, []SyncState{StateCheckingNetwork, StateCancelling, StateIdle}, transitionTargets(status.Transitions))
+}
+
+func TestSyncStateMachine_ParentContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs atomic.Int32
+	m := newSyncStateMachine(func(runCtx context.Context) {
+		runs.Add(1)
+		cancel()
+		<-runCtx.Done()
+	})
+	m.Trigger(ctx)
+	m.Trigger(ctx)
+	m.Wait()
+	// the follow-up run is dropped when the parent context is done
+	assert.Equal(t, int32(1), runs.Load())
+	assert.Equal(t, StateIdle, m.Status().State)
+}
+
+func transitionTargets(transitions []StateTransition) (states []SyncState) {
+	for _, t := range transitions {
+		states = append(states, t.To)
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// exitCodeInstallationChanged is returned by -prestart when it applied or rolled back an update
+	exitCodeInstallationChanged = 3
+	// daemonStopTimeout is the time the daemon has to exit after SIGTERM before being killed
+	daemonStopTimeout = 30 * time.Second
+	// stableDaemonRun is the time after which a daemon that exits is not considered crash looping anymore
+	stableDaemonRun = 5 * time.Minute
+)
+
+// SupervisorOptions are the options of the supervisor mode.
+type SupervisorOptions struct {
+	ConfigFilePath string
+	BasePath       string
+	// Executable is the binary the daemon is run with, and BackupExecutable the one of the previous installation,
+	// that applies the updates or rolls them back when the installed binary cannot do it.
+	Executable       string
+	BackupExecutable string
+	// Sync syncs at the first start of the daemon
+	Sync bool
+	// Output receives the output of the daemon and of the prestart steps
+	Output io.Writer
+}
+
+// supervisor runs the daemon in a loop, applying the updates before every start and delaying the restarts after
+// the crashes.
+type supervisor struct {
+	options SupervisorOptions
+	backoff backoff
+	// stableAfter is the run time after which the crashes of the daemon are not counted as a loop anymore
+	stableAfter time.Duration
+	// lockPollInterval is how often the lock of the daemon is checked while another process holds it
+	lockPollInterval time.Duration
+	// run runs the binary with the arguments until it exits or the context is done, returning its exit code
+	run func(ctx context.Context, binary string, args ...string) (int, error)
+}
+
+// Supervise runs the prestart step and the daemon until the context is done, restarting the daemon when it exits, and
+// at once when restart receives. It returns true if the installation changed, so that the supervisor is restarted
+// with the new binary.
+func Supervise(ctx context.Context, restart <-chan struct{}, options SupervisorOptions) bool {
+	s := &supervisor{
+		options:          options,
+		backoff:          backoff{initial: time.Second, max: stableDaemonRun},
+		stableAfter:      stableDaemonRun,
+		lockPollInterval: lockPollInterval,
+	}
+	s.run = s.runProcess
+	return s.supervise(ctx, restart)
+}
+
+func (s *supervisor) supervise(ctx context.Context, restart <-chan struct{}) bool {
+	applyUpdate, sync, crashes := true, s.options.Sync, 0
+	for {
+		if s.prestart(ctx, applyUpdate) {
+			slog.Info("The installation changed, restarting the supervisor")
+			return true
+		}
+		args := []string{"-config-file", s.options.ConfigFilePath, "-base-path", s.options.BasePath, "daemon"}
+		if sync {
+			args = append(args, "-sync")
+		}
+		started := time.Now()
+		code, restarted, err := s.runDaemon(ctx, restart, args)
+		if ctx.Err() != nil {
+			return false
+		}
+		// a daemon that could not lock its instance did not sync yet
+		applyUpdate, sync = code == ExitCodeApplyUpdate, sync && code == ExitCodeAlreadyRunning
+		switch {
+		case restarted:
+			slog.Info("Daemon restarted")
+			continue
+		case applyUpdate:
+			slog.Info("Applying the update")
+			continue
+		case code == ExitCodeAlreadyRunning:
+			// not a crash: a sync, or a daemon started by hand, holds the lock
+			if !s.waitDaemonLock(ctx, restart) {
+				return false
+			}
+			continue
+		case time.Since(started) >= s.stableAfter:
+			crashes = 1
+		default:
+			crashes++
+		}
+		delay := s.backoff.delay(crashes, 0)
+		slog.Warn("Daemon exited, restarting", "code", code, "error", err, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-restart:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// waitDaemonLock waits for the lock of the daemon to be released, or for restart to receive. It returns false if the
+// context is done first.
+func (s *supervisor) waitDaemonLock(ctx context.Context, restart <-chan struct{}) bool {
+	configPath, waiting := filepath.Dir(s.options.ConfigFilePath), false
+	for {
+		pid, holder, err := RunningInstance(configPath, InstanceDaemon)
+		if err != nil {
+			if !errors.Is(err, ErrNotRunning) {
+				slog.Warn("Failed to check the lock of the daemon", "error", err)
+			}
+			return true
+		}
+		if !waiting {
+			slog.Info("Another process holds the lock of the daemon, waiting for it to exit", "pid", pid,
+				"holder", holder)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-restart:
+			return true
+		case <-time.After(s.lockPollInterval):
+		}
+	}
+}
+
+// runDaemon runs the daemon until it exits or restart receives. restarted is true in the latter case.
+func (s *supervisor) runDaemon(ctx context.Context, restart <-chan struct{}, args []string) (
+	code int, restarted bool, err error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-restart:
+			cancel()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	code, err = s.run(runCtx, s.options.Executable, args...)
+	close(done)
+	return code, <-interrupted, err
+}
+
+// prestart applies the pending update, or counts the failed starts of the last one, with the installed binary or, if
+// it cannot run, with the backup one. It returns true if the installation changed.
+func (s *supervisor) prestart(ctx context.Context, applyUpdate bool) bool {
+	args := []string{"-config-file", s.options.ConfigFilePath, "-prestart",
+		"-apply-update=" + strconv.FormatBool(applyUpdate)}
+	code, err := s.run(ctx, s.options.Executable, args...)
+	if code != 0 && code != exitCodeInstallationChanged && s.options.BackupExecutable != "" {
+		if _, statErr := os.Stat(s.options.BackupExecutable); statErr == nil {
+			slog.Warn("Prestart failed, retrying with the backup binary", "code", code, "error", err)
+			code, err = s.run(ctx, s.options.BackupExecutable, args...)
+		}
+	}
+	if err != nil || (code != 0 && code != exitCodeInstallationChanged) {
+		slog.Error("Prestart failed", "code", code, "error", err)
+	}
+	return code == exitCodeInstallationChanged
+}
+
+// runProcess runs the binary, stopping it with SIGTERM, and then with SIGKILL after daemonStopTimeout, when the
+// context is done.
+func (s *supervisor) runProcess(ctx context.Context, binary string, args ...string) (int, error) {
+	//nolint:gosec
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout, cmd.Stderr = s.options.Output, s.options.Output
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = daemonStopTimeout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
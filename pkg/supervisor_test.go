@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProcesses replies to the runs of the supervisor with the exit codes of the script, in order. A negative code
+// blocks until the run is cancelled.
+type fakeProcesses struct {
+	mu     sync.Mutex
+	script []int
+	calls  []string
+	// started receives the blocking runs
+	started chan struct{}
+}
+
+func (f *fakeProcesses) run(ctx context.Context, binary string, args ...string) (int, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, binary+" "+strings.Join(args[2:], " "))
+	code := f.script[0]
+	f.script = f.script[1:]
+	f.mu.Unlock()
+	if code < 0 {
+		f.started <- struct{}{}
+		<-ctx.Done()
+		return 0, nil
+	}
+	return code, nil
+}
+
+func TestSupervisor(t *testing.T) {
+	processes := &fakeProcesses{started: make(chan struct{}, 1), script: []int{
+		0, ExitCodeApplyUpdate, // the daemon downloads an update
+		0, 1, // then it crashes
+		1, 0, -1, // the prestart of the installed binary fails, and the daemon is restarted
+		exitCodeInstallationChanged,
+	}}
+	s := &supervisor{
+		options: SupervisorOptions{ConfigFilePath: "config.yaml", BasePath: "/books", Executable: "bin",
+			BackupExecutable: "supervisor_test.go", Sync: true},
+		backoff:     backoff{initial: time.Millisecond, max: 10 * time.Millisecond},
+		stableAfter: time.Minute,
+		run:         processes.run,
+	}
+	restarts := make(chan struct{})
+	go func() {
+		<-processes.started
+		restarts <- struct{}{}
+	}()
+	assert.True(t, s.supervise(context.Background(), restarts))
+	assert.Equal(t, []string{
+		"bin -prestart -apply-update=true",
+		"bin -base-path /books daemon -sync",
+		"bin -prestart -apply-update=true",
+		"bin -base-path /books daemon",
+		"bin -prestart -apply-update=false",
+		"supervisor_test.go -prestart -apply-update=false",
+		"bin -base-path /books daemon",
+		"bin -prestart -apply-update=false",
+	}, processes.calls)
+}
+
+func TestSupervisor_stop(t *testing.T) {
+	processes := &fakeProcesses{started: make(chan struct{}, 1), script: []int{0, -1}}
+	s := &supervisor{options: SupervisorOptions{Executable: "bin"}, backoff: backoff{initial: time.Hour,
+		max: time.Hour}, run: processes.run}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-processes.started
+		cancel()
+	}()
+	assert.False(t, s.supervise(ctx, nil))
+	assert.Len(t, processes.calls, 2)
+}
+
+func TestSupervisor_daemonLocked(t *testing.T) {
+	configPath := t.TempDir()
+	lock, err := LockInstance(configPath, InstanceDaemon, "sync")
+	require.NoError(t, err)
+	processes := &fakeProcesses{started: make(chan struct{}, 1), script: []int{0, ExitCodeAlreadyRunning, 0, -1}}
+	// the daemon is not restarted with the backoff of the crashes, but as soon as the lock is released
+	s := &supervisor{options: SupervisorOptions{ConfigFilePath: filepath.Join(configPath, "config.yaml"),
+		BasePath: "/books", Executable: "bin", Sync: true}, backoff: backoff{initial: time.Hour, max: time.Hour},
+		lockPollInterval: 10 * time.Millisecond, run: processes.run}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//nolint:errcheck
+		lock.Release()
+		<-processes.started
+		cancel()
+	}()
+	assert.False(t, s.supervise(ctx, nil))
+	assert.Equal(t, []string{
+		"bin -prestart -apply-update=true",
+		"bin -base-path /books daemon -sync",
+		"bin -prestart -apply-update=false",
+		"bin -base-path /books daemon -sync",
+	}, processes.calls)
+}
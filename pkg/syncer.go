@@ -5,227 +5,138 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
 	"path"
-	"time"
-
-	"github.com/google/go-github/v55/github"
+	"slices"
+	"strings"
 
 	"github.com/studio-b12/gowebdav"
 )
 
-func (n *NetworkConnectionReconciler) sync(ctx context.Context) {
-	var (
-		filesMap      map[string][]string
-		nUpdatedFiles int
-		err           error
-	)
-	checkNetworkCtx, cancel := context.WithTimeout(ctx, time.Minute)
-	defer cancel()
-	if err = checkNetwork(checkNetworkCtx); err != nil {
-		log.Println("Network connection failed", err)
-		if !errors.Is(err, networkConnectionFailedErr) {
-			n.toastsChan <- fmt.Sprintf("Failed to sync: %s\n%s", err.Error(), generateFilesString(filesMap))
-		}
+// sync checks the profile, the network and the battery, then syncs the remotes of the profile, recording what
+// happened in run.
+func (n *NetworkConnectionReconciler) sync(ctx context.Context, profile *Profile, run *SyncRun) {
+	logger := loggerFrom(ctx)
+	// a disabled profile does not even probe the network
+	if profile != nil && profile.Disabled {
+		logger.Info("Sync disabled by profile", "profile", profile.Name)
+		run.skip(RunSkipped, fmt.Sprintf("disabled by profile %s", profile.Name))
+		n.toast(ctx, n.config.text(msgSyncDisabled, msgData{"Profile": profile.Name}))
 		return
 	}
-	n.toastsChan <- "Syncing with Nextcloud..."
-	filesMap, err = n.syncRemotes(ctx)
-	if err != nil {
-		log.Println("An error occurred during synchronization", err)
-	}
-	for _, files := range filesMap {
-		nUpdatedFiles += len(files)
-	}
-	if nUpdatedFiles > 0 {
-		n.toastsChan <- fmt.Sprintf("Synced %d files:\n%s", nUpdatedFiles, generateFilesString(filesMap))
-	} else {
-		n.toastsChan <- "No files updated"
-		log.Println("No files updated")
-	}
-	log.Println("Sync successful")
-	n.rescanBooks()
-}
-
-func (n *NetworkConnectionReconciler) syncRemotes(ctx context.Context) (updatedFiles map[string][]string, err error) {
-	updatedFiles = make(map[string][]string)
-	log.Println("Running sync")
-	for _, r := range n.config.Remotes {
-		if err = ctx.Err(); err != nil {
-			log.Println("The context has been canceled. Interrupting...")
-			err = ctx.Err()
-			return
+	n.state.Transition(StateCheckingNetwork)
+	probe := &n.config.ConnectivityProbe
+	if err := probe.checkNetwork(ctx, probe.targets(profile.selectRemotes(n.config.Remotes))); err != nil {
+		logger.Warn("Network connection failed", "error", err)
+		run.skip(RunSkipped, err.Error())
+		switch {
+		case errors.Is(err, errCaptivePortal):
+			n.toast(ctx, n.config.text(msgCaptivePortal, nil))
+		case ctx.Err() != nil:
+			run.skip(RunCancelled, err.Error())
+		case !errors.Is(err, networkConnectionFailedErr):
+			n.toast(ctx, n.config.text(msgSyncFailed, msgData{"Error": err.Error()}))
 		}
-		client := gowebdav.NewClient(r.remoteURL.String(), r.Username, r.Password)
-		// 10 Mb/s * 4 min * 60 s/min * 1/8 B/b = 300 MB per file/book max with a 10 Mbps connection(?)
-		client.SetTimeout(time.Minute * 4)
-		updatedFiles[r.String()], err = n.syncFolder(client, ctx, r.RemoteFolder, r.LocalPath)
-		if err != nil {
-			log.Println("error syncing folder", r.String(), err)
-			return updatedFiles, fmt.Errorf("error syncing folder %s: %s", r.String(), err)
-		}
-		log.Println("Synced remote", r.String())
-	}
-	return
-}
-
-func (n *NetworkConnectionReconciler) syncFolder(client *gowebdav.Client, ctx context.Context, remotePath, localPath string) (updatedFiles []string, err error) {
-	var remoteFiles []os.FileInfo
-	updatedFiles = []string{}
-	remoteFiles, err = client.ReadDir(remotePath)
-	if err != nil {
 		return
 	}
-
-	if ensureDirExists(localPath) != nil {
+	power := n.evaluatePowerPolicy()
+	if power.Skip {
+		logger.Info("Skipping sync", "reason", power.Reason)
+		run.skip(RunSkipped, power.Reason)
+		n.toast(ctx, n.config.text(msgSyncSkipped, msgData{"Reason": power.Reason}))
 		return
 	}
-	localFileMap := make(map[string]string)
-	for _, file := range remoteFiles {
-		if ctx.Err() != nil {
-			log.Println("The context has been canceled. Interrupting...")
-			err = ctx.Err()
-			return
-		}
-		remoteFilePath := path.Join(remotePath, file.Name())
-		localFilePath := path.Join(localPath, file.Name())
-		log.Println("Checking file", remoteFilePath, localFilePath)
-		if file.IsDir() {
-			log.Println(remoteFilePath, "is a dir. Executing recursion...", localFilePath)
-			if ensureDirExists(localFilePath) != nil {
-				return
-			}
-			var updatedFilesRec []string
-			localFileMap[localFilePath] = localFilePath
-			updatedFilesRec, err = n.syncFolder(client, ctx, remoteFilePath, localFilePath)
-			updatedFiles = append(updatedFiles, updatedFilesRec...)
-			if err != nil {
-				return
-			}
-		} else {
-			localFileMap[localFilePath] = localFilePath
-			if shouldDownloadFile(localFilePath, file.ModTime(), file.Size()) {
-				if err = downloadFile(client, remoteFilePath, localFilePath); err != nil {
-					return
-				}
-				updatedFiles = append(updatedFiles, localFilePath)
-				n.toastsChan <- fmt.Sprintf("Downloaded %s", remoteFilePath)
-			} else {
-				log.Println("Skipping file", remoteFilePath)
-			}
-		}
+	n.state.Transition(StateSyncing)
+	syncing := msgData{"Profile": ""}
+	if profile != nil {
+		syncing["Profile"] = profile.Name
 	}
-	err = removeRemotelyDeletedFiles(localFileMap, localPath)
-	return updatedFiles, err
-}
-
-func (n *NetworkConnectionReconciler) updateNow() {
-	// Check the latest version on GitHub
-	cli := github.NewClient(nil)
-	release, _, err := cli.Repositories.GetLatestRelease(context.Background(),
-		n.config.RepoOwner, n.config.RepoName)
-	// If we can't get the latest release, don't update
+	n.toast(ctx, n.config.text(msgSyncing, syncing))
+	var err error
+	run.Remotes, run.Note, err = n.syncRemotes(ctx, profile, power)
 	if err != nil {
-		log.Println("Failed to get latest release", err)
-		return
-	}
-	// get the latest updated version stored in the config
-	version, err := os.ReadFile(path.Join(n.config.configPath, "version.txt"))
-	if err != nil && !os.IsNotExist(err) {
-		log.Println("Failed to read version file", err)
-		return
-	}
-	if os.IsNotExist(err) {
-		log.Println("Version file not found, updating to latest release")
-	} else {
-		log.Println("Current version:", string(version), "Latest version:", *release.TagName)
-	}
-	if string(version) == *release.TagName {
-		log.Println("Already up to date")
-		return
-	}
-	// Download the latest release
-	asset := *release.Assets[0]
-	resp, err := http.Get(*asset.BrowserDownloadURL)
-	if err != nil {
-		log.Println("Failed to download latest release", err)
-		return
-	}
-	//nolint:errcheck
-	defer resp.Body.Close()
-
-	// Save the latest release to a file
-	file, err := os.Create(path.Join(n.config.configPath, "nextcloud-kobo.tar.gz"))
-	if err != nil {
-		log.Println("Failed to create release file", err)
+		run.skip(RunCancelled, err.Error())
+		if errors.Is(err, errSyncCancelled) {
+			n.toast(ctx, n.config.text(msgSyncCancelled, nil))
+		}
+		logger.Warn("Sync interrupted", "error", err)
 		return
 	}
-	//nolint:errcheck
-	defer file.Close()
+	run.finish()
+	n.toast(ctx, run.summary(n.config.localizer()))
+	logger.Info("Sync completed", "outcome", run.Outcome)
+}
 
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		log.Println("Failed to write release file:", err)
-		return
-	}
-	// Write the latest release to a file
-	versionFile, err := os.Create(path.Join(n.config.configPath, "version.txt"))
+// syncRemotes plans the sync of all the remotes, asks for confirmation if needed, and applies the plan, re-evaluating
+// the battery policy between remotes. A failing remote does not stop the sync of the others: the outcome of each
+// remote is reported in the results. powerNote reports the restrictions that the battery policy applied, if any: the
+// deferred files and the skipped remotes, one per line. The error is only set if the sync is cancelled by the user or
+// the context.
+func (n *NetworkConnectionReconciler) syncRemotes(ctx context.Context, profile *Profile, power powerDecision) (
+	results []*RemoteResult, powerNote string, err error) {
+	var deferred int
+	var deferredNote, skippedNote string
+	notes := func() string {
+		return strings.Join(slices.DeleteFunc([]string{deferredNote, skippedNote}, func(note string) bool {
+			return note == ""
+		}), "\n")
+	}
+	logger := loggerFrom(ctx)
+	logger.Info("Running sync")
+	plan, err := n.planSync(ctx, profile)
 	if err != nil {
-		log.Println("Failed to create version file", err)
-		return
+		return nil, "", err
 	}
-	_, err = versionFile.Write([]byte(*release.TagName))
-	if err != nil {
-		log.Println("Failed to write version file", err)
-		return
+	results = append(results, plan.Failed...)
+	switch n.confirmPlan(ctx, plan, power) {
+	case confirmAbort:
+		logger.Info("Sync cancelled by the user")
+		return results, "", errSyncCancelled
+	case confirmSkipDeletions:
+		plan.SkipDeletions = true
 	}
-	log.Println("Auto update successful")
-	n.toastsChan <- "An update for Nextcloud-Kobo is available"
-	os.Exit(0) // Exit to restart the application
-}
-
-func checkNetwork(ctx context.Context) error {
-	// Wait for the network to be fully connected
-	for i := 0; i < 10; i++ {
-		if ctx.Err() != nil {
-			return ctx.Err()
+	for i, rp := range plan.Remotes {
+		if err = ctx.Err(); err != nil {
+			logger.Info("The context has been canceled, interrupting")
+			return results, notes(), err
 		}
-		// Check if a web request to google is successful
-		client := &http.Client{
-			Timeout: 5 * time.Second,
+		if i > 0 && !power.Skip {
+			power = n.evaluatePowerPolicy()
+			if power.Skip {
+				logger.Info("Interrupting sync", "reason", power.Reason)
+				skippedNote = n.config.text(msgRemainingSkipped, msgData{"Reason": power.Reason})
+			}
 		}
-		req, err := http.NewRequestWithContext(ctx, "GET", "https://www.google.com", nil)
-		if err != nil {
-			log.Println("Fatal error", err)
-			return err
+		if power.Skip {
+			results = append(results, &RemoteResult{Remote: rp.remote.configuredLocalPath, Outcome: RemoteSkipped})
+			continue
 		}
-		resp, err := client.Do(req)
-		if err == nil && resp.StatusCode == 200 {
-			log.Printf("HTTP request #%d/10 successful\n", i+1)
-			//nolint:errcheck
-			resp.Body.Close()
-			return nil
+		result, applyErr := n.applyRemotePlan(ctx, rp, &power, plan.SkipDeletions)
+		if power.Deferred > 0 {
+			deferred += power.Deferred
+			deferredNote = n.config.text(msgFilesDeferred, msgData{"Count": deferred, "Reason": power.Reason})
 		}
-		log.Printf("HTTP request #%d/10 failed: %v\n", i+1, err)
-		time.Sleep(time.Second)
-	}
-	return fmt.Errorf("network connection failed")
-}
-
-func generateFilesString(filesMap map[string][]string) (filesString string) {
-	for remote, files := range filesMap {
-		filesString += fmt.Sprintf("Remote: %s\n", remote)
-		for _, file := range files {
-			filesString += fmt.Sprintf("  - %s\n", file)
+		if applyErr != nil && ctx.Err() != nil {
+			// keep the changes applied before the interruption in the history
+			return append(results, result), notes(), ctx.Err()
+		}
+		result.fail(rp.remote, applyErr)
+		results = append(results, result)
+		if result.Error != nil {
+			logger.Error("Remote not synced", "remote", rp.remote.String(), "outcome", result.Outcome,
+				"kind", result.Error.Kind, "changes", result.changes(), "error", result.Error.Err)
+			continue
 		}
+		logger.Info("Remote synced", "remote", rp.remote.String(), "added", len(result.Added),
+			"updated", len(result.Updated), "deleted", len(result.Deleted), "bytes", result.Bytes)
 	}
-	return
+	return results, notes(), nil
 }
 
-func downloadFile(client *gowebdav.Client, remoteFilePath, localFilePath string) error {
-	log.Printf("Downloading file %s to %s\n", remoteFilePath, localFilePath)
+// downloadFile downloads a remote file, limiting the download speed to bandwidthLimit bytes per second if it is not 0.
+func downloadFile(ctx context.Context, client *gowebdav.Client, remoteFilePath, localFilePath string,
+	bandwidthLimit int64) error {
+	loggerFrom(ctx).Debug("Downloading file", "remote_path", remoteFilePath, "local_path", localFilePath)
 	remoteFileReader, err := client.ReadStream(remoteFilePath) // Assuming ReadStream returns an io.ReadCloser
 	if err != nil {
 		return fmt.Errorf("error reading remote file %s: %w", remoteFilePath, err)
@@ -240,9 +151,13 @@ func downloadFile(client *gowebdav.Client, remoteFilePath, localFilePath string)
 	//nolint:errcheck
 	defer localFileWriter.Close()
 
-	if _, err = io.Copy(localFileWriter, remoteFileReader); err != nil {
+	var reader io.Reader = remoteFileReader
+	if bandwidthLimit > 0 {
+		reader = newThrottledReader(ctx, remoteFileReader, bandwidthLimit)
+	}
+	if _, err = io.Copy(localFileWriter, reader); err != nil {
 		return fmt.Errorf("error writing to local file %s: %w", localFilePath, err)
 	}
-	log.Println("Downloaded file", localFilePath)
+	loggerFrom(ctx).Info("Downloaded file", "path", localFilePath)
 	return nil
 }
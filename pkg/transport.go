@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// setupTransport builds the HTTP transport of the remote from its TLS and proxy options.
+func (r *Remote) setupTransport() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r.CAFile != "" {
+		pem, err := readRemoteFile("ca_file", r.CAFile)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_file %s", r.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if r.ClientCertFile != "" || r.ClientKeyFile != "" {
+		if r.ClientCertFile == "" || r.ClientKeyFile == "" {
+			return fmt.Errorf("client_cert_file and client_key_file must be set together")
+		}
+		cert, err := readRemoteFile("client_cert_file", r.ClientCertFile)
+		if err != nil {
+			return err
+		}
+		key, err := readRemoteFile("client_key_file", r.ClientKeyFile)
+		if err != nil {
+			return err
+		}
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if r.PinnedFingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(r.PinnedFingerprint, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return fmt.Errorf("pinned_fingerprint must be the hex encoded SHA-256 fingerprint of the certificate")
+		}
+		// the chain is not verified: the certificate is trusted if it matches the pinned fingerprint, even if it is
+		// self-signed or expired
+		//nolint:gosec
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("no certificate presented by %s", state.ServerName)
+			}
+			if sum := sha256.Sum256(state.PeerCertificates[0].Raw); !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("the certificate of %s does not match the pinned fingerprint", state.ServerName)
+			}
+			return nil
+		}
+	}
+	if r.ProxyURL != "" {
+		proxyURL, err := url.Parse(r.ProxyURL)
+		if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") {
+			return fmt.Errorf("invalid proxy_url %q: the scheme must be http, https or socks5", r.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	transport.TLSClientConfig = tlsConfig
+	r.transport = transport
+	return nil
+}
+
+func readRemoteFile(option, name string) ([]byte, error) {
+	if !filepath.IsAbs(name) {
+		return nil, fmt.Errorf("%s must be an absolute path", option)
+	}
+	content, err := os.ReadFile(filepath.Clean(name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", option, err)
+	}
+	return content, nil
+}
+
+// hostTransport routes the requests to the transport of the remote with the same host, so that the updates hosted on
+// a remote, e.g. a manifest on a Nextcloud share, use its TLS and proxy options. The other requests use the default
+// transport.
+type hostTransport struct {
+	transports map[string]http.RoundTripper
+	fallback   http.RoundTripper
+}
+
+func newHostTransport(remotes []Remote) *hostTransport {
+	t := &hostTransport{transports: map[string]http.RoundTripper{}, fallback: http.DefaultTransport}
+	for _, r := range remotes {
+		if _, ok := t.transports[r.remoteURL.Host]; !ok && r.transport != nil {
+			t.transports[r.remoteURL.Host] = r.transport
+		}
+	}
+	return t
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport, ok := t.transports[req.URL.Host]; ok {
+		return transport.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
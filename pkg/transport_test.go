@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCertificate generates a self-signed client certificate and returns the paths of the certificate and key.
+func writeClientCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestRemote_setupTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	mtls := httptest.NewUnstartedServer(srv.Config.Handler)
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	mtls.StartTLS()
+	t.Cleanup(mtls.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	certFile, keyFile := writeClientCertificate(t)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		name     string
+		remote   Remote
+		setupErr string
+		getErr   string
+	}{
+		{name: "system roots only", remote: Remote{URL: srv.URL}, getErr: "certificate"},
+		{name: "custom CA", remote: Remote{URL: srv.URL, CAFile: caFile}},
+		{name: "pinned fingerprint", remote: Remote{URL: srv.URL, PinnedFingerprint: fingerprint}},
+		{name: "wrong pinned fingerprint", remote: Remote{URL: srv.URL, PinnedFingerprint: "00" + fingerprint[2:]},
+			getErr: "does not match the pinned fingerprint"},
+		{name: "client certificate", remote: Remote{URL: mtls.URL, CAFile: caFile, ClientCertFile: certFile,
+			ClientKeyFile: keyFile}},
+		{name: "missing client certificate", remote: Remote{URL: mtls.URL, CAFile: caFile}, getErr: "certificate"},
+		{name: "proxy", remote: Remote{URL: "http://nextcloud.example.com", ProxyURL: proxy.URL}},
+		{name: "relative CA file", remote: Remote{URL: srv.URL, CAFile: "ca.pem"}, setupErr: "absolute path"},
+		{name: "missing CA file", remote: Remote{URL: srv.URL, CAFile: "/nonexistent/ca.pem"}, setupErr: "ca_file"},
+		{name: "invalid CA file", remote: Remote{URL: srv.URL, CAFile: keyFile}, setupErr: "no certificate found"},
+		{name: "key without certificate", remote: Remote{URL: srv.URL, ClientKeyFile: keyFile},
+			setupErr: "must be set together"},
+		{name: "invalid fingerprint", remote: Remote{URL: srv.URL, PinnedFingerprint: "abc"},
+			setupErr: "pinned_fingerprint"},
+		{name: "invalid proxy", remote: Remote{URL: srv.URL, ProxyURL: "ftp://proxy"}, setupErr: "invalid proxy_url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.remote.LocalPath = "books"
+			err := tt.remote.validateAndSetup(t.TempDir())
+			if tt.setupErr != "" {
+				assert.ErrorContains(t, err, tt.setupErr)
+				return
+			}
+			require.NoError(t, err)
+			client := &http.Client{Transport: tt.remote.transport}
+			resp, err := client.Get(tt.remote.URL)
+			if tt.getErr != "" {
+				assert.ErrorContains(t, err, tt.getErr)
+				return
+			}
+			require.NoError(t, err)
+			//nolint:errcheck
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		})
+	}
+	assert.Equal(t, []string{"http://nextcloud.example.com/"}, proxied)
+}
+
+func TestHostTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	remote := Remote{URL: srv.URL + "/s/token", LocalPath: "books", PinnedFingerprint: hex.EncodeToString(sum[:])}
+	require.NoError(t, remote.validateAndSetup(t.TempDir()))
+
+	// the update downloads from the remote host use the options of the remote
+	client := &http.Client{Transport: newHostTransport([]Remote{remote})}
+	resp, err := client.Get(srv.URL + "/updates/manifest.json")
+	require.NoError(t, err)
+	//nolint:errcheck
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// the other hosts use the default transport
+	_, err = (&http.Client{Transport: newHostTransport(nil)}).Get(srv.URL)
+	assert.ErrorContains(t, err, "certificate")
+}
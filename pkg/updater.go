@@ -0,0 +1,427 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// releasePublicKey is the minisign public key the releases are signed with. It is embedded at build time with
+// -ldflags "-X github.com/aleskandro/nextcloud-kobo-synchronizer/pkg.releasePublicKey=<key>", and the updates are
+// refused if it is not set.
+var releasePublicKey string
+
+const (
+	defaultUpdateAsset     = "KoboRoot.tgz"
+	defaultMaxUpdateSizeMB = 100
+
+	updateChannelStable     = "stable"
+	updateChannelPrerelease = "prerelease"
+	// maxListedReleases is the number of the most recent releases considered for the updates
+	maxListedReleases = 50
+
+	releaseFileName    = "nextcloud-kobo.tar.gz"
+	versionFileName    = "version.txt"
+	checksumsAssetName = "SHA256SUMS"
+	signatureAssetName = "SHA256SUMS.minisig"
+	// maxMetadataSize limits the size of the checksums and signature files
+	maxMetadataSize = 64 << 10
+)
+
+// updater downloads the releases from the update source and verifies it before storing it where the installer
+// expects it.
+type updater struct {
+	configPath string
+	// assetPattern is the name pattern of the release asset to install, with {arch} already replaced
+	assetPattern   string
+	maxSize        int64
+	channel        string
+	pinVersion     string
+	allowDowngrade bool
+	source         updateSource
+	httpClient     *http.Client
+	publicKey      string
+	// blacklist are the versions rolled back after a failed update
+	blacklist []string
+}
+
+func newUpdater(config *Config) (*updater, error) {
+	httpClient := &http.Client{Transport: newHostTransport(config.Remotes), Timeout: 10 * time.Minute}
+	source, err := newUpdateSource(config, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	var blacklist []string
+	if state, err := loadUpdateState(config.configPath); err != nil {
+		slog.Warn("Failed to read the blacklisted versions", "error", err)
+	} else {
+		blacklist = state.Blacklist
+	}
+	return &updater{
+		configPath:     config.configPath,
+		assetPattern:   strings.ReplaceAll(config.UpdateAsset, "{arch}", runtime.GOARCH),
+		maxSize:        config.MaxUpdateSizeMB << 20,
+		channel:        config.UpdateChannel,
+		pinVersion:     config.PinVersion,
+		allowDowngrade: config.AllowDowngrade,
+		source:         source,
+		httpClient:     httpClient,
+		publicKey:      releasePublicKey,
+		blacklist:      blacklist,
+	}, nil
+}
+
+// currentVersion returns the version of the running binary or, if it is unknown or not a version, e.g. a commit hash,
+// the version stored in the version file when the last update was downloaded. It returns the version of the binary if
+// both are unknown.
+func (u *updater) currentVersion() (string, error) {
+	running := RunningVersion()
+	if _, _, err := parseBuildVersion(running); err == nil {
+		return running, nil
+	}
+	version, err := os.ReadFile(path.Join(u.configPath, versionFileName))
+	if os.IsNotExist(err) {
+		return running, nil
+	}
+	return strings.TrimSpace(string(version)), err
+}
+
+// selectUpdate returns the release to install, or nil if the current version is up to date. The pinned version is
+// always selected if set; otherwise the highest version of the channel is selected if it is newer than the current
+// one, or older and downgrades are allowed. Drafts, blacklisted versions and releases whose tag is not a semantic
+// version are ignored.
+func (u *updater) selectUpdate(current string, releases []*release) (*release, error) {
+	var (
+		selected        *release
+		selectedVersion *semver
+	)
+	for _, release := range releases {
+		version, err := parseSemver(release.Tag)
+		if err != nil || release.Draft || u.isBlacklisted(version) {
+			continue
+		}
+		if u.pinVersion != "" {
+			pinned, _ := parseSemver(u.pinVersion)
+			if version.compare(pinned) == 0 {
+				selected, selectedVersion = release, version
+				break
+			}
+			continue
+		}
+		if (version.isPrerelease() || release.Prerelease) && u.channel != updateChannelPrerelease {
+			continue
+		}
+		if selectedVersion == nil || version.compare(selectedVersion) > 0 {
+			selected, selectedVersion = release, version
+		}
+	}
+	if selected == nil {
+		if u.pinVersion != "" {
+			return nil, fmt.Errorf("pinned version %s not found", u.pinVersion)
+		}
+		return nil, fmt.Errorf("no %s release found", u.channel)
+	}
+	currentVersion, dev, err := parseBuildVersion(current)
+	if err != nil {
+		slog.Warn("Current version is unknown, updating", "current", current, "release", selected.Tag)
+		return selected, nil
+	}
+	switch c := selectedVersion.compare(currentVersion); {
+	case c == 0:
+		if dev {
+			slog.Info("Development build of the release, not updating", "release", selected.Tag, "current", current)
+		}
+		return nil, nil
+	case c < 0 && u.pinVersion == "" && !u.allowDowngrade:
+		slog.Info("Release is older than the current version, not downgrading", "release", selected.Tag,
+			"current", current)
+		return nil, nil
+	}
+	return selected, nil
+}
+
+// isBlacklisted returns true if version was rolled back after a failed update.
+func (u *updater) isBlacklisted(version *semver) bool {
+	for _, blacklisted := range u.blacklist {
+		if v, err := parseSemver(blacklisted); err == nil && v.compare(version) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// install downloads the release and verifies its checksum, after having verified the signature of the checksums file.
+// The release is saved with its final name, and the version file updated, only if all the checks pass: on failure,
+// the current installation is left untouched.
+func (u *updater) install(ctx context.Context, release *release) error {
+	publicKey, err := parseMinisignPublicKey(u.publicKey)
+	if err != nil {
+		return fmt.Errorf("no valid release public key embedded: %w", err)
+	}
+	tarball, checksums, signature, err := findReleaseAssets(release, u.assetPattern)
+	if err != nil {
+		return err
+	}
+	if tarball.Size > u.maxSize {
+		return fmt.Errorf("release asset %s is larger than %d MB", tarball.Name, u.maxSize>>20)
+	}
+	if checksums == nil || signature == nil {
+		return fmt.Errorf("release %s is not signed", release.Tag)
+	}
+
+	checksumsContent := &bytes.Buffer{}
+	if err = u.fetch(ctx, checksums.URL, checksumsContent, maxMetadataSize); err != nil {
+		return fmt.Errorf("failed to download the checksums: %w", err)
+	}
+	signatureContent := &bytes.Buffer{}
+	if err = u.fetch(ctx, signature.URL, signatureContent, maxMetadataSize); err != nil {
+		return fmt.Errorf("failed to download the signature: %w", err)
+	}
+	if err = publicKey.Verify(checksumsContent.Bytes(), signatureContent.Bytes()); err != nil {
+		return fmt.Errorf("invalid checksums signature: %w", err)
+	}
+	expectedChecksum, err := findChecksum(checksumsContent.Bytes(), tarball.Name)
+	if err != nil {
+		return err
+	}
+
+	partialPath := path.Join(u.configPath, releaseFileName+".part")
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return fmt.Errorf("failed to create release file: %w", err)
+	}
+	defer func() {
+		//nolint:errcheck
+		file.Close()
+		//nolint:errcheck
+		os.Remove(partialPath)
+	}()
+	hash := sha256.New()
+	if err = u.fetch(ctx, tarball.URL, io.MultiWriter(file, hash), u.maxSize); err != nil {
+		return fmt.Errorf("failed to download the release: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to write the release file: %w", err)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != expectedChecksum {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", tarball.Name, expectedChecksum, checksum)
+	}
+	// the tarball is extracted in / as root: make sure it cannot write anywhere else than our own paths
+	if err = validateReleaseArchive(partialPath, u.maxSize); err != nil {
+		return err
+	}
+
+	if err = os.Rename(partialPath, path.Join(u.configPath, releaseFileName)); err != nil {
+		return fmt.Errorf("failed to save the release file: %w", err)
+	}
+	if err = os.WriteFile(path.Join(u.configPath, versionFileName), []byte(release.Tag), 0600); err != nil {
+		return fmt.Errorf("failed to write version file: %w", err)
+	}
+	return nil
+}
+
+// fetch downloads url into w. If limit is not negative, downloads larger than limit bytes fail.
+func (u *updater) fetch(ctx context.Context, url string, w io.Writer, limit int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if limit >= 0 {
+		body = io.LimitReader(resp.Body, limit+1)
+	}
+	written, err := io.Copy(w, body)
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && written > limit {
+		return fmt.Errorf("file larger than %d bytes", limit)
+	}
+	return nil
+}
+
+// findReleaseAssets returns the tarball, checksums and signature assets of a release. The tarball is the only asset
+// matching pattern: the release is rejected if no asset or more than one asset matches.
+func findReleaseAssets(release *release, pattern string) (tarball, checksums, signature *releaseAsset, err error) {
+	for _, asset := range release.Assets {
+		switch name := asset.Name; {
+		case name == checksumsAssetName:
+			checksums = asset
+		case name == signatureAssetName:
+			signature = asset
+		default:
+			if matched, _ := path.Match(pattern, name); !matched {
+				continue
+			}
+			if tarball != nil {
+				return nil, nil, nil, fmt.Errorf("release %s has more than one asset matching %s: %s and %s",
+					release.Tag, pattern, tarball.Name, name)
+			}
+			tarball = asset
+		}
+	}
+	if tarball == nil {
+		err = fmt.Errorf("release %s has no asset matching %s", release.Tag, pattern)
+	}
+	return
+}
+
+// findChecksum looks up the SHA-256 checksum of a file in a checksums file in the sha256sum format.
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum found for %s", name)
+}
+
+// pendingVersion returns the version of the update downloaded but not applied yet, if any.
+func (u *updater) pendingVersion() string {
+	return pendingUpdateVersion(u.configPath)
+}
+
+func pendingUpdateVersion(configPath string) string {
+	if _, err := os.Stat(path.Join(configPath, releaseFileName)); err != nil {
+		return ""
+	}
+	version, err := os.ReadFile(path.Join(configPath, versionFileName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// findUpdate returns the updater, the current version and the release to install, or nil if the current version is
+// up to date.
+func findUpdate(ctx context.Context, config *Config) (*updater, string, *release, error) {
+	u, err := newUpdater(config)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to set up the updater: %w", err)
+	}
+	releases, err := u.source.Releases(ctx)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to get the releases: %w", err)
+	}
+	version, err := u.currentVersion()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to read the version file: %w", err)
+	}
+	release, err := u.selectUpdate(version, releases)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to select the update: %w", err)
+	}
+	return u, version, release, nil
+}
+
+// UpdateCheck is the outcome of CheckUpdate.
+type UpdateCheck struct {
+	// Current is the running version, empty if unknown
+	Current string
+	// Available is the version to update to, empty if the current version is up to date
+	Available string
+	// Pending is the version downloaded and applied at the next start, if any
+	Pending string
+}
+
+// CheckUpdate looks for the update to install, according to the update options of the configuration.
+func CheckUpdate(ctx context.Context, config *Config) (*UpdateCheck, error) {
+	u, version, release, err := findUpdate(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	check := &UpdateCheck{Current: version, Pending: u.pendingVersion()}
+	if release != nil {
+		check.Available = release.Tag
+	}
+	return check, nil
+}
+
+// DownloadUpdate downloads and verifies the available update, so that it is applied at the next start. It returns
+// the version of the pending update, that may have been downloaded before, or an empty string if the current version
+// is up to date.
+func DownloadUpdate(ctx context.Context, config *Config) (string, error) {
+	u, _, release, err := findUpdate(ctx, config)
+	if err != nil || release == nil {
+		return "", err
+	}
+	if u.pendingVersion() == release.Tag {
+		return release.Tag, nil
+	}
+	if err = u.install(ctx, release); err != nil {
+		return "", fmt.Errorf("update to %s failed: %w", release.Tag, err)
+	}
+	return release.Tag, nil
+}
+
+// updateNow downloads the update, if any, and returns its version. It returns an empty string if no update has been
+// downloaded.
+func (n *NetworkConnectionReconciler) updateNow(ctx context.Context) string {
+	logger := loggerFrom(ctx)
+	u, version, release, err := findUpdate(ctx, n.config)
+	if err != nil {
+		// If we can't get the releases, don't update
+		logger.Warn("Failed to check for updates", "error", err)
+		return ""
+	}
+	if release == nil {
+		logger.Info("Already up to date", "version", version)
+		return ""
+	}
+	if u.pendingVersion() == release.Tag {
+		logger.Info("Update already downloaded, it will be applied at the next start", "release", release.Tag)
+		return ""
+	}
+	logger.Info("Updating", "current", version, "release", release.Tag)
+	if err = u.install(ctx, release); err != nil {
+		logger.Error("Auto update failed", "error", err)
+		n.toast(ctx, n.config.text(msgUpdateFailed, msgData{"Version": release.Tag, "Error": err.Error()}))
+		return ""
+	}
+	logger.Info("Auto update successful", "release", release.Tag)
+	return release.Tag
+}
+
+// applyUpdateNow returns true if the downloaded update has to be applied right away, restarting the daemon. If the
+// confirm policy asks for it, the user can postpone the update to the next boot.
+func (n *NetworkConnectionReconciler) applyUpdateNow(ctx context.Context, version string) bool {
+	if !n.config.Confirm.Update {
+		n.toast(ctx, n.config.text(msgUpdateRestarting, msgData{"Version": version}))
+		return true
+	}
+	timeout := time.Duration(n.config.Confirm.TimeoutSeconds) * time.Second
+	data := msgData{"Version": version}
+	accepted, err := n.confirm(ctx, timeout, n.config.text(msgUpdateTitle, data), n.config.text(msgUpdateBody, data),
+		n.config.text(msgUpdateAccept, data), n.config.text(msgUpdateReject, data))
+	if err != nil {
+		loggerFrom(ctx).Warn("Update not confirmed", "error", err)
+	}
+	if !accepted {
+		n.toast(ctx, n.config.text(msgUpdateNextBoot, data))
+		return false
+	}
+	n.toast(ctx, n.config.text(msgUpdateApplying, data))
+	return true
+}
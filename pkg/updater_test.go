@@ -0,0 +1,338 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testSigner signs the test releases in the minisign format.
+type testSigner struct {
+	keyID   [8]byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := &testSigner{private: private, public: public}
+	_, err = rand.Read(s.keyID[:])
+	require.NoError(t, err)
+	return s
+}
+
+// PublicKey returns the public key in the format of a minisign .pub file.
+func (s *testSigner) PublicKey() string {
+	raw := append(append([]byte("Ed"), s.keyID[:]...), s.public...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw)
+}
+
+func (s *testSigner) Sign(message []byte) []byte {
+	digest := blake2b.Sum512(message)
+	sig := ed25519.Sign(s.private, digest[:])
+	trustedComment := "timestamp:1700000000\tfile:SHA256SUMS\thashed"
+	globalSig := ed25519.Sign(s.private, append(append([]byte{}, sig...), trustedComment...))
+	raw := append(append([]byte("ED"), s.keyID[:]...), sig...)
+	return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trustedComment, base64.StdEncoding.EncodeToString(globalSig)))
+}
+
+// testRelease is a release served by the fake GitHub server.
+type testRelease struct {
+	tag     string
+	assets  map[string][]byte
+	ordered []string
+}
+
+func newSignedRelease(signer *testSigner, tag string, tarball []byte) *testRelease {
+	sum := sha256.Sum256(tarball)
+	checksums := []byte(fmt.Sprintf("%s  KoboRoot.tgz\n", hex.EncodeToString(sum[:])))
+	return &testRelease{
+		tag: tag,
+		assets: map[string][]byte{
+			"KoboRoot.tgz":     tarball,
+			checksumsAssetName: checksums,
+			signatureAssetName: signer.Sign(checksums),
+		},
+		ordered: []string{checksumsAssetName, "KoboRoot.tgz", signatureAssetName},
+	}
+}
+
+// newFakeGitHub serves a release of owner/repo through the GitHub API and its assets.
+func newFakeGitHub(t *testing.T, release *testRelease) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		ghRelease := &github.RepositoryRelease{TagName: github.String(release.tag)}
+		for _, name := range release.ordered {
+			ghRelease.Assets = append(ghRelease.Assets, &github.ReleaseAsset{
+				Name:               github.String(name),
+				BrowserDownloadURL: github.String(srv.URL + "/download/" + name),
+			})
+		}
+		//nolint:errcheck
+		json.NewEncoder(w).Encode([]*github.RepositoryRelease{ghRelease})
+	})
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		content, ok := release.assets[filepath.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		//nolint:errcheck
+		w.Write(content)
+	})
+	return srv
+}
+
+func newTestUpdater(t *testing.T, srv *httptest.Server, publicKey string) *updater {
+	t.Helper()
+	u, err := newUpdater(&Config{configPath: t.TempDir(), RepoOwner: "owner", RepoName: "repo",
+		UpdateSource: updateSourceGitHub, UpdateURL: srv.URL, UpdateAsset: defaultUpdateAsset, MaxUpdateSizeMB: 1})
+	require.NoError(t, err)
+	u.publicKey = publicKey
+	return u
+}
+
+func TestUpdater_install(t *testing.T) {
+	signer := newTestSigner(t)
+	tarball := makeTarball(t, map[string]string{
+		"usr/local/nextcloud-kobo/nextcloud-kobo": "binary",
+		"usr/local/nextcloud-kobo/run.sh":         "#!/bin/sh",
+	})
+
+	tests := []struct {
+		name      string
+		release   func() *testRelease
+		publicKey string
+		errMsg    string
+	}{
+		{
+			name:      "good release",
+			release:   func() *testRelease { return newSignedRelease(signer, "v1.1.0", tarball) },
+			publicKey: signer.PublicKey(),
+		},
+		{
+			name: "tampered tarball",
+			release: func() *testRelease {
+				r := newSignedRelease(signer, "v1.1.0", tarball)
+				r.assets["KoboRoot.tgz"] = []byte("a malicious tarball")
+				return r
+			},
+			publicKey: signer.PublicKey(),
+			errMsg:    "checksum mismatch",
+		},
+		{
+			name: "tampered checksums",
+			release: func() *testRelease {
+				r := newSignedRelease(signer, "v1.1.0", tarball)
+				sum := sha256.Sum256([]byte("a malicious tarball"))
+				r.assets["KoboRoot.tgz"] = []byte("a malicious tarball")
+				r.assets[checksumsAssetName] = []byte(hex.EncodeToString(sum[:]) + "  KoboRoot.tgz\n")
+				return r
+			},
+			publicKey: signer.PublicKey(),
+			errMsg:    "signature verification failed",
+		},
+		{
+			name:      "signed with another key",
+			release:   func() *testRelease { return newSignedRelease(signer, "v1.1.0", tarball) },
+			publicKey: newTestSigner(t).PublicKey(),
+			errMsg:    "invalid checksums signature",
+		},
+		{
+			name: "unsigned release",
+			release: func() *testRelease {
+				r := newSignedRelease(signer, "v1.1.0", tarball)
+				r.ordered = []string{"KoboRoot.tgz"}
+				return r
+			},
+			publicKey: signer.PublicKey(),
+			errMsg:    "is not signed",
+		},
+		{
+			name: "other assets are ignored",
+			release: func() *testRelease {
+				r := newSignedRelease(signer, "v1.1.0", tarball)
+				r.assets["nextcloud-kobo-linux-amd64.tar.gz"] = []byte("desktop build")
+				r.ordered = append([]string{"nextcloud-kobo-linux-amd64.tar.gz"}, r.ordered...)
+				return r
+			},
+			publicKey: signer.PublicKey(),
+		},
+		{
+			name: "archive writing outside of the allowed paths",
+			release: func() *testRelease {
+				return newSignedRelease(signer, "v1.1.0", makeTarball(t, map[string]string{
+					"usr/local/nextcloud-kobo/nextcloud-kobo": "binary",
+					"etc/init.d/rcS": "malicious",
+				}))
+			},
+			publicKey: signer.PublicKey(),
+			errMsg:    "etc/init.d/",
+		},
+		{
+			name: "oversized archive",
+			release: func() *testRelease {
+				return newSignedRelease(signer, "v1.1.0", makeTarball(t, map[string]string{
+					"usr/local/nextcloud-kobo/nextcloud-kobo": strings.Repeat("a", 2<<20),
+				}))
+			},
+			publicKey: signer.PublicKey(),
+			errMsg:    "larger than",
+		},
+		{
+			name:    "no public key embedded",
+			release: func() *testRelease { return newSignedRelease(signer, "v1.1.0", tarball) },
+			errMsg:  "no valid release public key embedded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, newFakeGitHub(t, tt.release()), tt.publicKey)
+			require.NoError(t, os.WriteFile(filepath.Join(u.configPath, versionFileName), []byte("v1.0.0"), 0600))
+
+			releases, err := u.source.Releases(context.Background())
+			require.NoError(t, err)
+			release, err := u.selectUpdate("v1.0.0", releases)
+			require.NoError(t, err)
+			err = u.install(context.Background(), release)
+
+			version, _ := os.ReadFile(filepath.Join(u.configPath, versionFileName))
+			entries, _ := os.ReadDir(u.configPath)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				// the current installation is left untouched
+				assert.Equal(t, "v1.0.0", string(version))
+				assert.Len(t, entries, 1)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "v1.1.0", string(version))
+			content, err := os.ReadFile(filepath.Join(u.configPath, releaseFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, tarball, content)
+			assert.Len(t, entries, 2)
+		})
+	}
+}
+
+func TestFindReleaseAssets(t *testing.T) {
+	release := &release{Tag: "v1.1.0"}
+	for _, name := range []string{"KoboRoot-arm.tgz", "KoboRoot-amd64.tgz", checksumsAssetName} {
+		release.Assets = append(release.Assets, &releaseAsset{Name: name})
+	}
+
+	tarball, checksums, signature, err := findReleaseAssets(release, "KoboRoot-arm.tgz")
+	assert.NoError(t, err)
+	assert.Equal(t, "KoboRoot-arm.tgz", tarball.Name)
+	assert.Equal(t, checksumsAssetName, checksums.Name)
+	assert.Nil(t, signature)
+
+	_, _, _, err = findReleaseAssets(release, "KoboRoot-*.tgz")
+	assert.ErrorContains(t, err, "more than one asset")
+
+	_, _, _, err = findReleaseAssets(release, "KoboRoot.tgz")
+	assert.ErrorContains(t, err, "no asset matching")
+}
+
+func TestUpdater_selectUpdate(t *testing.T) {
+	var releases []*release
+	for _, r := range []struct {
+		tag        string
+		prerelease bool
+		draft      bool
+	}{
+		{tag: "v1.3.0", draft: true},
+		{tag: "v1.3.0-rc.1", prerelease: true},
+		{tag: "v1.2.0"},
+		{tag: "nightly", prerelease: true},
+		{tag: "v1.1.0"},
+		{tag: "v1.0.0"},
+	} {
+		releases = append(releases, &release{Tag: r.tag, Prerelease: r.prerelease, Draft: r.draft})
+	}
+
+	tests := []struct {
+		name     string
+		updater  updater
+		current  string
+		expected string
+		errMsg   string
+	}{
+		{name: "update", updater: updater{channel: updateChannelStable}, current: "v1.1.0", expected: "v1.2.0"},
+		{name: "up to date", updater: updater{channel: updateChannelStable}, current: "1.2.0"},
+		{name: "unknown version", updater: updater{channel: updateChannelStable}, current: "", expected: "v1.2.0"},
+		{name: "development build", updater: updater{channel: updateChannelStable}, current: "v1.2.0-3-gabc1234"},
+		{name: "dirty build", updater: updater{channel: updateChannelStable}, current: "v1.2.0-dirty"},
+		{name: "development build of an older release", updater: updater{channel: updateChannelStable},
+			current: "v1.1.0-3-gabc1234-dirty", expected: "v1.2.0"},
+		{name: "commit hash", updater: updater{channel: updateChannelStable}, current: "abc1234", expected: "v1.2.0"},
+		{name: "no downgrade", updater: updater{channel: updateChannelStable}, current: "v1.3.0-rc.1"},
+		{name: "downgrade allowed", updater: updater{channel: updateChannelStable, allowDowngrade: true},
+			current: "v1.3.0-rc.1", expected: "v1.2.0"},
+		{name: "pre-release channel", updater: updater{channel: updateChannelPrerelease}, current: "v1.2.0",
+			expected: "v1.3.0-rc.1"},
+		{name: "pinned", updater: updater{channel: updateChannelStable, pinVersion: "1.0.0"}, current: "v1.2.0",
+			expected: "v1.0.0"},
+		{name: "pinned and up to date", updater: updater{channel: updateChannelStable, pinVersion: "v1.0.0"},
+			current: "v1.0.0"},
+		{name: "pinned version not found", updater: updater{channel: updateChannelStable, pinVersion: "v0.9.0"},
+			current: "v1.0.0", errMsg: "pinned version v0.9.0 not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := tt.updater.selectUpdate(tt.current, releases)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.expected == "" {
+				assert.Nil(t, release)
+				return
+			}
+			assert.Equal(t, tt.expected, release.Tag)
+		})
+	}
+}
+
+func TestUpdater_currentVersion(t *testing.T) {
+	original := Version
+	t.Cleanup(func() { Version = original })
+	u := &updater{configPath: t.TempDir()}
+	Version = "abc1234"
+	// without the version file, the commit hash is reported as the unknown version
+	version, err := u.currentVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "abc1234", version)
+
+	writeTestFile(t, filepath.Join(u.configPath, versionFileName), "v1.2.0\n")
+	version, err = u.currentVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "v1.2.0", version)
+	Version = "v1.2.0-3-gabc1234"
+	version, err = u.currentVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "v1.2.0-3-gabc1234", version)
+}
@@ -1,7 +1,9 @@
 package pkg
 
 import (
-	"log"
+	"context"
+	"io"
+	"log/slog"
 	"os"
 	"path"
 	"time"
@@ -9,20 +11,28 @@ import (
 
 func shouldDownloadFile(localFilePath string, remoteModTime time.Time, size int64) bool {
 	info, err := os.Stat(localFilePath)
-	log.Println("Checking existence of ", localFilePath)
+	slog.Debug("Checking the local file", "path", localFilePath)
 	return err != nil || info.Size() != size || remoteModTime.After(info.ModTime())
 }
 
-func removeRemotelyDeletedFiles(localFileMap map[string]string, localPath string) (err error) {
+// listRemotelyDeletedFiles returns the files and directories in localPath that are not in localFileMap.
+func listRemotelyDeletedFiles(localFileMap map[string]string, localPath string) (deletions []string) {
 	files, _ := os.ReadDir(localPath)
 	for _, file := range files {
 		localFilePath := path.Join(localPath, file.Name())
 		if _, ok := localFileMap[localFilePath]; !ok {
-			log.Println("Removing file", file.Name(), localFilePath)
-			err = os.RemoveAll(localFilePath)
-			if err != nil {
-				return
-			}
+			deletions = append(deletions, localFilePath)
+		}
+	}
+	return
+}
+
+func removeLocalFiles(localFilePaths []string) (err error) {
+	for _, localFilePath := range localFilePaths {
+		slog.Info("Removing file", "path", localFilePath)
+		err = os.RemoveAll(localFilePath)
+		if err != nil {
+			return
 		}
 	}
 	return
@@ -34,3 +44,36 @@ func ensureDirExists(dir string) error {
 	}
 	return nil
 }
+
+// throttledReader limits the average read speed of the wrapped reader to a number of bytes per second.
+type throttledReader struct {
+	ctx         context.Context
+	reader      io.Reader
+	bytesPerSec int64
+	start       time.Time
+	read        int64
+}
+
+func newThrottledReader(ctx context.Context, reader io.Reader, bytesPerSec int64) *throttledReader {
+	return &throttledReader{ctx: ctx, reader: reader, bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// read at most a tenth of a second worth of data at a time to keep the speed smooth
+	if chunk := max(t.bytesPerSec/10, 1); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.reader.Read(p)
+	t.read += int64(n)
+	expected := time.Duration(float64(t.read) / float64(t.bytesPerSec) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
@@ -1,6 +1,9 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -112,8 +115,12 @@ func TestRemoveRemotelyDeletedFiles(t *testing.T) {
 		path.Join(localDir, "file1.txt"): "",
 	}
 
-	// Run the function to test
-	err = removeRemotelyDeletedFiles(remoteFiles, localDir)
+	// Run the functions to test
+	deletions := listRemotelyDeletedFiles(remoteFiles, localDir)
+	if len(deletions) != 1 || deletions[0] != localFile2 {
+		t.Fatalf("expected only file2.txt to be listed for deletion, got %v", deletions)
+	}
+	err = removeLocalFiles(deletions)
 	if err != nil {
 		t.Fatalf("Function returned an error: %v", err)
 	}
@@ -126,3 +133,25 @@ func TestRemoveRemotelyDeletedFiles(t *testing.T) {
 		t.Errorf("file2.txt should have been deleted")
 	}
 }
+
+func TestThrottledReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 2048)
+	start := time.Now()
+	read, err := io.ReadAll(newThrottledReader(context.Background(), bytes.NewReader(data), 8192))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("read data does not match")
+	}
+	// 2 KiB at 8 KiB/s
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the read to be throttled, it took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = io.ReadAll(newThrottledReader(ctx, bytes.NewReader(data), 1024)); err == nil {
+		t.Errorf("expected the read to be interrupted by the context")
+	}
+}
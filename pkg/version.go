@@ -0,0 +1,21 @@
+package pkg
+
+import (
+	"runtime/debug"
+)
+
+// Version is the version of the running binary. It is set at build time with
+// -ldflags "-X github.com/aleskandro/nextcloud-kobo-synchronizer/pkg.Version=<version>".
+var Version string
+
+// RunningVersion returns the version embedded in the binary, either at link time or by the go toolchain in the build
+// info. It returns an empty string if the version is unknown, e.g. for development builds.
+func RunningVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
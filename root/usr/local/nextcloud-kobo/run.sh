@@ -1,35 +1,47 @@
 #!/bin/sh
 
-if pgrep "nextcloud-kobo"; then
-    echo "nextcloud-kobo is already running"
-    exit 0
-fi
+BIN=/usr/local/nextcloud-kobo/nextcloud-kobo
+BACKUP_BIN=/usr/local/nextcloud-kobo.backup/usr/local/nextcloud-kobo/nextcloud-kobo
+CONFIG=/mnt/onboard/.adds/nextcloud-kobo/config.yaml
+# The daemon writes and rotates its own log, nextcloud-kobo.log. This one only gets what it cannot log itself, e.g.
+# the panics
+LOG=/mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.stderr.log
 
 mkdir -p /mnt/onboard/.adds/nextcloud-kobo
 mkdir -p /mnt/onboard/nextcloud
 cp /usr/local/nextcloud-kobo/config.example.yaml /mnt/onboard/.adds/nextcloud-kobo/config.example.yaml
 
-if [ ! -f /mnt/onboard/.adds/nextcloud-kobo/config.yaml ]; then
+if [ ! -f "$CONFIG" ]; then
     echo "Configuration file not found. Do not run."
     qndb -m mwcToast 5000 "NextCloud-Kobo" "Configuration file not found. Not running."
     exit 0
 fi
 
-# Clean the log file if the size is greater than 2MB
-if [ -f /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log ] && \
-  [ "$(stat -c %s /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log)" -gt 2097152 ]; then
+# Clean the stderr log file if the size is greater than 2MB
+if [ -f "$LOG" ] && [ "$(stat -c %s "$LOG")" -gt 2097152 ]; then
         echo "Log file is greater than 2MB. Cleaning it."
-        echo "" > /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log
+        echo "" > "$LOG"
+fi
+# The supervisor applies the pending update, runs the daemon and restarts it when it exits. It holds a lock, so that
+# the instances started when udev fires the rule more than once exit at once (7).
+(attempts=0
+while true; do
+"$BIN" -config-file "$CONFIG" -base-path /mnt/onboard/nextcloud supervise -backup-binary "$BACKUP_BIN" >> "$LOG" 2>&1
+status=$?
+# The installation changed: reload this script too
+if [ $status -eq 3 ]; then
+  exec /bin/sh /usr/local/nextcloud-kobo/run.sh
+fi
+# 0: stopped, 7: already running
+if [ $status -eq 0 ] || [ $status -eq 7 ] || [ ! -x "$BACKUP_BIN" ] || [ $attempts -ge 3 ]; then
+  exit $status
 fi
-(while true; do
-/usr/local/nextcloud-kobo/nextcloud-kobo -config-file /mnt/onboard/.adds/nextcloud-kobo/config.yaml \
-  -base-path /mnt/onboard/nextcloud >> /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log 2>&1
-# Update
-if [ -f /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.tar.gz ]; then
-  echo "$(date) Updating NextCloud-Kobo" >> /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log
-  tar -xzf /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.tar.gz -C /
-  rm /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.tar.gz
-  echo "$(date) NextCloud-Kobo updated" >> /mnt/onboard/.adds/nextcloud-kobo/nextcloud-kobo.log
+# The installed binary cannot even run: let the previous one count the failed starts and roll the update back.
+# -prestart is a flag, not a command, so that every version understands it.
+attempts=$((attempts + 1))
+"$BACKUP_BIN" -config-file "$CONFIG" -prestart -apply-update=false >> "$LOG" 2>&1
+if [ $? -eq 3 ]; then
   exec /bin/sh /usr/local/nextcloud-kobo/run.sh
 fi
+sleep 10
 done) &